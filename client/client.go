@@ -0,0 +1,479 @@
+// Package client speaks the Hug protocol to an IM server. It is meant for
+// bots, integration tools and tests:
+//
+//	c, err := client.Dial("im.example.com:5222", client.Handlers{
+//		Message: func(msg messages.Message) { ... },
+//	})
+//	res, err := c.SignIn(account, password, users.TerminalType_PC)
+//	presences, err := c.GetPresences(cmdhandler.GetPresencesReqPkt{})
+//
+// Requests may be sent from any goroutine, including from handlers, and are
+// matched to their responses by Sid.
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hug/core/corps"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/rosters"
+	"hug/core/users"
+	"hug/imserver/cmdhandler"
+	"hug/imserver/connections"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds the wait for a response, unless Client.Timeout is set.
+const DefaultTimeout = 10 * time.Second
+
+var ErrClosed = errors.New("client: connection closed")
+var ErrTimeout = errors.New("client: response timeout")
+
+// PacketError is returned when the server answers with a Pkt_Type_Error
+// packet, e.g. connections.PktErr_RateLimited.
+type PacketError struct {
+	Cmd  uint8
+	Code int8
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("client: cmd 0x%02x error code %d", e.Cmd, e.Code)
+}
+
+// AuthError is returned by Auth when the server refused the credentials.
+type AuthError struct {
+	Code int8
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("client: auth error code %d", e.Code)
+}
+
+// Handlers are called for requests initiated by the server, one at a time
+// and in the order they arrived. Nil handlers are skipped. If
+// Capability_MsgAck was negotiated, a message is acknowledged once Message
+// returned.
+type Handlers struct {
+	Message              func(msg messages.Message)
+	Conflict             func()
+	Shutdown             func(n cmdhandler.ShutdownNotificationPacket)
+	SessionRevoked       func()
+	UserInfoChanged      func(n users.UserInfoChangedNotificationPkt)
+	UserStatusChanged    func(n users.UserStatusChangedNotificationPkt)
+	CorpChanged          func(n corps.CorpChangedNotification)
+	GroupChanged         func(n groups.GroupChangedNotification)
+	RosterChanged        func(n rosters.RosterChangedNotification)
+	RosterRequest        func(r rosters.RosterRequest)
+	RosterRequestHandled func(n rosters.HandleRosterRequestNotification)
+	PresenceChanged      func(n cmdhandler.PresenceChangedNotification)
+	ChatState            func(s cmdhandler.ChatStatePkt)
+	Receipt              func(n messages.ReceiptNotification)
+	// Other receives every other request, e.g. file transfers.
+	Other func(pkt connections.Packet)
+	// Closed is called once when the connection is closed, with the error
+	// which closed it.
+	Closed func(err error)
+	// Error is called when a request of the server cannot be decoded.
+	Error func(cmd uint8, err error)
+}
+
+// Client is a connection to an IM server.
+type Client struct {
+	Timeout time.Duration
+
+	conn          net.Conn
+	handlers      Handlers
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	sid           uint16
+	pending       map[uint16](chan connections.Packet)
+	codec         connections.Codec
+	capabilities  uint32
+	notifications chan connections.Packet
+	closed        chan bool
+	closeOnce     sync.Once
+	err           error
+}
+
+// Dial connects to the plaintext listener at address.
+func Dial(address string, handlers Handlers) (c *Client, err error) {
+	conn, err := net.DialTimeout("tcp", address, DefaultTimeout)
+	if err != nil {
+		return
+	}
+	c = New(conn, handlers)
+	return
+}
+
+// New speaks the protocol over conn, e.g. a tls.Conn or one end of a
+// net.Pipe in tests. The client owns conn from now on.
+func New(conn net.Conn, handlers Handlers) (c *Client) {
+	c = &Client{
+		conn:          conn,
+		handlers:      handlers,
+		pending:       make(map[uint16](chan connections.Packet)),
+		codec:         connections.JsonCodec,
+		notifications: make(chan connections.Packet, 256),
+		closed:        make(chan bool),
+	}
+	go c.readLoop()
+	go c.dispatchLoop()
+	return
+}
+
+// Close closes the connection. Pending calls return ErrClosed.
+func (c *Client) Close() error {
+	c.close(ErrClosed)
+	return nil
+}
+
+// Done is closed once the connection is closed.
+func (c *Client) Done() <-chan bool {
+	return c.closed
+}
+
+func (c *Client) close(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		c.lock.Unlock()
+		c.conn.Close()
+		close(c.closed)
+	})
+}
+
+func (c *Client) closeErr() (err error) {
+	c.lock.Lock()
+	err = c.err
+	c.lock.Unlock()
+	return
+}
+
+func (c *Client) getCodec() (codec connections.Codec) {
+	c.lock.Lock()
+	codec = c.codec
+	c.lock.Unlock()
+	return
+}
+
+func (c *Client) writePacket(cmd uint8, pktType uint8, sid uint16, data []byte) (err error) {
+	buf, err := connections.PrepareSendPacket(cmd, pktType, 0, sid, data)
+	if err != nil {
+		return
+	}
+	c.writeLock.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout()))
+	_, err = c.conn.Write(buf)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close(err)
+	}
+	return
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (c *Client) marshal(codec connections.Codec, req interface{}) (data []byte, err error) {
+	if req == nil {
+		return
+	}
+	data, err = codec.Marshal(req)
+	return
+}
+
+// Call sends req as a cmd request and decodes the response into res. req
+// and res may be nil for commands without data.
+func (c *Client) Call(cmd uint8, req interface{}, res interface{}) (err error) {
+	return c.call(c.getCodec(), cmd, req, res)
+}
+
+func (c *Client) call(codec connections.Codec, cmd uint8, req interface{}, res interface{}) (err error) {
+	data, err := c.marshal(codec, req)
+	if err != nil {
+		return
+	}
+	resChan := make(chan connections.Packet, 1)
+	c.lock.Lock()
+	c.sid++
+	for _, ok := c.pending[c.sid]; ok || c.sid == 0; _, ok = c.pending[c.sid] {
+		c.sid++
+	}
+	sid := c.sid
+	c.pending[sid] = resChan
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, sid)
+		c.lock.Unlock()
+	}()
+
+	err = c.writePacket(cmd, connections.Pkt_Type_Request, sid, data)
+	if err != nil {
+		return
+	}
+	var pkt connections.Packet
+	select {
+	case pkt = <-resChan:
+	case <-c.closed:
+		return c.closeErr()
+	case <-time.After(c.timeout()):
+		return ErrTimeout
+	}
+	if pkt.PktType == connections.Pkt_Type_Error {
+		return &PacketError{Cmd: pkt.Cmd, Code: pkt.Code}
+	}
+	if res != nil && len(pkt.Data) > 0 {
+		err = codec.Unmarshal(pkt.Data, res)
+	}
+	return
+}
+
+// Send sends req as a cmd request which the server does not answer, such as
+// Cmd_ChatState.
+func (c *Client) Send(cmd uint8, req interface{}) (err error) {
+	data, err := c.marshal(c.getCodec(), req)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	c.sid++
+	sid := c.sid
+	c.lock.Unlock()
+	err = c.writePacket(cmd, connections.Pkt_Type_Request, sid, data)
+	return
+}
+
+// Auth authenticates the connection. The request and response of Cmd_Auth
+// are always JSON, later packets use msgpack if it was negotiated.
+func (c *Client) Auth(req cmdhandler.AuthReqPacket) (res cmdhandler.AuthResPacket, err error) {
+	err = c.call(connections.JsonCodec, cmdhandler.Cmd_Auth, req, &res)
+	if err != nil {
+		return
+	}
+	if res.Code != users.AuthCode_None {
+		err = &AuthError{Code: res.Code}
+		return
+	}
+	c.lock.Lock()
+	c.capabilities = res.Capabilities
+	if res.Capabilities&users.Capability_MsgPack != 0 {
+		c.codec = connections.MsgpackCodec
+	}
+	c.lock.Unlock()
+	return
+}
+
+func (c *Client) hasCapability(capability uint32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.capabilities&capability == capability
+}
+
+// ackMsg answers the Cmd_Msg request sid with the id of the message, so the
+// server no longer keeps it waiting to send.
+func (c *Client) ackMsg(sid uint16, mid int64) {
+	data, err := c.marshal(c.getCodec(), messages.MessageResPacket{Mid: mid})
+	if err == nil {
+		c.writePacket(cmdhandler.Cmd_Msg, connections.Pkt_Type_Response, sid, data)
+	}
+}
+
+// SignIn authenticates with account and password, asking for the current
+// protocol version and every capability the server implements.
+func (c *Client) SignIn(account, password string, terminalType int16) (res cmdhandler.AuthResPacket, err error) {
+	return c.Auth(cmdhandler.AuthReqPacket{
+		User:            base64.StdEncoding.EncodeToString([]byte(account)),
+		Password:        base64.StdEncoding.EncodeToString([]byte(password)),
+		TerminalType:    terminalType,
+		ProtocolVersion: users.ProtocolVersion_Current,
+		Capabilities:    users.ServerCapabilities,
+	})
+}
+
+// Resume authenticates with the session token of a previous Auth.
+func (c *Client) Resume(token string, terminalType int16) (res cmdhandler.AuthResPacket, err error) {
+	return c.Auth(cmdhandler.AuthReqPacket{
+		Token:           token,
+		TerminalType:    terminalType,
+		ProtocolVersion: users.ProtocolVersion_Current,
+		Capabilities:    users.ServerCapabilities,
+	})
+}
+
+func (c *Client) readLoop() {
+	buf := make([]byte, 0, 4096)
+	readBuf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(readBuf)
+		if err != nil {
+			c.close(err)
+			close(c.notifications)
+			return
+		}
+		buf = append(buf, readBuf[:n]...)
+		for {
+			pkt, found := connections.ParseReceivedData(&buf)
+			if !found {
+				break
+			}
+			c.packetIn(pkt)
+		}
+	}
+}
+
+func (c *Client) packetIn(pkt connections.Packet) {
+	switch pkt.PktType {
+	case connections.Pkt_Type_Response, connections.Pkt_Type_Error:
+		c.lock.Lock()
+		resChan, ok := c.pending[pkt.Sid]
+		c.lock.Unlock()
+		if ok {
+			resChan <- pkt
+		}
+	case connections.Pkt_Type_Request:
+		if pkt.Cmd == cmdhandler.Cmd_Ping {
+			go c.writePacket(cmdhandler.Cmd_Ping, connections.Pkt_Type_Response, pkt.Sid, nil)
+			return
+		}
+		select {
+		case c.notifications <- pkt:
+		case <-c.closed:
+		}
+	}
+}
+
+func (c *Client) dispatchLoop() {
+	for pkt := range c.notifications {
+		c.dispatch(pkt)
+	}
+	if c.handlers.Closed != nil {
+		c.handlers.Closed(c.closeErr())
+	}
+}
+
+func (c *Client) dispatch(pkt connections.Packet) {
+	h := c.handlers
+	var err error
+	switch pkt.Cmd {
+	case cmdhandler.Cmd_Msg:
+		var v messages.Message
+		if err = c.unmarshal(pkt, &v); err == nil {
+			if h.Message != nil {
+				h.Message(v)
+			}
+			// Acknowledged once handled, so it is pushed again after a
+			// reconnect if the handler did not return.
+			if c.hasCapability(users.Capability_MsgAck) {
+				c.ackMsg(pkt.Sid, v.Id)
+			}
+		}
+	case cmdhandler.Cmd_ConflictNotification:
+		if h.Conflict != nil {
+			h.Conflict()
+		}
+	case cmdhandler.Cmd_SessionRevokedNotification:
+		if h.SessionRevoked != nil {
+			h.SessionRevoked()
+		}
+	case cmdhandler.Cmd_ShutdownNotification:
+		if h.Shutdown != nil {
+			var v cmdhandler.ShutdownNotificationPacket
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.Shutdown(v)
+			}
+		}
+	case cmdhandler.Cmd_UserInfoChangedNotification:
+		if h.UserInfoChanged != nil {
+			var v users.UserInfoChangedNotificationPkt
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.UserInfoChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_UserStatusChangedNotification:
+		if h.UserStatusChanged != nil {
+			var v users.UserStatusChangedNotificationPkt
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.UserStatusChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_CorpChangedNotification:
+		if h.CorpChanged != nil {
+			var v corps.CorpChangedNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.CorpChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_GroupChangedNotification:
+		if h.GroupChanged != nil {
+			var v groups.GroupChangedNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.GroupChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_RosterChangedNotification:
+		if h.RosterChanged != nil {
+			var v rosters.RosterChangedNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.RosterChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_RosterRequest:
+		if h.RosterRequest != nil {
+			var v rosters.RosterRequest
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.RosterRequest(v)
+			}
+		}
+	case cmdhandler.Cmd_HandleRosterRequestNotification:
+		if h.RosterRequestHandled != nil {
+			var v rosters.HandleRosterRequestNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.RosterRequestHandled(v)
+			}
+		}
+	case cmdhandler.Cmd_PresenceChangedNotification:
+		if h.PresenceChanged != nil {
+			var v cmdhandler.PresenceChangedNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.PresenceChanged(v)
+			}
+		}
+	case cmdhandler.Cmd_ChatState:
+		if h.ChatState != nil {
+			var v cmdhandler.ChatStatePkt
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.ChatState(v)
+			}
+		}
+	case cmdhandler.Cmd_ReceiptNotification:
+		if h.Receipt != nil {
+			var v messages.ReceiptNotification
+			if err = c.unmarshal(pkt, &v); err == nil {
+				h.Receipt(v)
+			}
+		}
+	default:
+		if h.Other != nil {
+			h.Other(pkt)
+		}
+	}
+	if err != nil && h.Error != nil {
+		h.Error(pkt.Cmd, err)
+	}
+}
+
+func (c *Client) unmarshal(pkt connections.Packet, v interface{}) error {
+	if len(pkt.Data) == 0 {
+		return nil
+	}
+	return c.getCodec().Unmarshal(pkt.Data, v)
+}
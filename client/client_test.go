@@ -0,0 +1,189 @@
+package client
+
+import (
+	"encoding/json"
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/cmdhandler"
+	"hug/imserver/connections"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer is the server end of a net.Pipe. Packets sent by the client
+// arrive on packets.
+type fakeServer struct {
+	t       *testing.T
+	conn    net.Conn
+	packets chan connections.Packet
+}
+
+func newFakeServer(t *testing.T, conn net.Conn) (s *fakeServer) {
+	s = &fakeServer{t: t, conn: conn, packets: make(chan connections.Packet, 16)}
+	go func() {
+		buf := make([]byte, 0, 1024)
+		readBuf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(readBuf)
+			if err != nil {
+				close(s.packets)
+				return
+			}
+			buf = append(buf, readBuf[:n]...)
+			for {
+				pkt, found := connections.ParseReceivedData(&buf)
+				if !found {
+					break
+				}
+				s.packets <- pkt
+			}
+		}
+	}()
+	return
+}
+
+func (s *fakeServer) read() (pkt connections.Packet) {
+	select {
+	case pkt = <-s.packets:
+	case <-time.After(3 * time.Second):
+		s.t.Fatal("no packet from client")
+	}
+	return
+}
+
+func (s *fakeServer) write(cmd uint8, pktType uint8, code int8, sid uint16, codec connections.Codec, v interface{}) {
+	var data []byte
+	if v != nil {
+		var err error
+		data, err = codec.Marshal(v)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	buf, err := connections.PrepareSendPacket(cmd, pktType, code, sid, data)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	go s.conn.Write(buf)
+}
+
+func TestAuthAndCallBySid(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	s := newFakeServer(t, serverConn)
+	c := New(clientConn, Handlers{})
+	defer c.Close()
+
+	go func() {
+		pkt := s.read()
+		var req cmdhandler.AuthReqPacket
+		if pkt.Cmd != cmdhandler.Cmd_Auth || json.Unmarshal(pkt.Data, &req) != nil || req.User != "Ym90" {
+			t.Errorf("got auth packet %+v", pkt)
+		}
+		s.write(pkt.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, connections.JsonCodec,
+			cmdhandler.AuthResPacket{Capabilities: users.Capability_MsgPack, SessionId: 9})
+
+		// Answer two requests in reverse order, in msgpack.
+		first, second := s.read(), s.read()
+		for _, pkt := range []connections.Packet{second, first} {
+			switch pkt.Cmd {
+			case cmdhandler.Cmd_GetPresences:
+				var req cmdhandler.GetPresencesReqPkt
+				connections.MsgpackCodec.Unmarshal(pkt.Data, &req)
+				s.write(pkt.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, connections.MsgpackCodec,
+					cmdhandler.GetPresencesResPkt{Presences: []cmdhandler.UserPresence{{Uid: req.Uids[0], Online: true}}})
+			case cmdhandler.Cmd_GetUserStatuses:
+				s.write(pkt.Cmd, connections.Pkt_Type_Error, connections.PktErr_RateLimited, pkt.Sid, nil, nil)
+			}
+		}
+	}()
+
+	res, err := c.SignIn("bot", "secret", users.TerminalType_PC)
+	if err != nil || res.SessionId != 9 {
+		t.Fatalf("sign in got %+v err %v", res, err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.GetUserStatuses(users.GetUserStatusesReqPkt{Uids: []int64{1}})
+		done <- err
+	}()
+	presences, err := c.GetPresences(cmdhandler.GetPresencesReqPkt{Uids: []int64{42}})
+	if err != nil || len(presences.Presences) != 1 || presences.Presences[0].Uid != 42 {
+		t.Fatalf("got presences %+v err %v", presences, err)
+	}
+	err = <-done
+	if pktErr, ok := err.(*PacketError); !ok || pktErr.Code != connections.PktErr_RateLimited {
+		t.Fatalf("got error %v, expect rate limited", err)
+	}
+}
+
+func TestNotificationsAndPing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	s := newFakeServer(t, serverConn)
+	received := make(chan messages.Message, 1)
+	conflict := make(chan bool, 1)
+	closed := make(chan error, 1)
+	c := New(clientConn, Handlers{
+		Message:  func(msg messages.Message) { received <- msg },
+		Conflict: func() { conflict <- true },
+		Closed:   func(err error) { closed <- err },
+	})
+	defer c.Close()
+
+	s.write(cmdhandler.Cmd_Msg, connections.Pkt_Type_Request, 0, 5, connections.JsonCodec, messages.Message{Id: 77})
+	s.write(cmdhandler.Cmd_Ping, connections.Pkt_Type_Request, 0, 6, nil, nil)
+	if pong := s.read(); pong.Cmd != cmdhandler.Cmd_Ping || pong.PktType != connections.Pkt_Type_Response || pong.Sid != 6 {
+		t.Fatalf("got pong %+v", pong)
+	}
+	select {
+	case msg := <-received:
+		if msg.Id != 77 {
+			t.Fatalf("got message %+v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not dispatched")
+	}
+	s.write(cmdhandler.Cmd_ConflictNotification, connections.Pkt_Type_Request, 0, 7, nil, nil)
+	select {
+	case <-conflict:
+	case <-time.After(3 * time.Second):
+		t.Fatal("conflict not dispatched")
+	}
+
+	// A pending call fails once the server closes the connection.
+	go func() {
+		s.read()
+		serverConn.Close()
+	}()
+	if _, err := c.GetSessions(); err == nil {
+		t.Fatal("call on closed connection succeeded")
+	}
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("closed handler not called")
+	}
+}
+
+func TestMsgAck(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	s := newFakeServer(t, serverConn)
+	c := New(clientConn, Handlers{})
+	defer c.Close()
+
+	go func() {
+		pkt := s.read()
+		s.write(pkt.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, connections.JsonCodec,
+			cmdhandler.AuthResPacket{Capabilities: users.Capability_MsgAck})
+	}()
+	if _, err := c.SignIn("bot", "secret", users.TerminalType_PC); err != nil {
+		t.Fatal(err)
+	}
+	s.write(cmdhandler.Cmd_Msg, connections.Pkt_Type_Request, 0, 5, connections.JsonCodec, messages.Message{Id: 77})
+	ack := s.read()
+	var res messages.MessageResPacket
+	if ack.Cmd != cmdhandler.Cmd_Msg || ack.PktType != connections.Pkt_Type_Response || ack.Sid != 5 ||
+		json.Unmarshal(ack.Data, &res) != nil || res.Mid != 77 {
+		t.Fatalf("got ack %+v", ack)
+	}
+}
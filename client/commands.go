@@ -0,0 +1,329 @@
+package client
+
+import (
+	"hug/core/corps"
+	"hug/core/devices"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/rosters"
+	"hug/core/users"
+	"hug/imserver/cmdhandler"
+	"time"
+)
+
+// Typed requests of the commands in cmdhandler. Every method sends one
+// request and waits for its response, see Call.
+// SendMessage sends req and returns the id the server gave it.
+func (c *Client) SendMessage(req messages.Message) (res messages.MessageResPacket, err error) {
+	err = c.Call(cmdhandler.Cmd_Msg, req, &res)
+	return
+}
+
+// GetMsg pulls the messages waiting to send and acknowledges req.Acks. It
+// needs Capability_MsgAck.
+func (c *Client) GetMsg(req messages.GetMsgReqPkt) (res messages.GetMsgResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetMsg, req, &res)
+	return
+}
+
+// SendReceipt tells the sender of req.Mids they were delivered or read. It
+// needs Capability_Receipts.
+func (c *Client) SendReceipt(req messages.ReceiptReqPkt) (res messages.ReceiptResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_Receipt, req, &res)
+	return
+}
+
+func (c *Client) GetReceipts(req messages.GetReceiptsReqPkt) (res messages.GetReceiptsResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetReceipts, req, &res)
+	return
+}
+
+func (c *Client) GetRecentContacts(req messages.GetRencetContactsReqPacket) (res messages.GetRencetContactsResPacket, err error) {
+	err = c.Call(cmdhandler.Cmd_GetRecentContact, req, &res)
+	return
+}
+
+func (c *Client) GetMsgHistory(req messages.GetMsgHistoryReqPkt) (res messages.GetMsgHistoryResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetMsgHistory, req, &res)
+	return
+}
+
+func (c *Client) GetMsgBodys(req messages.GetMsgBodysReqPkt) (res messages.GetMsgBodysResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetMsgBodys, req, &res)
+	return
+}
+
+func (c *Client) RemoveHistory(req messages.RemoveHistoryReqPkt) (res messages.RemoveHistoryResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveHistory, req, &res)
+	return
+}
+
+func (c *Client) GetUserInfos(req users.GetUserInfosReqPkt) (res users.GetUserInfosResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetUserInfos, req, &res)
+	return
+}
+
+func (c *Client) SetUserInfo(req users.SetUserInfoReqPkt) (res users.SetUserInfoResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetUserInfo, req, &res)
+	return
+}
+
+func (c *Client) GetUserInfoChanged(req users.GetUserInfoChangedReqPkt) (res users.GetUserInfoChangedResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetUserInfoChanged, req, &res)
+	return
+}
+
+func (c *Client) SetUserStatus(req users.SetUserStatusReqPkt) (res users.SetUserStatusResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetUserStatus, req, &res)
+	return
+}
+
+func (c *Client) GetUserStatuses(req users.GetUserStatusesReqPkt) (res users.GetUserStatusesResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetUserStatuses, req, &res)
+	return
+}
+
+func (c *Client) GetCids(req corps.GetCidsReqPkt) (res corps.GetCidsResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetCids, req, &res)
+	return
+}
+
+func (c *Client) GetCorpTrees(req corps.GetCorpTreesReqPkt) (res corps.GetCorpTreesResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetCorpTrees, req, &res)
+	return
+}
+
+func (c *Client) CreateCorp(req corps.CreateCorpReqPkt) (res corps.CreateCorpResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_CreateCorp, req, &res)
+	return
+}
+
+func (c *Client) GetCorp(req corps.GetCorpReqPkt) (res corps.Corp, err error) {
+	err = c.Call(cmdhandler.Cmd_GetCorp, req, &res)
+	return
+}
+
+func (c *Client) SetCorp(req corps.Corp) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetCorp, req, nil)
+	return
+}
+
+func (c *Client) RemoveCorp(req corps.RemoveCorpReqPkt) (res corps.RemoveCorpResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveCorp, req, &res)
+	return
+}
+
+func (c *Client) CreateDept(req corps.CreateDeptReqPkt) (res corps.CreateDeptResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_CreateDept, req, &res)
+	return
+}
+
+func (c *Client) GetDept(req corps.GetDeptReqPkt) (res corps.Dept, err error) {
+	err = c.Call(cmdhandler.Cmd_GetDept, req, &res)
+	return
+}
+
+func (c *Client) SetDept(req corps.Dept) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetDept, req, nil)
+	return
+}
+
+func (c *Client) RemoveDept(req corps.RemoveDeptReqPkt) (res corps.RemoveDeptResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveDept, req, &res)
+	return
+}
+
+func (c *Client) CreateWorker(req corps.CreateWorkerReqPkt) (res corps.CreateWorkerResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_CreateWorker, req, &res)
+	return
+}
+
+func (c *Client) GetWorker(req corps.GetWorkerReqPkt) (res corps.Worker, err error) {
+	err = c.Call(cmdhandler.Cmd_GetWorker, req, &res)
+	return
+}
+
+func (c *Client) SetWorker(req corps.Worker) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetWorker, req, nil)
+	return
+}
+
+func (c *Client) BindWorkerUser(req corps.BindWorkerUserReqPkt) (res corps.BindWorkerUserResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_BindWokerUser, req, &res)
+	return
+}
+
+func (c *Client) RemoveWorker(req corps.RemoveWorkerReqPkt) (res corps.RemoveWorkerResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveWorker, req, &res)
+	return
+}
+
+func (c *Client) GetCorpChanged(req corps.GetCorpChangedReqPkt) (res corps.GetCorpChangedResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetCorpChanged, req, &res)
+	return
+}
+
+func (c *Client) CreateGroup(req groups.CreateGroupReqPkt) (res groups.CreateGroupResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_CreateGroup, req, &res)
+	return
+}
+
+func (c *Client) RemoveGroup(req groups.RemoveGroupReqPkt) (res groups.RemoveGroupResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveGroup, req, &res)
+	return
+}
+
+func (c *Client) SetGroup(req groups.Group) (res groups.SetGroupResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetGroup, req, &res)
+	return
+}
+
+func (c *Client) GetGroups(req groups.GetGroupsReqPkt) (res groups.GetGroupsResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetGroups, req, &res)
+	return
+}
+
+func (c *Client) GetGids(req groups.GetGidsReqPkt) (res groups.GetGidsResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetGids, req, &res)
+	return
+}
+
+func (c *Client) AddGroupMembers(req groups.GroupMembersChangeReqPkt) (res groups.GroupMembersChangeResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_AddGroupMembers, req, &res)
+	return
+}
+
+func (c *Client) RemoveGroupMembers(req groups.GroupMembersChangeReqPkt) (res groups.GroupMembersChangeResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveGroupMembers, req, &res)
+	return
+}
+
+func (c *Client) SetGroupMember(req groups.GroupMember) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetGroupMember, req, nil)
+	return
+}
+
+func (c *Client) GetGroupsMembers(req groups.GetGroupsMembersReqPkt) (res groups.GetGroupsMembersResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetGroupsMembers, req, &res)
+	return
+}
+
+func (c *Client) GetGroupChanged(req groups.GetGroupChangedReqPkt) (res groups.GetGroupChangedResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetGroupChanged, req, &res)
+	return
+}
+
+func (c *Client) SetMsgPush(req messages.SetMsgPushReqPkt) (res messages.SetMsgPushResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetMsgPush, req, &res)
+	return
+}
+
+func (c *Client) GetMsgPush(req messages.GetMsgPushReqPkt) (res messages.GetMsgPushResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetMsgPush, req, &res)
+	return
+}
+
+func (c *Client) SetIosDeviceStatus(req devices.IosDeviceStatusPkt) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetIosDeviceStatus, req, nil)
+	return
+}
+
+func (c *Client) SetAndroidDeviceStatus(req devices.AndroidDeviceStatusPkt) (err error) {
+	err = c.Call(cmdhandler.Cmd_SetAndroidDeviceStatus, req, nil)
+	return
+}
+
+func (c *Client) GetAllRosters(req rosters.GetAllRostersReqPkt) (res rosters.GetAllRostersResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetAllRoster, req, &res)
+	return
+}
+
+func (c *Client) GetRosters(req rosters.GetRostersReqPkt) (res rosters.GetRostersResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetRosters, req, &res)
+	return
+}
+
+func (c *Client) SetRoster(req rosters.Roster) (res rosters.SetRosterResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetRoster, req, &res)
+	return
+}
+
+func (c *Client) RemoveRoster(req rosters.RemoveRosterReqPkt) (res rosters.RemoveRosterResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RemoveRoster, req, &res)
+	return
+}
+
+func (c *Client) GetRosterChanged(req rosters.GetRosterChangedReqPkt) (res rosters.GetRosterChangedResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetRosterChanged, req, &res)
+	return
+}
+
+func (c *Client) SendRosterRequest(req rosters.RosterRequest) (res rosters.RosterRequestResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RosterRequest, req, &res)
+	return
+}
+
+func (c *Client) GetRosterRequests(req rosters.GetRosterRequestReqPkt) (res rosters.GetRosterReqeustResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetRosterRequests, req, &res)
+	return
+}
+
+func (c *Client) HandleRosterRequest(req rosters.HandleRosterRequestReqPkt) (res rosters.HandleRosterRequestResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_HandleRosterRequest, req, &res)
+	return
+}
+
+func (c *Client) SetIgnoreRosterRequest(req rosters.IgnoreRequest) (res rosters.SetIgnoreRequestResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SetIgnoreRosterRequest, req, &res)
+	return
+}
+
+func (c *Client) GetPresences(req cmdhandler.GetPresencesReqPkt) (res cmdhandler.GetPresencesResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetPresences, req, &res)
+	return
+}
+
+func (c *Client) SubscribePresences(req cmdhandler.SubscribePresencesReqPkt) (res cmdhandler.SubscribePresencesResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_SubscribePresences, req, &res)
+	return
+}
+
+func (c *Client) RevokeSession(req cmdhandler.RevokeSessionReqPkt) (res cmdhandler.RevokeSessionResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_RevokeSession, req, &res)
+	return
+}
+
+// SignOut revokes the session token and waits until the server closed the
+// connection.
+func (c *Client) SignOut() (err error) {
+	err = c.Send(cmdhandler.Cmd_SignOut, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case <-c.closed:
+	case <-time.After(c.timeout()):
+		err = ErrTimeout
+		c.Close()
+	}
+	return
+}
+
+// Ping measures the round trip time to the server.
+func (c *Client) Ping() (rtt time.Duration, err error) {
+	start := time.Now()
+	err = c.Call(cmdhandler.Cmd_Ping, nil, nil)
+	rtt = time.Since(start)
+	return
+}
+
+func (c *Client) GetSessions() (res cmdhandler.GetSessionsResPkt, err error) {
+	err = c.Call(cmdhandler.Cmd_GetSessions, nil, &res)
+	return
+}
+
+// SendChatState shows state to the user or group to. It is not answered.
+func (c *Client) SendChatState(to messages.MessageContact, state int8) (err error) {
+	err = c.Send(cmdhandler.Cmd_ChatState, cmdhandler.ChatStatePkt{To: to, State: state})
+	return
+}
@@ -29,6 +29,7 @@ func Start() {
 	if users.ConnDB(cfg) != nil {
 		os.Exit(2)
 	}
+	go users.ExpireUserStatusesLoop()
 
 	if corps.ConnDB(cfg) != nil {
 		os.Exit(3)
@@ -62,6 +63,7 @@ func Stop() {
 	corps.CloseDB()
 	messages.CloseDB()
 	groups.CloseDB()
+	rosters.CloseDB()
 	devices.CloseDB()
 	files.CloseDB()
 }
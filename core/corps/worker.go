@@ -381,6 +381,56 @@ func GetCidsOfUid(uid int64) (cids []int64, err error) {
 	return
 }
 
+// GetWorkerOfUid returns the normal worker of uid in the corp cid, the one
+// with the highest permission if there are several. Wid is 0 if uid is not a
+// worker of cid.
+func GetWorkerOfUid(cid, uid int64) (worker Worker, err error) {
+	command := `
+	SELECT wid, did, permission FROM workers where cid = @cid AND uid = @uid AND status = @status ORDER BY permission DESC LIMIT 1;
+	`
+	cidParam := pgsql.NewParameter("@cid", pgsql.Bigint)
+	err = cidParam.SetValue(cid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(WorkerStatus_Normal)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	res, err := conn.Query(command, cidParam, uidParam, statusParam)
+	if err != nil {
+		logs.Logger.Critical("Error execute query: ", err)
+	} else {
+		var fetched bool
+		fetched, err = res.ScanNext(&worker.Wid, &worker.Did, &worker.Permission)
+		if err != nil {
+			logs.Logger.Critical("Error scan: ", err)
+		} else if fetched {
+			worker.Cid = cid
+			worker.Uid = uid
+			worker.Status = WorkerStatus_Normal
+		}
+	}
+	res.Close()
+	pool.Release(conn)
+	return
+}
+
 func GetUidsOfCorp(cid int64) (uids []int64, err error) {
 	command := `
 	SELECT uid FROM workers where cid = @cid;
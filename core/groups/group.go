@@ -245,15 +245,23 @@ func RemoveGroup(reqPkt RemoveGroupReqPkt) (code int8) {
 		code = RemoveGroupCode_HasNoPermission
 		return
 	}
-	err := deleteGroup(reqPkt.Gid)
+	code = RemoveGroupWithGid(reqPkt.Gid)
+	return
+}
+
+// RemoveGroupWithGid removes gid without checking the permission of the
+// requesting user.
+func RemoveGroupWithGid(gid int64) (code int8) {
+	code = RemoveGroupCode_DatabaseErr
+	err := deleteGroup(gid)
 	if err != nil {
 		return
 	}
-	//DeleteAllMemberOfGroup(reqPkt.Gid)
+	//DeleteAllMemberOfGroup(gid)
 	code = RemoveGroupCode_None
 	stamp := time.Now().UnixNano()
 	var change GroupChangedNotification
-	change.Gid = reqPkt.Gid
+	change.Gid = gid
 	change.Type = GroupChangedType_Removed
 	CreateGroupChange(change, stamp)
 	return
@@ -548,3 +548,220 @@ func ClearUnreadHistory(uid int64, contact MessageContact) {
 	pool.Release(conn)
 	return
 }
+
+// IsMsgInHistory reports whether the message mid was sent or delivered to
+// uid and not removed from its history.
+func IsMsgInHistory(uid, mid int64) (in bool, err error) {
+	n := 0
+	command := `
+	SELECT COUNT(*) AS nummsgs FROM history where uid = @uid AND mid = @mid AND status != @status;
+	`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	midParam := pgsql.NewParameter("@mid", pgsql.Bigint)
+	err = midParam.SetValue(mid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(HistoryStatus_Removed)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	res, err := conn.Query(command, uidParam, midParam, statusParam)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	} else {
+		_, err = res.ScanNext(&n)
+		if err != nil {
+			logs.Logger.Critical("Error scan: ", err)
+		}
+		in = n > 0
+	}
+	res.Close()
+	pool.Release(conn)
+	return
+}
+
+// MaxGetMsgSize bounds the messages returned by one GetMsg and the acks it
+// takes.
+const MaxGetMsgSize = 100
+
+// GetMsgReqPkt pulls the inbound messages of Uid not yet acknowledged, in
+// the order they were sent, starting after MinMessageId. Acks lists the
+// messages received from the previous pull.
+type GetMsgReqPkt struct {
+	Uid          int64   `json:"u,omitempty"`
+	MinMessageId int64   `json:"min,omitempty"`
+	Size         int     `json:"sz,omitempty"`
+	Acks         []int64 `json:"acks,omitempty"`
+}
+
+type GetMsgResPkt struct {
+	Messages []Message `json:"ms,omitempty"`
+	// More is set if messages after the last one are waiting too.
+	More bool `json:"more,omitempty"`
+}
+
+func GetMsg(reqPkt GetMsgReqPkt) (resPkt GetMsgResPkt) {
+	if reqPkt.Uid == 0 {
+		return
+	}
+	acks := reqPkt.Acks
+	if len(acks) > MaxGetMsgSize {
+		acks = acks[:MaxGetMsgSize]
+	}
+	AckMsgs(reqPkt.Uid, acks)
+	size := reqPkt.Size
+	if size <= 0 || size > MaxGetMsgSize {
+		size = MaxGetMsgSize
+	}
+	resPkt.Messages, resPkt.More = GetWaitToSendMsgs(reqPkt.Uid, reqPkt.MinMessageId, size)
+	return
+}
+
+// GetWaitToSendMsgs returns up to size inbound messages of uid in
+// HistoryStatus_WaitToSend with an id above minMid, oldest first. more is
+// set if there are others after them.
+func GetWaitToSendMsgs(uid, minMid int64, size int) (msgs []Message, more bool) {
+	command := `
+	SELECT history.mid, history.contactid, history.contacttype, messages.stamp, messages.authorid,
+	messages.authortype, messages.authorterminal, messages.body FROM history, messages
+	where history.uid = @uid AND history.status = @status AND history.dir = @dir AND history.mid > @minMid
+	AND messages.mid = history.mid ORDER BY history.mid ASC LIMIT @limit;
+		`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err := uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(HistoryStatus_WaitToSend)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	dirParam := pgsql.NewParameter("@dir", pgsql.Smallint)
+	err = dirParam.SetValue(MessageDir_In)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	minMidParam := pgsql.NewParameter("@minMid", pgsql.Bigint)
+	err = minMidParam.SetValue(minMid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	// One more row than asked tells whether more are waiting.
+	limitParam := pgsql.NewParameter("@limit", pgsql.Integer)
+	err = limitParam.SetValue(int32(size + 1))
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	msgs = make([]Message, 0, size)
+	res, err := conn.Query(command, uidParam, statusParam, dirParam, minMidParam, limitParam)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	} else {
+		for {
+			hasRow, _ := res.FetchNext()
+			if !hasRow {
+				break
+			}
+			if len(msgs) >= size {
+				more = true
+				break
+			}
+			var msg Message
+			var body string
+			err = res.Scan(&msg.Id, &msg.From.Id, &msg.From.Type, &msg.Stamp, &msg.Author.Id, &msg.Author.Type, &msg.AuthorTerminal, &body)
+			if err != nil {
+				logs.Logger.Critical("database scan error =", err)
+				continue
+			}
+			msg.To = MessageContact{Id: uid, Type: MCT_User}
+			msg.Items = decodeMsgItems(body)
+			msgs = append(msgs, msg)
+		}
+		res.Close()
+	}
+	pool.Release(conn)
+	return
+}
+
+// AckMsgs marks the inbound messages mids of uid HistoryStatus_Sended once a
+// client of uid acknowledged them.
+func AckMsgs(uid int64, mids []int64) {
+	if len(mids) == 0 {
+		return
+	}
+	command := `
+	update history set status=@newstatus where uid = @uid AND mid = @mid AND dir = @dir 
+	AND status = @oldstatus;
+		`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err := uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	midParam := pgsql.NewParameter("@mid", pgsql.Bigint)
+	dirParam := pgsql.NewParameter("@dir", pgsql.Smallint)
+	err = dirParam.SetValue(MessageDir_In)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	oldStatusParam := pgsql.NewParameter("@oldstatus", pgsql.Smallint)
+	err = oldStatusParam.SetValue(HistoryStatus_WaitToSend)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	newStatusParam := pgsql.NewParameter("@newstatus", pgsql.Smallint)
+	err = newStatusParam.SetValue(HistoryStatus_Sended)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	for _, mid := range mids {
+		err = midParam.SetValue(mid)
+		if err != nil {
+			logs.Logger.Critical(err)
+			continue
+		}
+		_, err = conn.Execute(command, newStatusParam, uidParam, midParam, dirParam, oldStatusParam)
+		if err != nil {
+			logs.Logger.Critical("Error executing query: ", err)
+		}
+	}
+	pool.Release(conn)
+	return
+}
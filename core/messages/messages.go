@@ -129,14 +129,7 @@ func GetMsgBody(mid int64) (msgBody MessageBody, err error) {
 		if err != nil {
 			logs.Logger.Critical("Error scan mid: ", err)
 		} else if fetched {
-			bodyBytes, err := base64.StdEncoding.DecodeString(body)
-			if err != nil {
-				logs.Logger.Critical(fmt.Sprintln("base64 decodestring err =", err))
-			}
-			err = json.Unmarshal(bodyBytes, &msgBody.Items)
-			if err != nil {
-				logs.Logger.Critical(fmt.Sprintln("json unmarshal err =", err))
-			}
+			msgBody.Items = decodeMsgItems(body)
 		}
 	}
 	res.Close()
@@ -144,6 +137,19 @@ func GetMsgBody(mid int64) (msgBody MessageBody, err error) {
 	return
 }
 
+// decodeMsgItems decodes the body column of the messages table.
+func decodeMsgItems(body string) (items []MessageItem) {
+	bodyBytes, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		logs.Logger.Critical(fmt.Sprintln("base64 decodestring err =", err))
+	}
+	err = json.Unmarshal(bodyBytes, &items)
+	if err != nil {
+		logs.Logger.Critical(fmt.Sprintln("json unmarshal err =", err))
+	}
+	return
+}
+
 func GetMsgBodys(reqPkt GetMsgBodysReqPkt) (resPkt GetMsgBodysResPkt) {
 	resPkt.MessageBodys = make([]MessageBody, 0, len(reqPkt.Mids))
 	for _, mid := range reqPkt.Mids {
@@ -0,0 +1,278 @@
+package messages
+
+import (
+	"fmt"
+	"github.com/lxn/go-pgsql"
+	"hug/logs"
+	"strings"
+)
+
+// Receipt statuses, each one implying the ones before it.
+const (
+	ReceiptStatus_None int8 = iota
+	// The message reached a terminal of the recipient.
+	ReceiptStatus_Delivered
+	// The recipient read the message.
+	ReceiptStatus_Read
+)
+
+const createReceiptsTableSql = `
+CREATE TABLE IF NOT EXISTS receipts
+		(
+		  mid bigint NOT NULL,
+		  uid bigint NOT NULL,
+		  status smallint NOT NULL default 0,
+		  stamp bigint NOT NULL default 0,
+		  CONSTRAINT receipts_pkey PRIMARY KEY (mid, uid)
+		)
+		WITH (OIDS=FALSE);
+`
+
+// Receipt is how far the recipient Uid got with the message Mid.
+type Receipt struct {
+	Mid    int64 `json:"mid"`
+	Uid    int64 `json:"uid"`
+	Status int8  `json:"s"`
+	Stamp  int64 `json:"st,omitempty"`
+}
+
+// ReceiptReqPkt acknowledges one-to-one messages Contact sent to the user.
+type ReceiptReqPkt struct {
+	Contact MessageContact `json:"c"`
+	Mids    []int64        `json:"mids"`
+	Status  int8           `json:"s"`
+}
+
+const (
+	ReceiptCode_None int8 = iota
+	ReceiptCode_InvalidFormat
+	ReceiptCode_DatabaseErr
+)
+
+type ReceiptResPkt struct {
+	Code int8 `json:"code"`
+}
+
+// ReceiptNotification tells the terminals of the sender To and of the
+// reader From that From got the messages Mids that far.
+type ReceiptNotification struct {
+	From   MessageContact `json:"fr"`
+	To     MessageContact `json:"to"`
+	Mids   []int64        `json:"mids"`
+	Status int8           `json:"s"`
+	Stamp  int64          `json:"st,omitempty"`
+}
+
+type GetReceiptsReqPkt struct {
+	Uid  int64   `json:"u,omitempty"`
+	Mids []int64 `json:"mids"`
+}
+
+type GetReceiptsResPkt struct {
+	Receipts []Receipt `json:"rs,omitempty"`
+}
+
+// SetReceipts raises the receipts of uid for mids to status. changed has
+// the mids whose receipt did not have that status or a later one yet.
+func SetReceipts(mids []int64, uid int64, status int8, stamp int64) (changed []int64, err error) {
+	if len(mids) == 0 {
+		return
+	}
+	names, midParams, err := midParameters(mids)
+	if err != nil {
+		return
+	}
+	updateCommand := `
+	UPDATE receipts set status=@status, stamp=@stamp where uid = @uid AND status < @status
+	AND mid IN (` + strings.Join(names, ",") + `) RETURNING mid;
+		`
+	insertCommand := `
+	INSERT INTO receipts(mid,uid,status,stamp) SELECT m.mid,@uid,@status,@stamp
+	FROM (VALUES (` + strings.Join(names, "),(") + `)) AS m(mid)
+	WHERE NOT EXISTS (SELECT 1 FROM receipts WHERE receipts.mid = m.mid AND receipts.uid = @uid) RETURNING mid;
+		`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(int16(status))
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	stampParam := pgsql.NewParameter("@stamp", pgsql.Bigint)
+	err = stampParam.SetValue(stamp)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	params := append([]*pgsql.Parameter{uidParam, statusParam, stampParam}, midParams...)
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	changed, err = queryMids(conn, updateCommand, params)
+	if err == nil {
+		var inserted []int64
+		inserted, err = queryMids(conn, insertCommand, params)
+		changed = append(changed, inserted...)
+	}
+	pool.Release(conn)
+	return
+}
+
+// GetReceipts returns the receipts of mids which uid may see: those of the
+// messages uid sent and its own.
+func GetReceipts(reqPkt GetReceiptsReqPkt) (resPkt GetReceiptsResPkt) {
+	if reqPkt.Uid == 0 || len(reqPkt.Mids) == 0 {
+		return
+	}
+	names, midParams, err := midParameters(reqPkt.Mids)
+	if err != nil {
+		return
+	}
+	command := `
+	SELECT receipts.mid, receipts.uid, receipts.status, receipts.stamp FROM receipts, messages
+	where receipts.mid IN (` + strings.Join(names, ",") + `) AND messages.mid = receipts.mid
+	AND (messages.authorid = @uid OR receipts.uid = @uid);
+		`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(reqPkt.Uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	res, err := conn.Query(command, append([]*pgsql.Parameter{uidParam}, midParams...)...)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	} else {
+		resPkt.Receipts = make([]Receipt, 0, len(reqPkt.Mids))
+		for {
+			hasRow, _ := res.FetchNext()
+			if !hasRow {
+				break
+			}
+			var receipt Receipt
+			var status int16
+			err = res.Scan(&receipt.Mid, &receipt.Uid, &status, &receipt.Stamp)
+			if err != nil {
+				logs.Logger.Critical("database scan error =", err)
+				continue
+			}
+			receipt.Status = int8(status)
+			resPkt.Receipts = append(resPkt.Receipts, receipt)
+		}
+		res.Close()
+	}
+	pool.Release(conn)
+	return
+}
+
+// MsgsFrom returns the mids which are inbound messages of uid from contact,
+// not removed from its history.
+func MsgsFrom(uid int64, mids []int64, contact MessageContact) (from []int64, err error) {
+	if len(mids) == 0 {
+		return
+	}
+	names, midParams, err := midParameters(mids)
+	if err != nil {
+		return
+	}
+	command := `
+	SELECT mid FROM history where uid = @uid AND mid IN (` + strings.Join(names, ",") + `) AND contactid = @contactid
+	AND contacttype = @contacttype AND dir = @dir AND status != @status;
+	`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	contactIdParam := pgsql.NewParameter("@contactid", pgsql.Bigint)
+	err = contactIdParam.SetValue(contact.Id)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	contactTypeParam := pgsql.NewParameter("@contacttype", pgsql.Smallint)
+	err = contactTypeParam.SetValue(contact.Type)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	dirParam := pgsql.NewParameter("@dir", pgsql.Smallint)
+	err = dirParam.SetValue(MessageDir_In)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(HistoryStatus_Removed)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	from, err = queryMids(conn, command, append([]*pgsql.Parameter{uidParam, contactIdParam, contactTypeParam, dirParam, statusParam}, midParams...))
+	pool.Release(conn)
+	return
+}
+
+// midParameters returns the parameters of mids for an IN (...) list and
+// their names. The names have the same length, so none is the prefix of
+// another.
+func midParameters(mids []int64) (names []string, params []*pgsql.Parameter, err error) {
+	names = make([]string, 0, len(mids))
+	params = make([]*pgsql.Parameter, 0, len(mids))
+	for i, mid := range mids {
+		name := fmt.Sprintf("@mid%04d", i)
+		param := pgsql.NewParameter(name, pgsql.Bigint)
+		err = param.SetValue(mid)
+		if err != nil {
+			logs.Logger.Critical(err)
+			return
+		}
+		names = append(names, name)
+		params = append(params, param)
+	}
+	return
+}
+
+// queryMids runs command, which selects or returns mids.
+func queryMids(conn *pgsql.Conn, command string, params []*pgsql.Parameter) (mids []int64, err error) {
+	res, err := conn.Query(command, params...)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+		return
+	}
+	for {
+		hasRow, _ := res.FetchNext()
+		if !hasRow {
+			break
+		}
+		var mid int64
+		if scanErr := res.Scan(&mid); scanErr != nil {
+			logs.Logger.Critical("Error scan: ", scanErr)
+			continue
+		}
+		mids = append(mids, mid)
+	}
+	res.Close()
+	return
+}
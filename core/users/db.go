@@ -13,6 +13,10 @@ var pool *pgsql.Pool
 
 var UserInfoChangedNotificationChan chan int64
 
+// UserStatusChangedNotificationChan receives the uid of every user whose
+// status was set or expired.
+var UserStatusChangedNotificationChan chan int64
+
 func ConnDB(cfg *config.Config) (err error) {
 	dbName, err := cfg.GetString("db_users_name")
 	if err != nil {
@@ -51,6 +55,9 @@ func ConnDB(cfg *config.Config) (err error) {
 		return
 	}
 
+	secret, _ := cfg.GetString("session_token_secret")
+	setSessionTokenSecret(secret)
+
 	params := fmt.Sprintf("dbname=%s user=%s password=%s sslmode=disable", dbName, user, password)
 	pool, err = pgsql.NewPool(params, minConns, maxConns, time.Duration(idleTimeout)*time.Second)
 	if err != nil {
@@ -59,6 +66,7 @@ func ConnDB(cfg *config.Config) (err error) {
 	//pool.Debug = true
 
 	UserInfoChangedNotificationChan = make(chan int64, 512)
+	UserStatusChangedNotificationChan = make(chan int64, 512)
 
 	err = nil
 	return
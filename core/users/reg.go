@@ -268,6 +268,40 @@ func GetRegUser(email string) (regUser RegUser, err error) {
 	return
 }
 
+// GetRegUsers returns the registrations waiting for verification, oldest
+// first.
+func GetRegUsers() (regUsers []RegUser, err error) {
+	command := `
+	SELECT * FROM regusers order by CreateStamp;
+	`
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+	} else {
+		res, err := conn.Query(command)
+		if err != nil {
+			logs.Logger.Critical("Error execute query: ", err)
+		} else {
+			for {
+				hasRow, _ := res.FetchNext()
+				if !hasRow {
+					break
+				}
+				var regUser RegUser
+				err = res.Scan(&regUser.Email, &regUser.Password, &regUser.Mobile, &regUser.RealName, &regUser.NickName, &regUser.Gender, &regUser.Signature, &regUser.Location, &regUser.Birthday, &regUser.VerifyCode, &regUser.CreateStamp)
+				if err != nil {
+					logs.Logger.Critical("Error scan: ", err)
+					break
+				}
+				regUsers = append(regUsers, regUser)
+			}
+			res.Close()
+		}
+	}
+	pool.Release(conn)
+	return
+}
+
 func IsUserRegisted(email string) (exist bool, err error) {
 	command := `
 	SELECT COUNT(*) AS numusers FROM regusers where email = @email;
@@ -352,6 +386,60 @@ func VerifyAccount(reqPkt VerifyReqPkt) (code int8) {
 	return VerifyRegUserCode_None
 }
 
+// VerifyRegUser verifies the registration of email without its verify code.
+func VerifyRegUser(email string) (code int8) {
+	exist, err := IsUserRegisted(email)
+	if err != nil {
+		return VerifyRegUserCode_DatabaseErr
+	}
+	if !exist {
+		return VerifyRegUserCode_UnRegUser
+	}
+	regUser, err := GetRegUser(email)
+	if err != nil {
+		return VerifyRegUserCode_DatabaseErr
+	}
+	return VerifyAccount(VerifyReqPkt{Account: email, VerifyCode: regUser.VerifyCode})
+}
+
+// CreateUser creates a verified user right away, without a verify mail.
+func CreateUser(regUser RegUser) (uid int64, code int8) {
+	if !utils.IsValidEmail(regUser.Email) {
+		code = RegUserCode_InvalidEmail
+		return
+	}
+	if len(regUser.Password) == 0 {
+		code = RegUserCode_InvalidPassword
+		return
+	}
+	if len(regUser.Mobile) > 0 && !utils.IsValidMobile(regUser.Mobile) {
+		code = RegUserCode_InvalidMobile
+		return
+	}
+	exist, err := IsUserExist(regUser.Email)
+	if err != nil {
+		code = RegUserCode_DatabaseErr
+		return
+	}
+	if exist {
+		code = RegUserCode_UserExist
+		return
+	}
+	uid, err = createUser(regUser.Email, EncryptPassword(regUser.Email, regUser.Password))
+	if err != nil || uid == 0 {
+		code = RegUserCode_DatabaseErr
+		return
+	}
+	err = createUserInfo(uid, regUser)
+	if err != nil {
+		logs.Logger.Critical(err)
+		code = RegUserCode_DatabaseErr
+		return
+	}
+	code = RegUserCode_None
+	return
+}
+
 func SendMail(e *utils.Email) {
 	err := e.Send()
 	if err != nil {
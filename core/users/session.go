@@ -0,0 +1,325 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/lxn/go-pgsql"
+	"hug/logs"
+	"strings"
+	"time"
+)
+
+const SessionTokenDuration = 30 * 24 * time.Hour
+
+// SessionTokenGrace is how long a token stays valid once it was replaced, so
+// a terminal which lost the response carrying the new token can still sign
+// in with the old one.
+const SessionTokenGrace = time.Minute
+
+const createSessionTokensTableSql = `
+CREATE TABLE IF NOT EXISTS sessiontokens
+		(
+		  tid bigint NOT NULL unique,
+		  uid bigint NOT NULL,
+		  terminaltype smallint NOT NULL,
+		  expire bigint NOT NULL,
+		  CONSTRAINT sessiontokens_pkey PRIMARY KEY (tid)
+		)
+		WITH (OIDS=FALSE);
+		`
+
+// SessionToken lets a terminal authenticate again without its password. The
+// token is signed, bound to uid and terminal type and only valid while its
+// tid is stored in sessiontokens, so it can be revoked.
+type SessionToken struct {
+	Tid          int64
+	Uid          int64
+	TerminalType int16
+	Expire       int64
+}
+
+var sessionTokenSecret []byte
+
+var (
+	errInvalidSessionToken = errors.New("invalid session token")
+	errSessionTokenExpired = errors.New("session token expired")
+)
+
+func setSessionTokenSecret(secret string) {
+	if len(secret) > 0 {
+		sessionTokenSecret = []byte(secret)
+		return
+	}
+	logs.Logger.Warn("session_token_secret not configured, session tokens are only valid until restart")
+	sessionTokenSecret = make([]byte, 32)
+	rand.Read(sessionTokenSecret)
+}
+
+func (t SessionToken) payload() string {
+	return fmt.Sprintf("%d:%d:%d:%d", t.Tid, t.Uid, t.TerminalType, t.Expire)
+}
+
+func signSessionToken(t SessionToken) (token string) {
+	mac := hmac.New(sha256.New, sessionTokenSecret)
+	mac.Write([]byte(t.payload()))
+	token = base64.URLEncoding.EncodeToString([]byte(t.payload())) + "." + hex.EncodeToString(mac.Sum(nil))
+	return
+}
+
+func parseSessionToken(token string, now time.Time) (t SessionToken, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		err = errInvalidSessionToken
+		return
+	}
+	payload, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		err = errInvalidSessionToken
+		return
+	}
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil {
+		err = errInvalidSessionToken
+		return
+	}
+	mac := hmac.New(sha256.New, sessionTokenSecret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		err = errInvalidSessionToken
+		return
+	}
+	_, err = fmt.Sscanf(string(payload), "%d:%d:%d:%d", &t.Tid, &t.Uid, &t.TerminalType, &t.Expire)
+	if err != nil || t.payload() != string(payload) {
+		err = errInvalidSessionToken
+		return
+	}
+	if t.Expire <= now.Unix() {
+		err = errSessionTokenExpired
+	}
+	return
+}
+
+func newTokenId() (tid int64) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	tid = int64(binary.BigEndian.Uint64(b) &^ (1 << 63))
+	return
+}
+
+// IssueSessionToken creates and stores a token for uid on terminalType.
+func IssueSessionToken(uid int64, terminalType int16) (token string, t SessionToken, err error) {
+	t = SessionToken{
+		Tid:          newTokenId(),
+		Uid:          uid,
+		TerminalType: terminalType,
+		Expire:       time.Now().Add(SessionTokenDuration).Unix(),
+	}
+	command := `
+		INSERT INTO sessiontokens(tid,uid,terminaltype,expire)
+		VALUES(@tid,@uid,@terminaltype,@expire);
+		`
+	tidParam := pgsql.NewParameter("@tid", pgsql.Bigint)
+	err = tidParam.SetValue(t.Tid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(t.Uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	terminalTypeParam := pgsql.NewParameter("@terminaltype", pgsql.Smallint)
+	err = terminalTypeParam.SetValue(t.TerminalType)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	expireParam := pgsql.NewParameter("@expire", pgsql.Bigint)
+	err = expireParam.SetValue(t.Expire)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	_, err = conn.Execute(command, tidParam, uidParam, terminalTypeParam, expireParam)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	} else {
+		token = signSessionToken(t)
+	}
+	pool.Release(conn)
+	return
+}
+
+// isSessionTokenStored reports whether tid is stored and not expired, which
+// it may be before the token itself once replaced.
+func isSessionTokenStored(tid int64, now time.Time) (stored bool, err error) {
+	n := 0
+	command := `
+	SELECT COUNT(*) FROM sessiontokens where tid = @tid AND expire > @now;
+	`
+	tidParam := pgsql.NewParameter("@tid", pgsql.Bigint)
+	err = tidParam.SetValue(tid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	nowParam := pgsql.NewParameter("@now", pgsql.Bigint)
+	err = nowParam.SetValue(now.Unix())
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	res, err := conn.Query(command, tidParam, nowParam)
+	if err != nil {
+		logs.Logger.Critical("Error execute query: ", err)
+		pool.Release(conn)
+		return
+	}
+	if hasRow, _ := res.FetchNext(); hasRow {
+		err = res.Scan(&n)
+		if err != nil {
+			logs.Logger.Critical("Error scan: ", err)
+		}
+	}
+	res.Close()
+	pool.Release(conn)
+	stored = n >= 1
+	return
+}
+
+// AuthSessionToken checks a token sent by terminalType. It is the token
+// counterpart of AuthUser.
+func AuthSessionToken(token string, terminalType int16) (code int8, t SessionToken) {
+	now := time.Now()
+	t, err := parseSessionToken(token, now)
+	if err == errSessionTokenExpired {
+		code = AuthCode_TokenExpired
+		RevokeSessionToken(t.Tid)
+		return
+	} else if err != nil || t.TerminalType != terminalType {
+		code = AuthCode_InvalidToken
+		return
+	}
+	stored, err := isSessionTokenStored(t.Tid, now)
+	if err != nil {
+		code = AuthCode_DatabaseErr
+		return
+	}
+	if !stored {
+		code = AuthCode_InvalidToken
+		return
+	}
+	code = AuthCode_None
+	return
+}
+
+func deleteSessionTokens(command string, name string, value int64) {
+	param := pgsql.NewParameter(name, pgsql.Bigint)
+	err := param.SetValue(value)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+	} else {
+		_, err = conn.Execute(command, param)
+		if err != nil {
+			logs.Logger.Critical("Error execute query: ", err)
+		}
+	}
+	pool.Release(conn)
+	return
+}
+
+// RevokeSessionToken invalidates the token tid, e.g. on Cmd_SignOut.
+func RevokeSessionToken(tid int64) {
+	if tid == 0 {
+		return
+	}
+	deleteSessionTokens(`DELETE FROM sessiontokens where tid = @tid;`, "@tid", tid)
+}
+
+// retiredExpire is the expiry of t once replaced at now.
+func retiredExpire(t SessionToken, now time.Time) int64 {
+	expire := now.Add(SessionTokenGrace).Unix()
+	if t.Expire < expire {
+		expire = t.Expire
+	}
+	return expire
+}
+
+// RetireSessionToken keeps t valid for SessionTokenGrace only, after a new
+// token was issued in its place. The retired tokens of the user which are
+// expired by now are removed.
+func RetireSessionToken(t SessionToken) {
+	now := time.Now()
+	tidParam := pgsql.NewParameter("@tid", pgsql.Bigint)
+	err := tidParam.SetValue(t.Tid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(t.Uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	expireParam := pgsql.NewParameter("@expire", pgsql.Bigint)
+	err = expireParam.SetValue(retiredExpire(t, now))
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	nowParam := pgsql.NewParameter("@now", pgsql.Bigint)
+	err = nowParam.SetValue(now.Unix())
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	command := `
+	UPDATE sessiontokens set expire=@expire where tid = @tid AND expire > @expire;
+	`
+	_, err = conn.Execute(command, tidParam, expireParam)
+	if err == nil {
+		command = `
+		DELETE FROM sessiontokens where uid = @uid AND expire <= @now;
+		`
+		_, err = conn.Execute(command, uidParam, nowParam)
+	}
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	}
+	pool.Release(conn)
+}
+
+// RevokeUserSessionTokens invalidates every token of uid, e.g. after the
+// password changed.
+func RevokeUserSessionTokens(uid int64) {
+	deleteSessionTokens(`DELETE FROM sessiontokens where uid = @uid;`, "@uid", uid)
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	"github.com/lxn/go-pgsql"
+	"hug/logs"
+)
+
+// DefaultMaxSessions is how many sessions of one terminal type an account
+// may have at once, unless MaxSessions or the account overrides it. Signing
+// in beyond the limit closes the oldest session.
+var DefaultMaxSessions = 1
+
+// MaxSessions overrides DefaultMaxSessions by terminal type.
+var MaxSessions = make(map[int16]int)
+
+const createSessionLimitsTableSql = `
+CREATE TABLE IF NOT EXISTS sessionlimits
+		(
+		  uid bigint NOT NULL,
+		  terminaltype smallint NOT NULL,
+		  maxsessions integer NOT NULL,
+		  CONSTRAINT sessionlimits_pkey PRIMARY KEY (uid, terminaltype)
+		)
+		WITH (OIDS=FALSE);
+		`
+
+// NewSessionId returns a random id, unique across nodes, which identifies a
+// signed in connection.
+func NewSessionId() int64 {
+	return newTokenId()
+}
+
+func defaultMaxSessions(terminalType int16) int {
+	if max, ok := MaxSessions[terminalType]; ok {
+		return max
+	}
+	return DefaultMaxSessions
+}
+
+// GetMaxSessions returns how many sessions of terminalType uid may have at
+// once, from the account policy if set.
+func GetMaxSessions(uid int64, terminalType int16) (max int) {
+	max = defaultMaxSessions(terminalType)
+	command := `
+	SELECT maxsessions FROM sessionlimits where uid = @uid and terminaltype = @terminaltype;
+	`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err := uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	terminalTypeParam := pgsql.NewParameter("@terminaltype", pgsql.Smallint)
+	err = terminalTypeParam.SetValue(terminalType)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+	} else {
+		res, err := conn.Query(command, uidParam, terminalTypeParam)
+		if err != nil {
+			logs.Logger.Critical("Error execute query: ", err)
+		} else {
+			if hasRow, _ := res.FetchNext(); hasRow {
+				var limit int
+				err = res.Scan(&limit)
+				if err != nil {
+					logs.Logger.Critical("Error scan: ", err)
+				} else if limit > 0 {
+					max = limit
+				}
+			}
+			res.Close()
+		}
+	}
+	pool.Release(conn)
+	return
+}
+
+// SetMaxSessions sets the account policy of uid for terminalType. A max of
+// 0 falls back to the server default.
+func SetMaxSessions(uid int64, terminalType int16, max int) (err error) {
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	terminalTypeParam := pgsql.NewParameter("@terminaltype", pgsql.Smallint)
+	err = terminalTypeParam.SetValue(terminalType)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	maxParam := pgsql.NewParameter("@maxsessions", pgsql.Integer)
+	err = maxParam.SetValue(max)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	command := `
+	DELETE FROM sessionlimits where uid=@uid and terminaltype=@terminaltype;
+	`
+	_, err = conn.Execute(command, uidParam, terminalTypeParam)
+	if err == nil && max > 0 {
+		command = `
+		INSERT INTO sessionlimits(uid,terminaltype,maxsessions)
+		VALUES(@uid,@terminaltype,@maxsessions);
+		`
+		_, err = conn.Execute(command, uidParam, terminalTypeParam, maxParam)
+	}
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	}
+	pool.Release(conn)
+	return
+}
@@ -0,0 +1,60 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	sessionTokenSecret = []byte("test secret")
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	now := time.Now()
+	token := signSessionToken(SessionToken{Tid: 7, Uid: 10001, TerminalType: TerminalType_Mobile_Iphone, Expire: now.Add(time.Hour).Unix()})
+	st, err := parseSessionToken(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tid != 7 || st.Uid != 10001 || st.TerminalType != TerminalType_Mobile_Iphone {
+		t.Errorf("got %+v", st)
+	}
+}
+
+func TestSessionTokenTampered(t *testing.T) {
+	now := time.Now()
+	token := signSessionToken(SessionToken{Tid: 7, Uid: 10001, TerminalType: TerminalType_PC, Expire: now.Add(time.Hour).Unix()})
+	forged := signSessionToken(SessionToken{Tid: 7, Uid: 10002, TerminalType: TerminalType_PC, Expire: now.Add(time.Hour).Unix()})
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err := parseSessionToken(tampered, now); err != errInvalidSessionToken {
+		t.Errorf("tampered token: got err %v", err)
+	}
+	if _, err := parseSessionToken("not a token", now); err != errInvalidSessionToken {
+		t.Errorf("garbage token: got err %v", err)
+	}
+}
+
+func TestSessionTokenExpired(t *testing.T) {
+	now := time.Now()
+	token := signSessionToken(SessionToken{Tid: 7, Uid: 10001, TerminalType: TerminalType_PC, Expire: now.Unix()})
+	st, err := parseSessionToken(token, now)
+	if err != errSessionTokenExpired {
+		t.Errorf("got err %v", err)
+	}
+	if st.Tid != 7 {
+		t.Errorf("expired token should still report its tid, got %d", st.Tid)
+	}
+}
+
+func TestRetiredExpire(t *testing.T) {
+	now := time.Now()
+	st := SessionToken{Tid: 7, Expire: now.Add(time.Hour).Unix()}
+	if expire := retiredExpire(st, now); expire != now.Add(SessionTokenGrace).Unix() {
+		t.Errorf("got expire %d, expect the grace window", expire)
+	}
+	st.Expire = now.Add(time.Second).Unix()
+	if expire := retiredExpire(st, now); expire != st.Expire {
+		t.Errorf("got expire %d, expect the token expiry %d", expire, st.Expire)
+	}
+}
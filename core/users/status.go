@@ -0,0 +1,354 @@
+package users
+
+import (
+	"github.com/lxn/go-pgsql"
+	"hug/logs"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Availability status set by the user, shown next to the online status.
+const (
+	Status_Available int16 = iota
+	Status_Away
+	Status_Busy
+	Status_DoNotDisturb
+)
+
+const StatusTextMaxLen = 200
+
+// MaxGetUserStatuses bounds the uids of one GetUserStatusesReqPkt.
+const MaxGetUserStatuses = 200
+
+// StatusExpireInterval is how often ExpireUserStatusesLoop resets the
+// expired statuses.
+var StatusExpireInterval = 10 * time.Second
+
+// StatusCacheTTL is how long IsDoNotDisturb trusts a status it read. A
+// status set on another node is seen that late at most.
+var StatusCacheTTL = 30 * time.Second
+
+const createUserStatusTableSql = `
+CREATE TABLE IF NOT EXISTS userstatus
+		(
+		  uid bigint NOT NULL unique,
+		  status smallint NOT NULL default 0,
+		  text character varying(200) default '',
+		  expire bigint NOT NULL default 0,
+		  updatestamp bigint NOT NULL default 0,
+		  CONSTRAINT userstatus_pkey PRIMARY KEY (uid)
+		)
+		WITH (OIDS=FALSE);
+		`
+
+// UserStatus is the availability of a user. Expire is in milliseconds, once
+// it passed the user is Status_Available again. 0 never expires.
+type UserStatus struct {
+	Uid    int64  `json:"uid"`
+	Status int16  `json:"s,omitempty"`
+	Text   string `json:"t,omitempty"`
+	Expire int64  `json:"e,omitempty"`
+	Stamp  int64  `json:"st,omitempty"`
+}
+
+type SetUserStatusReqPkt struct {
+	Status int16  `json:"s,omitempty"`
+	Text   string `json:"t,omitempty"`
+	Expire int64  `json:"e,omitempty"`
+}
+
+type SetUserStatusResPkt struct {
+	Code  int8  `json:"c,omitempty"`
+	Stamp int64 `json:"st,omitempty"`
+}
+
+type GetUserStatusesReqPkt struct {
+	Uids []int64 `json:"uids,omitempty"`
+}
+
+type GetUserStatusesResPkt struct {
+	Statuses []UserStatus `json:"ss,omitempty"`
+}
+
+type UserStatusChangedNotificationPkt struct {
+	Status UserStatus `json:"s"`
+}
+
+const (
+	SetUserStatusCode_None int8 = iota
+	SetUserStatusCode_InvalidStatus
+	SetUserStatusCode_TextTooLong
+	SetUserStatusCode_Expired
+	SetUserStatusCode_DatabaseErr
+)
+
+func nowMillis(now time.Time) int64 {
+	return now.UnixNano() / 1000000
+}
+
+// Effective returns the status as it is at now, with expired statuses reset
+// to Status_Available.
+func (s UserStatus) Effective(now time.Time) (status UserStatus) {
+	status = s
+	if status.Expire > 0 && status.Expire <= nowMillis(now) {
+		status.Status = Status_Available
+		status.Text = ""
+		status.Expire = 0
+	}
+	return
+}
+
+func checkUserStatus(reqPkt SetUserStatusReqPkt, now time.Time) (code int8) {
+	if reqPkt.Status < Status_Available || reqPkt.Status > Status_DoNotDisturb {
+		code = SetUserStatusCode_InvalidStatus
+	} else if utf8.RuneCountInString(reqPkt.Text) > StatusTextMaxLen {
+		code = SetUserStatusCode_TextTooLong
+	} else if reqPkt.Expire != 0 && reqPkt.Expire <= nowMillis(now) {
+		code = SetUserStatusCode_Expired
+	} else {
+		code = SetUserStatusCode_None
+	}
+	return
+}
+
+// SetUserStatus stores the status of uid and notifies its relations. They are
+// notified again by ExpireUserStatusesLoop when the status expires.
+func SetUserStatus(uid int64, reqPkt SetUserStatusReqPkt) (code int8, stamp int64) {
+	now := time.Now()
+	code = checkUserStatus(reqPkt, now)
+	if code != SetUserStatusCode_None {
+		return
+	}
+	stamp = now.UnixNano()
+	status := UserStatus{Uid: uid, Status: reqPkt.Status, Text: reqPkt.Text, Expire: reqPkt.Expire, Stamp: stamp}
+	err := saveUserStatus(status)
+	if err != nil {
+		code = SetUserStatusCode_DatabaseErr
+		stamp = 0
+		return
+	}
+	cacheUserStatus(status, now)
+	UserStatusChangedNotificationChan <- uid
+	return
+}
+
+// ExpireUserStatusesLoop resets the statuses whose expiry passed and notifies
+// the relations of their users. Every node may run it: a status is reset,
+// and notified, by one of them only.
+func ExpireUserStatusesLoop() {
+	for {
+		time.Sleep(StatusExpireInterval)
+		for _, uid := range expireUserStatuses(time.Now()) {
+			UserStatusChangedNotificationChan <- uid
+		}
+		pruneStatusCache(time.Now())
+	}
+}
+
+func expireUserStatuses(now time.Time) (uids []int64) {
+	command := `
+	UPDATE userstatus set status=@status,text='',expire=0,updatestamp=@updatestamp
+	where expire > 0 AND expire <= @now RETURNING uid;
+	`
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err := statusParam.SetValue(Status_Available)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	updatestampParam := pgsql.NewParameter("@updatestamp", pgsql.Bigint)
+	err = updatestampParam.SetValue(now.UnixNano())
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	nowParam := pgsql.NewParameter("@now", pgsql.Bigint)
+	err = nowParam.SetValue(nowMillis(now))
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	res, err := conn.Query(command, statusParam, updatestampParam, nowParam)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	} else {
+		for {
+			hasRow, _ := res.FetchNext()
+			if !hasRow {
+				break
+			}
+			var uid int64
+			err = res.Scan(&uid)
+			if err != nil {
+				logs.Logger.Critical("Error scan: ", err)
+				continue
+			}
+			uids = append(uids, uid)
+		}
+		res.Close()
+	}
+	pool.Release(conn)
+	return
+}
+
+func saveUserStatus(status UserStatus) (err error) {
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(status.Uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(status.Status)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	textParam := pgsql.NewParameter("@text", pgsql.Text)
+	err = textParam.SetValue(status.Text)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	expireParam := pgsql.NewParameter("@expire", pgsql.Bigint)
+	err = expireParam.SetValue(status.Expire)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	updatestampParam := pgsql.NewParameter("@updatestamp", pgsql.Bigint)
+	err = updatestampParam.SetValue(status.Stamp)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	command := `
+	UPDATE userstatus set status=@status,text=@text,expire=@expire,updatestamp=@updatestamp where uid=@uid;
+	`
+	n, err := conn.Execute(command, uidParam, statusParam, textParam, expireParam, updatestampParam)
+	if err == nil && n == 0 {
+		command = `
+		INSERT INTO userstatus(uid,status,text,expire,updatestamp)
+		VALUES(@uid,@status,@text,@expire,@updatestamp);
+		`
+		_, err = conn.Execute(command, uidParam, statusParam, textParam, expireParam, updatestampParam)
+	}
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+	}
+	pool.Release(conn)
+	return
+}
+
+// GetUserStatus returns the stored status of uid, which may have expired.
+// Users who never set one are Status_Available.
+func GetUserStatus(uid int64) (status UserStatus, err error) {
+	status.Uid = uid
+	command := `
+	SELECT status, text, expire, updatestamp FROM userstatus where uid = @uid;
+	`
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+	} else {
+		res, err := conn.Query(command, uidParam)
+		if err != nil {
+			logs.Logger.Critical("Error execute query: ", err)
+		} else if hasRow, _ := res.FetchNext(); hasRow {
+			err = res.Scan(&status.Status, &status.Text, &status.Expire, &status.Stamp)
+			if err != nil {
+				logs.Logger.Critical("Error scan: ", err)
+			}
+		}
+		res.Close()
+	}
+	pool.Release(conn)
+	return
+}
+
+// GetUserStatuses returns the effective statuses of the first
+// MaxGetUserStatuses uids.
+func GetUserStatuses(uids []int64) (statuses []UserStatus) {
+	if len(uids) > MaxGetUserStatuses {
+		uids = uids[:MaxGetUserStatuses]
+	}
+	now := time.Now()
+	statuses = make([]UserStatus, 0, len(uids))
+	for _, uid := range uids {
+		status, err := GetUserStatus(uid)
+		if err != nil {
+			continue
+		}
+		statuses = append(statuses, status.Effective(now))
+	}
+	return
+}
+
+// IsDoNotDisturb reports whether uid is in Status_DoNotDisturb now, in which
+// case no mobile pushes are sent to it. The status is read from the database
+// at most once per StatusCacheTTL.
+func IsDoNotDisturb(uid int64) bool {
+	now := time.Now()
+	status, ok := cachedUserStatus(uid, now)
+	if !ok {
+		var err error
+		status, err = GetUserStatus(uid)
+		if err != nil {
+			return false
+		}
+		cacheUserStatus(status, now)
+	}
+	return status.Effective(now).Status == Status_DoNotDisturb
+}
+
+type cachedStatus struct {
+	status UserStatus
+	until  time.Time
+}
+
+var statusCacheLock sync.Mutex
+var statusCache = make(map[int64]cachedStatus)
+
+func cachedUserStatus(uid int64, now time.Time) (status UserStatus, ok bool) {
+	statusCacheLock.Lock()
+	cached, ok := statusCache[uid]
+	statusCacheLock.Unlock()
+	if ok && now.After(cached.until) {
+		ok = false
+	}
+	status = cached.status
+	return
+}
+
+func cacheUserStatus(status UserStatus, now time.Time) {
+	statusCacheLock.Lock()
+	statusCache[status.Uid] = cachedStatus{status: status, until: now.Add(StatusCacheTTL)}
+	statusCacheLock.Unlock()
+}
+
+func pruneStatusCache(now time.Time) {
+	statusCacheLock.Lock()
+	for uid, cached := range statusCache {
+		if now.After(cached.until) {
+			delete(statusCache, uid)
+		}
+	}
+	statusCacheLock.Unlock()
+}
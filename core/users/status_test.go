@@ -0,0 +1,61 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStatusEffective(t *testing.T) {
+	now := time.Now()
+	status := UserStatus{Uid: 1, Status: Status_DoNotDisturb, Text: "in a meeting", Expire: nowMillis(now.Add(time.Hour))}
+	if s := status.Effective(now); s.Status != Status_DoNotDisturb || s.Text != "in a meeting" {
+		t.Errorf("active status got %+v", s)
+	}
+	if s := status.Effective(now.Add(2 * time.Hour)); s.Status != Status_Available || s.Text != "" || s.Expire != 0 {
+		t.Errorf("expired status got %+v", s)
+	}
+	status.Expire = 0
+	if s := status.Effective(now.Add(24 * time.Hour)); s.Status != Status_DoNotDisturb {
+		t.Errorf("status without expiry got %+v", s)
+	}
+}
+
+func TestCheckUserStatus(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		reqPkt SetUserStatusReqPkt
+		code   int8
+	}{
+		{SetUserStatusReqPkt{Status: Status_Busy, Text: "busy"}, SetUserStatusCode_None},
+		{SetUserStatusReqPkt{Status: Status_DoNotDisturb, Expire: nowMillis(now.Add(time.Hour))}, SetUserStatusCode_None},
+		{SetUserStatusReqPkt{Status: Status_DoNotDisturb + 1}, SetUserStatusCode_InvalidStatus},
+		{SetUserStatusReqPkt{Status: -1}, SetUserStatusCode_InvalidStatus},
+		{SetUserStatusReqPkt{Status: Status_Away, Text: strings.Repeat("会", StatusTextMaxLen)}, SetUserStatusCode_None},
+		{SetUserStatusReqPkt{Status: Status_Away, Text: strings.Repeat("a", StatusTextMaxLen+1)}, SetUserStatusCode_TextTooLong},
+		{SetUserStatusReqPkt{Status: Status_Away, Expire: nowMillis(now.Add(-time.Minute))}, SetUserStatusCode_Expired},
+	}
+	for _, c := range cases {
+		if code := checkUserStatus(c.reqPkt, now); code != c.code {
+			t.Errorf("%+v got code %d, expect %d", c.reqPkt, code, c.code)
+		}
+	}
+}
+
+func TestStatusCache(t *testing.T) {
+	now := time.Now()
+	cacheUserStatus(UserStatus{Uid: 7, Status: Status_DoNotDisturb, Expire: nowMillis(now.Add(time.Second))}, now)
+	if !IsDoNotDisturb(7) {
+		t.Error("cached do not disturb status not used")
+	}
+	if status, ok := cachedUserStatus(7, now.Add(2*time.Second)); !ok || status.Effective(now.Add(2*time.Second)).Status != Status_Available {
+		t.Errorf("got %+v cached %v, expect the expired status available", status, ok)
+	}
+	if _, ok := cachedUserStatus(7, now.Add(StatusCacheTTL+time.Second)); ok {
+		t.Error("status cached beyond StatusCacheTTL")
+	}
+	pruneStatusCache(now.Add(StatusCacheTTL + time.Second))
+	if len(statusCache) != 0 {
+		t.Errorf("%d statuses left after prune", len(statusCache))
+	}
+}
@@ -69,6 +69,11 @@ const (
 	AuthCode_UserNotVerified
 	AuthCode_DatabaseErr
 	AuthCode_WaitAuth
+	AuthCode_ProtocolNotSupported
+	AuthCode_InvalidToken
+	AuthCode_TokenExpired
+	AuthCode_TooManyAttempts
+	AuthCode_UserFrozen
 )
 
 const (
@@ -81,21 +86,75 @@ const (
 	TerminalType_Web
 )
 
+const (
+	ProtocolVersion_Legacy int16 = iota
+	ProtocolVersion_1
+)
+
+const (
+	ProtocolVersion_Current = ProtocolVersion_1
+	ProtocolVersion_Min     = ProtocolVersion_Legacy
+)
+
+const (
+	Capability_Compression uint32 = 1 << iota
+	Capability_Receipts
+	Capability_MsgPack
+	// The client answers every Cmd_Msg it receives with a response, and an
+	// inbound message stays waiting to send until it does.
+	Capability_MsgAck
+	// The server pushes the messages waiting to send after Cmd_Auth.
+	Capability_OfflineReplay
+)
+
+// ServerCapabilities lists the capabilities this server implements. A
+// capability is only enabled for a connection if the client asks for it too.
+const ServerCapabilities uint32 = Capability_Compression | Capability_Receipts | Capability_MsgPack | Capability_MsgAck | Capability_OfflineReplay
+
+// NegotiateProtocol picks the protocol version and capabilities used with a
+// client. Clients which do not send a version are treated as legacy clients
+// without any capabilities.
+func NegotiateProtocol(version int16, caps uint32) (negotiatedVersion int16, negotiatedCaps uint32, ok bool) {
+	if version < ProtocolVersion_Min {
+		return
+	}
+	negotiatedVersion = version
+	if negotiatedVersion > ProtocolVersion_Current {
+		negotiatedVersion = ProtocolVersion_Current
+	}
+	if negotiatedVersion > ProtocolVersion_Legacy {
+		negotiatedCaps = caps & ServerCapabilities
+	}
+	ok = true
+	return
+}
+
 type AuthInfo struct {
 	Account         string
 	Uid             int64
 	TerminalType    int16
 	TerminalSystem  string
 	TerminalVersion string
+	ProtocolVersion int16
+	Capabilities    uint32
 	AuthCode        int8
+	SessionTokenId  int64
+	SessionId       int64
+	MaxSessions     int
+	SignInTime      int64
 	IosDevice       devices.IosDevice
 	AndroidDevice   devices.AndroidDevice
 }
 
+func (a *AuthInfo) HasCapability(capability uint32) bool {
+	return a.Capabilities&capability == capability
+}
+
 func (a *AuthInfo) String() (str string) {
 	str = "Auth info ["
 	str += ("Account:" + a.Account)
 	str += (fmt.Sprintf(", Uid: %d", a.Uid))
+	str += (fmt.Sprintf(", Session: %d", a.SessionId))
 	str += ", Terminal type:"
 	switch a.TerminalType {
 	case TerminalType_PC:
@@ -115,6 +174,7 @@ func (a *AuthInfo) String() (str string) {
 	}
 	str += (", Terminal system:" + a.TerminalSystem)
 	str += (", Terminal version:" + a.TerminalVersion)
+	str += (fmt.Sprintf(", Protocol version: %d, Capabilities: 0x%x", a.ProtocolVersion, a.Capabilities))
 	str += "]"
 	return
 }
@@ -152,6 +212,10 @@ func AuthUser(account, password string) (code int8, uid int64) {
 		code = AuthCode_PasswordIncorrect
 		return
 	}
+	if user.Status == UserStatus_Frozen {
+		code = AuthCode_UserFrozen
+		return
+	}
 	code = AuthCode_None
 	uid = user.Uid
 	return
@@ -370,6 +434,85 @@ func createUser(email, password string) (uid int64, err error) {
 	return
 }
 
+// UpdatePassword changes the password of account and revokes its session
+// tokens, so devices have to sign in with the new password.
+func UpdatePassword(account, password string) (err error) {
+	user, err := GetUser(account)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uid := user.Uid
+	command := `
+	UPDATE users set Password=@password where uid=@uid;
+	`
+	passwordParam := pgsql.NewParameter("@password", pgsql.Text)
+	err = passwordParam.SetValue(EncryptPassword(account, password))
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	_, err = conn.Execute(command, passwordParam, uidParam)
+	pool.Release(conn)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+		return
+	}
+	RevokeUserSessionTokens(uid)
+	return
+}
+
+// SetUserAccountStatus sets the status of uid to UserStatus_Active or
+// UserStatus_Frozen. Freezing revokes the session tokens, so the user cannot
+// sign in again on any device.
+func SetUserAccountStatus(uid int64, status int16) (err error) {
+	command := `
+	UPDATE users set Status=@status where uid=@uid;
+	`
+	statusParam := pgsql.NewParameter("@status", pgsql.Smallint)
+	err = statusParam.SetValue(status)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	uidParam := pgsql.NewParameter("@uid", pgsql.Bigint)
+	err = uidParam.SetValue(uid)
+	if err != nil {
+		logs.Logger.Critical(err)
+		return
+	}
+	conn, err := pool.Acquire()
+	if err != nil {
+		logs.Logger.Critical("Error acquiring connection: ", err)
+		return
+	}
+	n, err := conn.Execute(command, statusParam, uidParam)
+	pool.Release(conn)
+	if err != nil {
+		logs.Logger.Critical("Error executing query: ", err)
+		return
+	}
+	if n == 0 {
+		err = errors.New(fmt.Sprint("user ", uid, " not exist"))
+		return
+	}
+	if status == UserStatus_Frozen {
+		RevokeUserSessionTokens(uid)
+	}
+	return
+}
+
 func IsUidValid(uid int64) (valid bool) {
 	if uid <= 0 {
 		return false
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hug/core/corps"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/users"
+	"os"
+	"strconv"
+)
+
+// oneArg returns the only positional argument of a command.
+func oneArg(args []string, name string) (arg string, err error) {
+	if len(args) != 1 {
+		err = fmt.Errorf("expect one argument <%s>", name)
+		return
+	}
+	arg = args[0]
+	return
+}
+
+func idArg(args []string, name string) (id int64, err error) {
+	arg, err := oneArg(args, name)
+	if err != nil {
+		return
+	}
+	id, err = strconv.ParseInt(arg, 10, 64)
+	if err != nil || id <= 0 {
+		err = fmt.Errorf("invalid %s: %s", name, arg)
+	}
+	return
+}
+
+func getUser(account string) (user users.User, err error) {
+	user, err = users.GetUser(account)
+	if err == nil && user.Uid == 0 {
+		err = fmt.Errorf("user %s not exist", account)
+	}
+	return
+}
+
+func userCreate(args []string) (err error) {
+	var regUser users.RegUser
+	fs := flag.NewFlagSet("user-create", flag.ContinueOnError)
+	fs.StringVar(&regUser.Email, "email", "", "account email")
+	fs.StringVar(&regUser.Password, "password", "", "password")
+	fs.StringVar(&regUser.Mobile, "mobile", "", "mobile number")
+	fs.StringVar(&regUser.NickName, "nickname", "", "nick name")
+	fs.StringVar(&regUser.RealName, "realname", "", "real name")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	uid, code := users.CreateUser(regUser)
+	if code != users.RegUserCode_None {
+		return fmt.Errorf("create user failed, code %d", code)
+	}
+	return printJSON(map[string]int64{"uid": uid})
+}
+
+func userShow(args []string) (err error) {
+	account, err := oneArg(args, "account")
+	if err != nil {
+		return
+	}
+	user, err := getUser(account)
+	if err != nil {
+		return
+	}
+	user.Passwrod = ""
+	info, err := users.GetUserInfo(user.Uid)
+	if err != nil {
+		return
+	}
+	return printJSON(map[string]interface{}{"user": user, "info": info})
+}
+
+func setAccountStatus(args []string, status int16) (err error) {
+	account, err := oneArg(args, "account")
+	if err != nil {
+		return
+	}
+	user, err := getUser(account)
+	if err != nil {
+		return
+	}
+	return users.SetUserAccountStatus(user.Uid, status)
+}
+
+// userFreeze stops account from signing in and closes its open sessions on
+// the nodes of a cluster. Sessions open on a server running alone last until
+// they disconnect.
+func userFreeze(args []string) (err error) {
+	if err = setAccountStatus(args, users.UserStatus_Frozen); err != nil {
+		return
+	}
+	user, err := getUser(args[0])
+	if err != nil {
+		return
+	}
+	err = closeSessions(user.Uid)
+	if err == errNoCluster {
+		fmt.Fprintln(os.Stderr, "hugctl: no cluster, open sessions last until they disconnect")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("account frozen, but open sessions not closed: %v", err)
+	}
+	return
+}
+
+func userUnfreeze(args []string) error {
+	return setAccountStatus(args, users.UserStatus_Active)
+}
+
+// userPassword sets the password of account and revokes its session tokens.
+// Sessions open on a running server last until they disconnect.
+func userPassword(args []string) (err error) {
+	var password string
+	fs := flag.NewFlagSet("user-password", flag.ContinueOnError)
+	fs.StringVar(&password, "password", "", "new password")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if password == "" {
+		return errors.New("-password is required")
+	}
+	account, err := oneArg(fs.Args(), "account")
+	if err != nil {
+		return
+	}
+	if _, err = getUser(account); err != nil {
+		return
+	}
+	return users.UpdatePassword(account, password)
+}
+
+// sessionLimit prints how many sessions of a terminal type account may have
+// at once, or sets it to max. A max of 0 falls back to the server default.
+// Sessions open beyond a lowered limit are only closed by the next sign in.
+func sessionLimit(args []string) (err error) {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("expect arguments <account> <terminaltype> [max]")
+	}
+	user, err := getUser(args[0])
+	if err != nil {
+		return
+	}
+	terminalType, err := strconv.ParseInt(args[1], 10, 16)
+	if err != nil || terminalType < 0 {
+		return fmt.Errorf("invalid terminaltype: %s", args[1])
+	}
+	if len(args) == 3 {
+		max, err := strconv.Atoi(args[2])
+		if err != nil || max < 0 {
+			return fmt.Errorf("invalid max: %s", args[2])
+		}
+		err = users.SetMaxSessions(user.Uid, int16(terminalType), max)
+		if err != nil {
+			return err
+		}
+	}
+	max := users.GetMaxSessions(user.Uid, int16(terminalType))
+	return printJSON(map[string]int64{"uid": user.Uid, "terminaltype": terminalType, "max": int64(max)})
+}
+
+func regList(args []string) (err error) {
+	regUsers, err := users.GetRegUsers()
+	if err != nil {
+		return
+	}
+	for i := range regUsers {
+		regUsers[i].Password = ""
+		regUsers[i].VerifyCode = ""
+	}
+	return printJSON(regUsers)
+}
+
+func regVerify(args []string) (err error) {
+	email, err := oneArg(args, "email")
+	if err != nil {
+		return
+	}
+	if code := users.VerifyRegUser(email); code != users.VerifyRegUserCode_None {
+		return fmt.Errorf("verify %s failed, code %d", email, code)
+	}
+	return
+}
+
+// corpCreate creates a corp with its owner as worker, like Cmd_CreateCorp.
+func corpCreate(args []string) (err error) {
+	var reqPkt corps.CreateCorpReqPkt
+	fs := flag.NewFlagSet("corp-create", flag.ContinueOnError)
+	fs.StringVar(&reqPkt.FullName, "name", "", "full name")
+	fs.StringVar(&reqPkt.ShortName, "short", "", "short name")
+	fs.Int64Var(&reqPkt.OwnerUid, "owner", 0, "uid of the owner")
+	fs.StringVar(&reqPkt.OwnerName, "ownername", "", "worker name of the owner")
+	fs.StringVar(&reqPkt.OwnerPost, "ownerpost", "", "post of the owner")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	cid, code := corps.CreateCorp(reqPkt)
+	if code != corps.CreateCorpCode_None {
+		return fmt.Errorf("create corp failed, code %d", code)
+	}
+	worker := corps.CreateWorkerReqPkt{
+		Name:       reqPkt.OwnerName,
+		Cid:        cid,
+		Post:       reqPkt.OwnerPost,
+		Uid:        reqPkt.OwnerUid,
+		Permission: corps.WorkerPermission_CorpOwner,
+	}
+	wid, code := corps.CreateWorker(worker)
+	if code != corps.CreateWorkerCode_None {
+		return fmt.Errorf("corp %d created, but not its owner worker, code %d", cid, code)
+	}
+	return printJSON(map[string]int64{"cid": cid, "wid": wid})
+}
+
+func corpShow(args []string) (err error) {
+	cid, err := idArg(args, "cid")
+	if err != nil {
+		return
+	}
+	corp, err := corps.GetCorp(cid)
+	if err != nil {
+		return
+	}
+	if corp.Cid == 0 {
+		return fmt.Errorf("corp %d not exist", cid)
+	}
+	depts, err := corps.GetCorpDepts(cid)
+	if err != nil {
+		return
+	}
+	workers, err := corps.GetCorpWorkers(cid)
+	if err != nil {
+		return
+	}
+	return printJSON(map[string]interface{}{"corp": corp, "depts": depts, "workers": workers})
+}
+
+func workerCreate(args []string) (err error) {
+	var reqPkt corps.CreateWorkerReqPkt
+	var permission int
+	fs := flag.NewFlagSet("worker-create", flag.ContinueOnError)
+	fs.Int64Var(&reqPkt.Cid, "cid", 0, "corp id")
+	fs.StringVar(&reqPkt.Name, "name", "", "worker name")
+	fs.Int64Var(&reqPkt.Uid, "uid", 0, "bound user")
+	fs.Int64Var(&reqPkt.Did, "did", 0, "dept id")
+	fs.StringVar(&reqPkt.Post, "post", "", "post")
+	fs.IntVar(&permission, "permission", int(corps.WorkerPermission_Normal), "permission")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	reqPkt.Permission = int16(permission)
+	wid, code := corps.CreateWorker(reqPkt)
+	if code != corps.CreateWorkerCode_None {
+		return fmt.Errorf("create worker failed, code %d", code)
+	}
+	return printJSON(map[string]int64{"wid": wid})
+}
+
+func groupShow(args []string) (err error) {
+	gid, err := idArg(args, "gid")
+	if err != nil {
+		return
+	}
+	group, err := groups.GetGroup(gid)
+	if err != nil {
+		return
+	}
+	if group.Gid == 0 {
+		return fmt.Errorf("group %d not exist", gid)
+	}
+	members, err := groups.GetGroupMembers(gid)
+	if err != nil {
+		return
+	}
+	return printJSON(map[string]interface{}{"group": group, "members": members})
+}
+
+func groupRemove(args []string) (err error) {
+	gid, err := idArg(args, "gid")
+	if err != nil {
+		return
+	}
+	exist, err := groups.IsGidExist(gid)
+	if err != nil {
+		return
+	}
+	if !exist {
+		return fmt.Errorf("group %d not exist", gid)
+	}
+	if code := groups.RemoveGroupWithGid(gid); code != groups.RemoveGroupCode_None {
+		return fmt.Errorf("remove group failed, code %d", code)
+	}
+	return
+}
+
+// history prints the messages between uid and a user or group, with their
+// bodies.
+func history(args []string) (err error) {
+	var reqPkt messages.GetMsgHistoryReqPkt
+	var isGroup bool
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.Int64Var(&reqPkt.Uid, "uid", 0, "uid whose history is read")
+	fs.Int64Var(&reqPkt.Contact.Id, "contact", 0, "uid or gid of the contact")
+	fs.BoolVar(&isGroup, "group", false, "contact is a group")
+	fs.IntVar(&reqPkt.Size, "size", 20, "number of messages")
+	fs.Int64Var(&reqPkt.MaxMessageId, "max", 0, "only messages before this id")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if reqPkt.Uid <= 0 || reqPkt.Contact.Id <= 0 {
+		return errors.New("-uid and -contact are required")
+	}
+	reqPkt.Contact.Type = messages.MCT_User
+	if isGroup {
+		reqPkt.Contact.Type = messages.MCT_Group
+	}
+	resPkt := messages.GetMsgHistory(reqPkt)
+	mids := append(append([]int64{}, resPkt.InMids...), resPkt.OutMids...)
+	bodys := messages.GetMsgBodys(messages.GetMsgBodysReqPkt{Mids: mids})
+	return printJSON(map[string]interface{}{"in": resPkt.InMids, "out": resPkt.OutMids, "messages": bodys.MessageBodys})
+}
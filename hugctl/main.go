@@ -0,0 +1,130 @@
+// hugctl runs admin tasks against the databases of a Hug server, using the
+// same core packages as the server. Changes are recorded like those made by
+// clients, so online users pick them up with the Cmd_Get*Changed commands.
+//
+//	hugctl [-config config_db.json] [-imserver config_imserver.json] <command> [flags] [args]
+//
+// The imserver config is only read to reach the nodes of a cluster, to close
+// the sessions of frozen users.
+//
+// Run hugctl without a command to list the commands.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hug/config"
+	"hug/core/corps"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/logs"
+	"hug/utils"
+	"os"
+	"sort"
+)
+
+// imserverConfigFile is read by the commands which reach running servers.
+var imserverConfigFile string
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"user-create":   {"-email e -password p [-mobile m] [-nickname n] [-realname r]", userCreate},
+	"user-show":     {"<account>", userShow},
+	"user-freeze":   {"<account>  (closes open sessions on cluster nodes only)", userFreeze},
+	"user-unfreeze": {"<account>", userUnfreeze},
+	"user-password": {"-password p <account>", userPassword},
+	"session-limit": {"<account> <terminaltype> [max]", sessionLimit},
+	"reg-list":      {"", regList},
+	"reg-verify":    {"<email>", regVerify},
+	"corp-create":   {"-name n -owner uid [-ownername n] [-ownerpost p] [-short s]", corpCreate},
+	"corp-show":     {"<cid>", corpShow},
+	"worker-create": {"-cid c -name n [-uid u] [-did d] [-post p] [-permission n]", workerCreate},
+	"group-show":    {"<gid>", groupShow},
+	"group-remove":  {"<gid>", groupRemove},
+	"history":       {"-uid u -contact id [-group] [-size n] [-max mid]", history},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hugctl [-config file] [-imserver file] [-log] <command> [flags] [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	configFile := flag.String("config", utils.ApplicationPath()+"/config_db.json", "database config file")
+	flag.StringVar(&imserverConfigFile, "imserver", utils.ApplicationPath()+"/config_imserver.json", "imserver config file, for the cluster")
+	useLog := flag.Bool("log", false, "log with the config_log xml of the server")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command:", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if *useLog {
+		logs.InitLogger()
+	} else {
+		logs.DisableLog()
+	}
+	err := connDB(*configFile)
+	if err == nil {
+		err = cmd.run(flag.Args()[1:])
+		closeDB()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hugctl:", err)
+		os.Exit(1)
+	}
+}
+
+func connDB(configFile string) (err error) {
+	cfg, err := config.LoadConfigFile(configFile)
+	if err != nil {
+		return
+	}
+	if err = users.ConnDB(cfg); err != nil {
+		return
+	}
+	if err = corps.ConnDB(cfg); err != nil {
+		return
+	}
+	if err = groups.ConnDB(cfg); err != nil {
+		return
+	}
+	err = messages.ConnDB(cfg)
+	return
+}
+
+func closeDB() {
+	users.CloseDB()
+	corps.CloseDB()
+	groups.CloseDB()
+	messages.CloseDB()
+}
+
+// printJSON writes v as indented JSON, with the field names of the protocol.
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hug/config"
+	"hug/imserver/cluster"
+)
+
+// errNoCluster is returned by closeSessions when the server runs alone.
+var errNoCluster = errors.New("no cluster_node in the imserver config")
+
+// closeSessions closes the sessions uid has open on the running servers, like
+// Cmd_RevokeSession does. The sessions are found through the registry of a
+// cluster and revoked on their nodes. A server running alone cannot be
+// reached, its sessions last until they disconnect.
+func closeSessions(uid int64) (err error) {
+	cfg, err := config.LoadConfigFile(imserverConfigFile)
+	if err != nil {
+		return
+	}
+	if node, _ := cfg.GetString("cluster_node"); len(node) == 0 {
+		return errNoCluster
+	}
+	secret, err := cfg.GetString("cluster_secret")
+	if err != nil {
+		return
+	}
+	registryHostPort, err := cfg.GetString("registry_host_port")
+	if err != nil {
+		return
+	}
+	registry := cluster.NewRemoteRegistry(registryHostPort, []byte(secret))
+	defer registry.Close()
+	sessions, err := registry.Lookup(uid)
+	if err != nil {
+		return
+	}
+	node := cluster.NewNode("hugctl", []byte(secret), nil)
+	defer node.Close()
+	for _, s := range sessions {
+		sendErr := node.Send(s.Node, cluster.Forward{Kind: cluster.ForwardKind_Revoke, Uid: uid, Session: s.Id})
+		if sendErr != nil {
+			err = fmt.Errorf("close session %d on node %s: %v", s.Id, s.Node, sendErr)
+		}
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+)
+
+// hello makes up the handshake opening every connection between nodes and
+// the registry. Each side proves it knows the secret of the cluster with the
+// HMAC of a nonce chosen by the other side, so the secret is never sent.
+type hello struct {
+	Nonce []byte `json:"n,omitempty"`
+	Mac   []byte `json:"m,omitempty"`
+}
+
+var errNotAuthenticated = errors.New("cluster peer not authenticated")
+
+func newNonce() (nonce []byte, err error) {
+	nonce = make([]byte, 16)
+	_, err = rand.Read(nonce)
+	return
+}
+
+func helloMac(secret, nonce []byte, side string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(side))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// acceptHello authenticates the peer which dialed the connection of enc and
+// dec, and then itself to the peer.
+func acceptHello(enc *json.Encoder, dec *json.Decoder, secret []byte) (err error) {
+	if len(secret) == 0 {
+		return errNotAuthenticated
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return
+	}
+	err = enc.Encode(hello{Nonce: nonce})
+	if err != nil {
+		return
+	}
+	var answer hello
+	err = dec.Decode(&answer)
+	if err != nil {
+		return
+	}
+	if len(answer.Nonce) == 0 || !hmac.Equal(answer.Mac, helloMac(secret, nonce, "dial")) {
+		return errNotAuthenticated
+	}
+	err = enc.Encode(hello{Mac: helloMac(secret, answer.Nonce, "accept")})
+	return
+}
+
+// dialHello authenticates to the peer accepting the connection of enc and
+// dec, and then the peer.
+func dialHello(enc *json.Encoder, dec *json.Decoder, secret []byte) (err error) {
+	if len(secret) == 0 {
+		return errNotAuthenticated
+	}
+	var challenge hello
+	err = dec.Decode(&challenge)
+	if err != nil {
+		return
+	}
+	if len(challenge.Nonce) == 0 {
+		return errNotAuthenticated
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return
+	}
+	err = enc.Encode(hello{Nonce: nonce, Mac: helloMac(secret, challenge.Nonce, "dial")})
+	if err != nil {
+		return
+	}
+	var answer hello
+	err = dec.Decode(&answer)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(answer.Mac, helloMac(secret, nonce, "accept")) {
+		return errNotAuthenticated
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"hug/logs"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("cluster-secret")
+
+func init() {
+	logs.DisableLog()
+}
+
+func sessionIds(sessions []Session) (ids []int64) {
+	for _, s := range sessions {
+		ids = append(ids, s.Id)
+	}
+	return
+}
+
+func testRegistry(t *testing.T, a, b PresenceRegistry) {
+	if evicted, err := a.Register(1, Session{Id: 10, TerminalType: 2, Node: "node-a"}, 2); err != nil || len(evicted) != 0 {
+		t.Fatalf("register got evicted %v err %v", evicted, err)
+	}
+	a.Register(1, Session{Id: 11, TerminalType: 3, Node: "node-a"}, 1)
+	b.Register(1, Session{Id: 12, TerminalType: 2, Node: "node-b"}, 2)
+	sessions, err := b.Lookup(1)
+	if err != nil || !reflect.DeepEqual(sessionIds(sessions), []int64{10, 11, 12}) {
+		t.Fatalf("lookup got %v err %v", sessions, err)
+	}
+	// A third session of terminal type 2 evicts the oldest one only.
+	evicted, _ := b.Register(1, Session{Id: 13, TerminalType: 2, Node: "node-b"}, 2)
+	if len(evicted) != 1 || evicted[0] != (Session{Id: 10, TerminalType: 2, Node: "node-a"}) {
+		t.Fatalf("got evicted %v, expect session 10", evicted)
+	}
+	// The closed evicted session must not remove another one.
+	a.Unregister(1, 10)
+	if sessions, _ = a.Lookup(1); !reflect.DeepEqual(sessionIds(sessions), []int64{11, 12, 13}) {
+		t.Fatalf("after unregister got %v", sessions)
+	}
+	b.UnregisterNode("node-b")
+	if sessions, _ = a.Lookup(1); !reflect.DeepEqual(sessionIds(sessions), []int64{11}) {
+		t.Fatalf("after unregister node got %v", sessions)
+	}
+	if sessions, _ = a.Lookup(404); len(sessions) != 0 {
+		t.Fatalf("unknown uid got %v", sessions)
+	}
+}
+
+func TestEvictSessions(t *testing.T) {
+	sessions := []Session{{Id: 1, TerminalType: 1}, {Id: 2, TerminalType: 2}, {Id: 3, TerminalType: 1}, {Id: 4, TerminalType: 1}}
+	kept, evicted := EvictSessions(sessions, 1, 1)
+	if !reflect.DeepEqual(sessionIds(kept), []int64{2, 4}) || !reflect.DeepEqual(sessionIds(evicted), []int64{1, 3}) {
+		t.Fatalf("got kept %v evicted %v", kept, evicted)
+	}
+	if kept, evicted = EvictSessions(sessions, 1, 0); len(kept) != 4 || len(evicted) != 0 {
+		t.Fatalf("unlimited got kept %v evicted %v", kept, evicted)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	r := NewMemoryRegistry()
+	testRegistry(t, r, r)
+}
+
+func TestRemoteRegistry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeRegistry(listener, NewMemoryRegistry(), testSecret)
+
+	a := NewRemoteRegistry(listener.Addr().String(), testSecret)
+	defer a.Close()
+	b := NewRemoteRegistry(listener.Addr().String(), testSecret)
+	defer b.Close()
+	testRegistry(t, a, b)
+
+	// A dropped idle connection is replaced by a new one within the call.
+	for _, c := range a.idle {
+		c.conn.Close()
+	}
+	if _, err := a.Lookup(1); err != nil {
+		t.Fatalf("lookup after reconnect error: %v", err)
+	}
+
+	wrong := NewRemoteRegistry(listener.Addr().String(), []byte("wrong"))
+	defer wrong.Close()
+	if _, err := wrong.Lookup(1); err == nil {
+		t.Fatal("lookup with a wrong secret succeeded")
+	}
+	// Calls then fail at once until registryRetryDelay passed.
+	start := time.Now()
+	if _, err := wrong.Lookup(1); err != errRegistryDown || time.Since(start) > registryTimeout/2 {
+		t.Fatalf("got %v after %v, expect errRegistryDown at once", err, time.Since(start))
+	}
+}
+
+func TestExpireNodes(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Register(1, Session{Id: 10, Node: "crashed"}, 0)
+	r.Register(1, Session{Id: 11, Node: "alive"}, 0)
+	r.Register(2, Session{Id: 20, Node: "crashed"}, 0)
+	before := time.Now()
+	r.Heartbeat("alive")
+
+	if expired := r.ExpireNodes(before); !reflect.DeepEqual(expired, []string{"crashed"}) {
+		t.Fatalf("expired %v, expect crashed", expired)
+	}
+	if sessions, _ := r.Lookup(1); !reflect.DeepEqual(sessionIds(sessions), []int64{11}) {
+		t.Fatalf("got %v after expiry", sessions)
+	}
+	if sessions, _ := r.Lookup(2); len(sessions) != 0 {
+		t.Fatalf("got %v after expiry", sessions)
+	}
+	// The crashed node comes back and learns it has to register again.
+	if known, _ := r.Heartbeat("crashed"); known {
+		t.Fatal("expired node still known")
+	}
+	if known, _ := r.Heartbeat("crashed"); !known {
+		t.Fatal("node unknown after heartbeat")
+	}
+}
+
+func TestNodeForward(t *testing.T) {
+	received := make(chan Forward, 4)
+	b := NewNode("127.0.0.1:0", testSecret, func(f Forward) { received <- f })
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := b.listener.Addr().String()
+	a := NewNode("a", testSecret, nil)
+	defer a.Close()
+
+	sent := Forward{Kind: ForwardKind_Packet, Uid: 7, Session: 2, Cmd: 0x23, Data: []byte{1, 2, 3}}
+	if err := a.Send(addr, sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-received:
+		if f.Uid != 7 || f.Cmd != 0x23 || f.Session != 2 || string(f.Data) != string(sent.Data) {
+			t.Fatalf("got %+v", f)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("forward not received")
+	}
+
+	// Restart b on the same address, a has to dial it again.
+	b.Close()
+	restarted := make(chan Forward, 1)
+	b = NewNode(addr, testSecret, func(f Forward) { restarted <- f })
+	if err := b.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := a.Send(addr, sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-restarted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("forward not received after restart")
+	}
+
+	// A node without the secret is refused and never reaches the handler.
+	intruder := NewNode("intruder", []byte("wrong"), nil)
+	defer intruder.Close()
+	if err := intruder.Send(addr, sent); err == nil {
+		t.Fatal("forward with a wrong secret succeeded")
+	}
+	select {
+	case f := <-restarted:
+		t.Fatalf("got forward %+v with a wrong secret", f)
+	default:
+	}
+}
@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"encoding/json"
+	"hug/logs"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ForwardKind_Packet uint8 = iota + 1
+	ForwardKind_Message
+	ForwardKind_Conflict
+	ForwardKind_Revoke
+)
+
+// Forward is sent from node to node to reach sessions connected elsewhere.
+// For ForwardKind_Packet and ForwardKind_Message, Data is written as a Cmd
+// request to every session of Uid except Session. For ForwardKind_Conflict,
+// the session Session of Uid was evicted by a newer one and has to be closed.
+// For ForwardKind_Revoke, the session Session was revoked by the user, or by
+// an admin freezing the user.
+type Forward struct {
+	Kind    uint8  `json:"k"`
+	Uid     int64  `json:"u"`
+	Session int64  `json:"s,omitempty"`
+	Cmd     uint8  `json:"cmd,omitempty"`
+	Data    []byte `json:"d,omitempty"`
+}
+
+const nodeTimeout = 3 * time.Second
+
+type peer struct {
+	lock sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// Node sends and receives Forwards. Its Id is the address other nodes dial.
+// Connections between nodes are authenticated with the secret of the
+// cluster but not encrypted, so the address should still only be reachable
+// from inside the cluster.
+type Node struct {
+	Id        string
+	secret    []byte
+	handler   func(f Forward)
+	listener  net.Listener
+	peersLock sync.Mutex
+	peers     map[string]*peer
+	incoming  map[net.Conn]bool
+}
+
+func NewNode(id string, secret []byte, handler func(f Forward)) *Node {
+	return &Node{
+		Id:       id,
+		secret:   secret,
+		handler:  handler,
+		peers:    make(map[string]*peer),
+		incoming: make(map[net.Conn]bool),
+	}
+}
+
+// Listen receives Forwards on hostPort and passes them to the handler, in
+// the order every peer sent them. Every Forward is acknowledged once read.
+func (n *Node) Listen(hostPort string) (err error) {
+	n.listener, err = net.Listen("tcp", hostPort)
+	if err != nil {
+		return
+	}
+	go n.serve(n.listener)
+	return
+}
+
+func (n *Node) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logs.Logger.Info("node listener closed: ", err)
+			return
+		}
+		go n.servePeer(conn)
+	}
+}
+
+func (n *Node) servePeer(conn net.Conn) {
+	n.peersLock.Lock()
+	n.incoming[conn] = true
+	n.peersLock.Unlock()
+	defer func() {
+		n.peersLock.Lock()
+		delete(n.incoming, conn)
+		n.peersLock.Unlock()
+		conn.Close()
+	}()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	conn.SetDeadline(time.Now().Add(nodeTimeout))
+	err := acceptHello(enc, dec, n.secret)
+	if err != nil {
+		logs.Logger.Warn("node peer ", conn.RemoteAddr(), ": ", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	for {
+		var f Forward
+		err = dec.Decode(&f)
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(nodeTimeout))
+		err = enc.Encode(true)
+		if err != nil {
+			return
+		}
+		n.handler(f)
+	}
+}
+
+// Send sends f to node, dialing it if needed, and waits until node read it.
+func (n *Node) Send(node string, f Forward) (err error) {
+	for retry := 0; retry < 2; retry++ {
+		p := n.getPeer(node)
+		p.lock.Lock()
+		if p.conn == nil {
+			p.conn, err = net.DialTimeout("tcp", node, nodeTimeout)
+			if err != nil {
+				p.conn = nil
+				p.lock.Unlock()
+				return
+			}
+			p.enc = json.NewEncoder(p.conn)
+			p.dec = json.NewDecoder(p.conn)
+			p.conn.SetDeadline(time.Now().Add(nodeTimeout))
+			err = dialHello(p.enc, p.dec, n.secret)
+			if err != nil {
+				p.conn.Close()
+				p.conn = nil
+				p.lock.Unlock()
+				return
+			}
+		}
+		p.conn.SetDeadline(time.Now().Add(nodeTimeout))
+		err = p.enc.Encode(f)
+		if err == nil {
+			var ack bool
+			err = p.dec.Decode(&ack)
+		}
+		if err != nil {
+			// The peer may have restarted, dial it again once.
+			p.conn.Close()
+			p.conn = nil
+		}
+		p.lock.Unlock()
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (n *Node) getPeer(node string) (p *peer) {
+	n.peersLock.Lock()
+	p, ok := n.peers[node]
+	if !ok {
+		p = &peer{}
+		n.peers[node] = p
+	}
+	n.peersLock.Unlock()
+	return
+}
+
+// Close stops listening and closes the connections from and to other nodes.
+func (n *Node) Close() {
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.peersLock.Lock()
+	for conn := range n.incoming {
+		conn.Close()
+	}
+	for _, p := range n.peers {
+		p.lock.Lock()
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		p.lock.Unlock()
+	}
+	n.peersLock.Unlock()
+}
@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeTTL is how long the registry keeps the sessions of a node which stopped
+// sending heartbeats, after it crashed for instance. Nodes send one every
+// NodeTTL/3.
+var NodeTTL = 30 * time.Second
+
+// Session is one signed in connection of a user. Id is unique across nodes.
+// SignInTime is in milliseconds.
+type Session struct {
+	Id              int64  `json:"id"`
+	TerminalType    int16  `json:"tt,omitempty"`
+	TerminalSystem  string `json:"ts,omitempty"`
+	TerminalVersion string `json:"tv,omitempty"`
+	RemoteAddr      string `json:"a,omitempty"`
+	SignInTime      int64  `json:"si,omitempty"`
+	Node            string `json:"n,omitempty"`
+}
+
+// PresenceRegistry records which node every online session of a user is
+// connected to, so that packets for the user can reach it from any node.
+type PresenceRegistry interface {
+	// Register records s for uid. If uid then has more than maxSessions
+	// sessions of s.TerminalType, the oldest are removed and returned.
+	// maxSessions <= 0 means no limit.
+	Register(uid int64, s Session, maxSessions int) (evicted []Session, err error)
+	// Unregister removes the session sessionId of uid.
+	Unregister(uid int64, sessionId int64) (err error)
+	// Lookup returns every online session of uid, oldest first.
+	Lookup(uid int64) (sessions []Session, err error)
+	// UnregisterNode removes every session recorded on node.
+	UnregisterNode(node string) (err error)
+	// Heartbeat tells that node is alive. known is false if the registry
+	// holds no sessions of node, because it expired them for instance.
+	Heartbeat(node string) (known bool, err error)
+}
+
+// EvictSessions returns sessions without the oldest sessions of terminalType
+// beyond maxSessions, and the removed sessions. sessions are oldest first.
+func EvictSessions(sessions []Session, terminalType int16, maxSessions int) (kept []Session, evicted []Session) {
+	if maxSessions <= 0 {
+		kept = sessions
+		return
+	}
+	count := 0
+	for _, s := range sessions {
+		if s.TerminalType == terminalType {
+			count++
+		}
+	}
+	kept = make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.TerminalType == terminalType && count > maxSessions {
+			evicted = append(evicted, s)
+			count--
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return
+}
+
+// MemoryRegistry is a PresenceRegistry for a single node, or for a cluster
+// when served by ServeRegistry.
+type MemoryRegistry struct {
+	lock  sync.RWMutex
+	users map[int64]([]Session)
+	// When every node last registered a session or sent a heartbeat.
+	nodes map[string]time.Time
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{users: make(map[int64]([]Session)), nodes: make(map[string]time.Time)}
+}
+
+func (r *MemoryRegistry) Register(uid int64, s Session, maxSessions int) (evicted []Session, err error) {
+	r.lock.Lock()
+	r.nodes[s.Node] = time.Now()
+	sessions := make([]Session, 0, len(r.users[uid])+1)
+	for _, old := range r.users[uid] {
+		if old.Id != s.Id {
+			sessions = append(sessions, old)
+		}
+	}
+	sessions = append(sessions, s)
+	r.users[uid], evicted = EvictSessions(sessions, s.TerminalType, maxSessions)
+	r.lock.Unlock()
+	return
+}
+
+func (r *MemoryRegistry) Unregister(uid int64, sessionId int64) (err error) {
+	r.lock.Lock()
+	r.users[uid] = removeSessions(r.users[uid], func(s Session) bool { return s.Id == sessionId })
+	if len(r.users[uid]) == 0 {
+		delete(r.users, uid)
+	}
+	r.lock.Unlock()
+	return
+}
+
+func (r *MemoryRegistry) Lookup(uid int64) (sessions []Session, err error) {
+	r.lock.RLock()
+	sessions = make([]Session, len(r.users[uid]))
+	copy(sessions, r.users[uid])
+	r.lock.RUnlock()
+	return
+}
+
+func (r *MemoryRegistry) UnregisterNode(node string) (err error) {
+	r.lock.Lock()
+	r.removeNodes(map[string]bool{node: true})
+	r.lock.Unlock()
+	return
+}
+
+func (r *MemoryRegistry) Heartbeat(node string) (known bool, err error) {
+	r.lock.Lock()
+	_, known = r.nodes[node]
+	r.nodes[node] = time.Now()
+	r.lock.Unlock()
+	return
+}
+
+// ExpireNodes removes the sessions of the nodes not heard from since before
+// and returns those nodes.
+func (r *MemoryRegistry) ExpireNodes(before time.Time) (expired []string) {
+	r.lock.Lock()
+	nodes := make(map[string]bool)
+	for node, seen := range r.nodes {
+		if seen.Before(before) {
+			nodes[node] = true
+			expired = append(expired, node)
+		}
+	}
+	if len(nodes) > 0 {
+		r.removeNodes(nodes)
+	}
+	r.lock.Unlock()
+	return
+}
+
+func (r *MemoryRegistry) removeNodes(nodes map[string]bool) {
+	for uid, sessions := range r.users {
+		sessions = removeSessions(sessions, func(s Session) bool { return nodes[s.Node] })
+		if len(sessions) == 0 {
+			delete(r.users, uid)
+		} else {
+			r.users[uid] = sessions
+		}
+	}
+	for node := range nodes {
+		delete(r.nodes, node)
+	}
+}
+
+// removeSessions returns a copy of sessions without those matching remove,
+// so slices handed out before stay unchanged.
+func removeSessions(sessions []Session, remove func(s Session) bool) (kept []Session) {
+	kept = make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if !remove(s) {
+			kept = append(kept, s)
+		}
+	}
+	return
+}
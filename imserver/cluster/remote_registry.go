@@ -0,0 +1,267 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"hug/logs"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	registryOp_Register uint8 = iota + 1
+	registryOp_Unregister
+	registryOp_Lookup
+	registryOp_UnregisterNode
+	registryOp_Heartbeat
+)
+
+const (
+	registryTimeout = 3 * time.Second
+	// After failing to reach the registry, calls fail at once for that long
+	// instead of every one waiting for registryTimeout.
+	registryRetryDelay = time.Second
+	registryMaxIdle    = 8
+)
+
+var errRegistryDown = errors.New("registry unreachable")
+
+type registryRequest struct {
+	Op          uint8   `json:"op"`
+	Uid         int64   `json:"u,omitempty"`
+	Session     Session `json:"s,omitempty"`
+	MaxSessions int     `json:"m,omitempty"`
+	Node        string  `json:"n,omitempty"`
+}
+
+type registryResponse struct {
+	Sessions []Session `json:"ss,omitempty"`
+	Known    bool      `json:"k,omitempty"`
+	Err      string    `json:"e,omitempty"`
+}
+
+// ServeRegistry shares registry with the nodes of a cluster, which reach it
+// through RemoteRegistry with the same secret. Every request is one JSON
+// object per line. The sessions of nodes which stop sending heartbeats are
+// removed after NodeTTL. It returns when listener is closed.
+func ServeRegistry(listener net.Listener, registry *MemoryRegistry, secret []byte) {
+	closed := make(chan bool)
+	defer close(closed)
+	go expireNodesLoop(registry, closed)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logs.Logger.Info("registry listener closed: ", err)
+			return
+		}
+		go serveRegistryConn(conn, registry, secret)
+	}
+}
+
+func expireNodesLoop(registry *MemoryRegistry, closed chan bool) {
+	ticker := time.NewTicker(NodeTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			for _, node := range registry.ExpireNodes(time.Now().Add(-NodeTTL)) {
+				logs.Logger.Warn("node ", node, " expired, sessions removed")
+			}
+		}
+	}
+}
+
+func serveRegistryConn(conn net.Conn, registry PresenceRegistry, secret []byte) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	conn.SetDeadline(time.Now().Add(registryTimeout))
+	err := acceptHello(enc, dec, secret)
+	if err != nil {
+		logs.Logger.Warn("registry peer ", conn.RemoteAddr(), ": ", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	for {
+		var req registryRequest
+		err = dec.Decode(&req)
+		if err != nil {
+			return
+		}
+		var res registryResponse
+		switch req.Op {
+		case registryOp_Register:
+			res.Sessions, err = registry.Register(req.Uid, req.Session, req.MaxSessions)
+		case registryOp_Unregister:
+			err = registry.Unregister(req.Uid, req.Session.Id)
+		case registryOp_Lookup:
+			res.Sessions, err = registry.Lookup(req.Uid)
+		case registryOp_UnregisterNode:
+			err = registry.UnregisterNode(req.Node)
+		case registryOp_Heartbeat:
+			res.Known, err = registry.Heartbeat(req.Node)
+		default:
+			err = errors.New("invalid registry op")
+		}
+		if err != nil {
+			res.Err = err.Error()
+		}
+		conn.SetWriteDeadline(time.Now().Add(registryTimeout))
+		err = enc.Encode(res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// RemoteRegistry is a PresenceRegistry served by ServeRegistry on another
+// host. Every call takes a connection of its own, so that a slow call does
+// not hold the others, and leaves it idle for the next ones.
+type RemoteRegistry struct {
+	hostPort  string
+	secret    []byte
+	lock      sync.Mutex
+	idle      []*registryConn
+	downUntil time.Time
+}
+
+type registryConn struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func NewRemoteRegistry(hostPort string, secret []byte) *RemoteRegistry {
+	return &RemoteRegistry{hostPort: hostPort, secret: secret}
+}
+
+func (r *RemoteRegistry) call(req registryRequest) (res registryResponse, err error) {
+	for retry := 0; retry < 2; retry++ {
+		// An idle connection may have been closed by the registry, retry
+		// once on a new one.
+		var c *registryConn
+		dialed := retry > 0
+		if !dialed {
+			c, err = r.getIdle()
+			if err != nil {
+				return
+			}
+		}
+		if c == nil {
+			dialed = true
+			c, err = r.dial()
+			if err != nil {
+				return
+			}
+		}
+		c.conn.SetDeadline(time.Now().Add(registryTimeout))
+		err = c.enc.Encode(req)
+		if err == nil {
+			err = c.dec.Decode(&res)
+		}
+		if err != nil {
+			c.conn.Close()
+			if dialed {
+				r.setDown()
+				return
+			}
+			continue
+		}
+		r.putIdle(c)
+		if len(res.Err) > 0 {
+			err = errors.New(res.Err)
+		}
+		return
+	}
+	return
+}
+
+func (r *RemoteRegistry) getIdle() (c *registryConn, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Now().Before(r.downUntil) {
+		err = errRegistryDown
+		return
+	}
+	if n := len(r.idle); n > 0 {
+		c = r.idle[n-1]
+		r.idle = r.idle[:n-1]
+	}
+	return
+}
+
+func (r *RemoteRegistry) putIdle(c *registryConn) {
+	r.lock.Lock()
+	if len(r.idle) < registryMaxIdle {
+		r.idle = append(r.idle, c)
+		c = nil
+	}
+	r.lock.Unlock()
+	if c != nil {
+		c.conn.Close()
+	}
+}
+
+func (r *RemoteRegistry) setDown() {
+	r.lock.Lock()
+	r.downUntil = time.Now().Add(registryRetryDelay)
+	r.lock.Unlock()
+}
+
+func (r *RemoteRegistry) dial() (c *registryConn, err error) {
+	conn, err := net.DialTimeout("tcp", r.hostPort, registryTimeout)
+	if err != nil {
+		r.setDown()
+		return
+	}
+	c = &registryConn{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	conn.SetDeadline(time.Now().Add(registryTimeout))
+	err = dialHello(c.enc, c.dec, r.secret)
+	if err != nil {
+		conn.Close()
+		c = nil
+		r.setDown()
+	}
+	return
+}
+
+func (r *RemoteRegistry) Register(uid int64, s Session, maxSessions int) (evicted []Session, err error) {
+	res, err := r.call(registryRequest{Op: registryOp_Register, Uid: uid, Session: s, MaxSessions: maxSessions})
+	evicted = res.Sessions
+	return
+}
+
+func (r *RemoteRegistry) Unregister(uid int64, sessionId int64) (err error) {
+	_, err = r.call(registryRequest{Op: registryOp_Unregister, Uid: uid, Session: Session{Id: sessionId}})
+	return
+}
+
+func (r *RemoteRegistry) Lookup(uid int64) (sessions []Session, err error) {
+	res, err := r.call(registryRequest{Op: registryOp_Lookup, Uid: uid})
+	sessions = res.Sessions
+	return
+}
+
+func (r *RemoteRegistry) UnregisterNode(node string) (err error) {
+	_, err = r.call(registryRequest{Op: registryOp_UnregisterNode, Node: node})
+	return
+}
+
+func (r *RemoteRegistry) Heartbeat(node string) (known bool, err error) {
+	res, err := r.call(registryRequest{Op: registryOp_Heartbeat, Node: node})
+	known = res.Known
+	return
+}
+
+// Close closes the idle connections to the registry.
+func (r *RemoteRegistry) Close() {
+	r.lock.Lock()
+	for _, c := range r.idle {
+		c.conn.Close()
+	}
+	r.idle = nil
+	r.lock.Unlock()
+}
@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/devices"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -19,6 +18,9 @@ func (h *SetAndroidDeviceStatusHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *SetAndroidDeviceStatusHandler) packetIn(pkt connections.Packet) {
 	var reqPkt devices.AndroidDeviceStatusPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -27,11 +29,6 @@ func (h *SetAndroidDeviceStatusHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn(err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " data:", string(pkt.Data))
-		return
-	}
 	if pkt.Conn.AuthInfo.AndroidDevice.IsValid() {
 		devices.SetAndroidDeviceStatus(pkt.Conn.AuthInfo.AndroidDevice.Alias, reqPkt.Status)
 	}
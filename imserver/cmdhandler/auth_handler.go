@@ -16,17 +16,25 @@ import (
 type AuthReqPacket struct {
 	User            string                `json:"u,omitempty"`
 	Password        string                `json:"p,omitempty"`
+	Token           string                `json:"tk,omitempty"`
 	TerminalType    int16                 `json:"tt,omitempty"`
 	TerminalSystem  string                `json:"ts,omitempty"`
 	TerminalVersion string                `json:"tv,omitempty"`
+	ProtocolVersion int16                 `json:"pv,omitempty"`
+	Capabilities    uint32                `json:"cap,omitempty"`
 	IosDevice       devices.IosDevice     `json:"ios,omitempty"`
 	AndroidDevice   devices.AndroidDevice `json:"and,omitempty"`
 }
 
 type AuthResPacket struct {
-	Code        int8       `json:"c,omitempty"`
-	ServerStamp int64      `json:"ss,omitempty"`
-	User        users.User `json:"usr,omitempty"`
+	Code            int8       `json:"c,omitempty"`
+	ServerStamp     int64      `json:"ss,omitempty"`
+	User            users.User `json:"usr,omitempty"`
+	ProtocolVersion int16      `json:"pv,omitempty"`
+	Capabilities    uint32     `json:"cap,omitempty"`
+	Token           string     `json:"tk,omitempty"`
+	TokenExpire     int64      `json:"te,omitempty"`
+	SessionId       int64      `json:"sn,omitempty"`
 }
 
 type AuthHandler struct {
@@ -39,9 +47,19 @@ func (h *AuthHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (a *AuthHandler) packetIn(pkt connections.Packet) {
+	if !pkt.Conn.AllowAuthFromIP() {
+		logs.Logger.Warn("too many auth attempts addr:", pkt.Conn.RemoteAddr())
+		refuseAuth(pkt)
+		return
+	}
 	authInfo, err := Auth(pkt.Data)
+	if authInfo.AuthCode == users.AuthCode_TooManyAttempts {
+		logs.Logger.Warn("too many auth attempts user:", authInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		refuseAuth(pkt)
+		return
+	}
 	if err != nil {
-		logs.Logger.Warn(err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " pkt:", string(pkt.Data))
+		logs.Logger.Warn(err, " user:", authInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 	}
 	var resData AuthResPacket
 	if authInfo.AuthCode == users.AuthCode_None {
@@ -53,7 +71,20 @@ func (a *AuthHandler) packetIn(pkt connections.Packet) {
 			resData.User = usr
 			resData.User.Passwrod = ""
 		}
-
+		resData.ProtocolVersion = authInfo.ProtocolVersion
+		resData.Capabilities = authInfo.Capabilities
+		authInfo.SessionId = users.NewSessionId()
+		authInfo.SignInTime = time.Now().UnixNano() / 1000000
+		authInfo.MaxSessions = users.GetMaxSessions(authInfo.Uid, authInfo.TerminalType)
+		resData.SessionId = authInfo.SessionId
+		token, t, err := users.IssueSessionToken(authInfo.Uid, authInfo.TerminalType)
+		if err != nil {
+			logs.Logger.Critical(err, " user:", authInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		} else {
+			resData.Token = token
+			resData.TokenExpire = t.Expire
+			authInfo.SessionTokenId = t.Tid
+		}
 	}
 	resData.Code = authInfo.AuthCode
 
@@ -70,6 +101,10 @@ func (a *AuthHandler) packetIn(pkt connections.Packet) {
 	}
 	pkt.Conn.SetAuthResult(authInfo)
 	if authInfo.AuthCode == users.AuthCode_None {
+		go heartbeatLoop(pkt.Conn)
+		if authInfo.HasCapability(users.Capability_OfflineReplay) {
+			go replayMsgs(pkt.Conn)
+		}
 		if authInfo.IosDevice.IsValid() {
 			devices.SetIosDeviceToken(authInfo.Uid, authInfo.IosDevice)
 			devices.SetIosDeviceStatus(authInfo.IosDevice.Token, devices.IosDeviceStatus_Foreground)
@@ -81,6 +116,15 @@ func (a *AuthHandler) packetIn(pkt connections.Packet) {
 	return
 }
 
+// refuseAuth answers a rate limited Cmd_Auth with an error packet and closes
+// the connection once the error is written.
+func refuseAuth(pkt connections.Packet) {
+	err := pkt.Conn.WritePacketNotify(Cmd_Auth, connections.Pkt_Type_Error, connections.PktErr_TooManyAuthAttempts, pkt.Sid, nil, pkt.Conn.Close)
+	if err != nil {
+		go pkt.Conn.Close()
+	}
+}
+
 type SignOutHandler struct {
 	CmdHandler
 }
@@ -92,6 +136,7 @@ func (h *SignOutHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *SignOutHandler) packetIn(pkt connections.Packet) {
 	//logs.Logger.Critical("Close connection account =", pkt.Conn.AuthInfo.Account)
+	users.RevokeSessionToken(pkt.Conn.AuthInfo.SessionTokenId)
 	if pkt.Conn.AuthInfo.IosDevice.IsValid() {
 		devices.SetIosDeviceToken(0, pkt.Conn.AuthInfo.IosDevice)
 	} else if pkt.Conn.AuthInfo.AndroidDevice.IsValid() {
@@ -112,12 +157,14 @@ func NewAuthHandlers(cmdHandlers *CmdHandlers) {
 
 func SendConflictNotificationLoop() {
 	for {
-		conn := <-connections.ConflictConnChan
-		if conn.AuthInfo.IosDevice.IsValid() {
-			devices.SetIosDeviceToken(0, conn.AuthInfo.IosDevice)
-		} else if conn.AuthInfo.AndroidDevice.IsValid() {
-			devices.SetAndroidDeviceAlias(0, conn.AuthInfo.AndroidDevice)
+		var conn *connections.ClientConnection
+		select {
+		case conn = <-connections.ConflictConnChan:
+		case conflict := <-connections.RemoteConflictChan:
+			forwardConflict(conflict)
+			continue
 		}
+		releasePushDevice(conn)
 		var wtBytes []byte
 		err := conn.WritePacket(Cmd_ConflictNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
 		if err != nil {
@@ -127,6 +174,38 @@ func SendConflictNotificationLoop() {
 	}
 }
 
+// releasePushDevice unbinds the push device of conn from its user, so the
+// device gets no more pushes once conn is closed.
+func releasePushDevice(conn *connections.ClientConnection) {
+	if conn.AuthInfo.IosDevice.IsValid() {
+		devices.SetIosDeviceToken(0, conn.AuthInfo.IosDevice)
+	} else if conn.AuthInfo.AndroidDevice.IsValid() {
+		devices.SetAndroidDeviceAlias(0, conn.AuthInfo.AndroidDevice)
+	}
+}
+
+type ShutdownNotificationPacket struct {
+	ReconnectDelay int64 `json:"rd,omitempty"`
+}
+
+// SendShutdownNotification tells every authed client that the server is going
+// down. Clients reconnect after the given delay in milliseconds, which is
+// spread over maxDelay so they do not all hit the remaining servers at once.
+func SendShutdownNotification(maxDelay time.Duration) {
+	for _, conn := range connections.Connections() {
+		if conn.AuthInfo.AuthCode != users.AuthCode_None {
+			continue
+		}
+		notification := ShutdownNotificationPacket{
+			ReconnectDelay: rand.Int63n(int64(maxDelay/time.Millisecond) + 1),
+		}
+		err := conn.WriteObject(Cmd_ShutdownNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), notification)
+		if err != nil {
+			logs.Logger.Warn(err, " user:", conn.AuthInfo.Account, " addr:", conn.RemoteAddr())
+		}
+	}
+}
+
 func Auth(authData []byte) (authInfo users.AuthInfo, authErr error) {
 	//ACCOUNT := "zhongjun@jim.com"
 	//PASSWORD := "test123"
@@ -141,7 +220,33 @@ func Auth(authData []byte) (authInfo users.AuthInfo, authErr error) {
 		authInfo.AuthCode = users.AuthCode_InvalidReq
 		return
 	}
-	var account, pwd string
+	var account string
+	if len(reqPacket.Token) > 0 {
+		account, authErr = authToken(&authInfo, reqPacket)
+	} else {
+		account, authErr = authPassword(&authInfo, reqPacket)
+	}
+	if authErr != nil {
+		return
+	}
+	if authInfo.AuthCode == users.AuthCode_None {
+		var ok bool
+		authInfo.ProtocolVersion, authInfo.Capabilities, ok = users.NegotiateProtocol(reqPacket.ProtocolVersion, reqPacket.Capabilities)
+		if !ok {
+			authInfo.AuthCode = users.AuthCode_ProtocolNotSupported
+		}
+	}
+	authInfo.Account = account
+	authInfo.TerminalType = reqPacket.TerminalType
+	authInfo.TerminalSystem = reqPacket.TerminalSystem
+	authInfo.TerminalVersion = reqPacket.TerminalVersion
+	authInfo.IosDevice = reqPacket.IosDevice
+	authInfo.AndroidDevice = reqPacket.AndroidDevice
+	return
+}
+
+func authPassword(authInfo *users.AuthInfo, reqPacket AuthReqPacket) (account string, authErr error) {
+	var pwd string
 	data, errBase64 := base64.StdEncoding.DecodeString(reqPacket.User)
 	if errBase64 != nil {
 		authErr = errors.New(fmt.Sprintln("User data base64 decode error:", errBase64))
@@ -157,12 +262,30 @@ func Auth(authData []byte) (authInfo users.AuthInfo, authErr error) {
 	} else {
 		pwd = string(data)
 	}
+	if !connections.AllowAuthForAccount(account) {
+		authInfo.AuthCode = users.AuthCode_TooManyAttempts
+		return
+	}
 	authInfo.AuthCode, authInfo.Uid = users.AuthUser(account, pwd)
-	authInfo.Account = account
-	authInfo.TerminalType = reqPacket.TerminalType
-	authInfo.TerminalSystem = reqPacket.TerminalSystem
-	authInfo.TerminalVersion = reqPacket.TerminalVersion
-	authInfo.IosDevice = reqPacket.IosDevice
-	authInfo.AndroidDevice = reqPacket.AndroidDevice
+	return
+}
+
+// authToken authenticates with a session token issued by a previous
+// Cmd_Auth. The response carries a new token, the used one stays valid for
+// users.SessionTokenGrace in case the response is lost.
+func authToken(authInfo *users.AuthInfo, reqPacket AuthReqPacket) (account string, authErr error) {
+	code, t := users.AuthSessionToken(reqPacket.Token, reqPacket.TerminalType)
+	authInfo.AuthCode = code
+	if code != users.AuthCode_None {
+		return
+	}
+	account, err := users.GetUserAccount(t.Uid)
+	if err != nil {
+		authInfo.AuthCode = users.AuthCode_DatabaseErr
+		logs.Logger.Critical(err)
+		return
+	}
+	users.RetireSessionToken(t)
+	authInfo.Uid = t.Uid
 	return
 }
@@ -0,0 +1,341 @@
+package cmdhandler
+
+import (
+	"fmt"
+	"hug/core/corps"
+	"hug/core/devices"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/rosters"
+	"hug/core/users"
+	"hug/logs"
+)
+
+// Relations answers the questions asked by authorizeRequest about groups,
+// corps, rosters and messages.
+type Relations interface {
+	IsGroupMember(gid, uid int64) bool
+	// GroupPermission is GroupMemberPermission_None if uid is not a member.
+	GroupPermission(gid, uid int64) int16
+	// WorkerOfUid has Wid 0 if uid is no normal worker of cid.
+	WorkerOfUid(cid, uid int64) corps.Worker
+	Worker(wid int64) corps.Worker
+	CidOfDid(did int64) int64
+	RosterRequest(rrid int64) rosters.RosterRequest
+	IsMsgInHistory(uid, mid int64) bool
+	// MsgsFrom returns the mids which were sent to uid by contact.
+	MsgsFrom(uid int64, mids []int64, contact messages.MessageContact) []int64
+}
+
+// dbRelations reads the relations from the databases of core.
+type dbRelations struct{}
+
+func (dbRelations) IsGroupMember(gid, uid int64) bool {
+	in, err := groups.IsMemberInGroup(gid, uid)
+	return err == nil && in
+}
+
+func (dbRelations) GroupPermission(gid, uid int64) int16 {
+	return groups.GetGroupMemberPermission(gid, uid)
+}
+
+func (dbRelations) WorkerOfUid(cid, uid int64) corps.Worker {
+	worker, err := corps.GetWorkerOfUid(cid, uid)
+	if err != nil {
+		return corps.Worker{}
+	}
+	return worker
+}
+
+func (dbRelations) Worker(wid int64) corps.Worker {
+	worker, err := corps.GetWorker(wid)
+	if err != nil {
+		return corps.Worker{}
+	}
+	return worker
+}
+
+func (dbRelations) CidOfDid(did int64) int64 {
+	return corps.GetCidOfDid(did)
+}
+
+func (dbRelations) RosterRequest(rrid int64) rosters.RosterRequest {
+	request, err := rosters.GetRequest(rrid)
+	if err != nil {
+		return rosters.RosterRequest{}
+	}
+	return request
+}
+
+func (dbRelations) IsMsgInHistory(uid, mid int64) bool {
+	in, err := messages.IsMsgInHistory(uid, mid)
+	return err == nil && in
+}
+
+func (dbRelations) MsgsFrom(uid int64, mids []int64, contact messages.MessageContact) []int64 {
+	from, err := messages.MsgsFrom(uid, mids, contact)
+	if err != nil {
+		return nil
+	}
+	return from
+}
+
+var relations Relations = dbRelations{}
+
+// authorizeRequest binds the decoded request of cmd to uid, the user signed
+// in on the connection, before it reaches core. Fields naming the acting user
+// are filled with uid when empty and must be uid otherwise. Groups, corps,
+// depts and workers named by the request must be visible to uid, and changes
+// need the matching group member or worker permission. Ids uid may not see
+// are dropped from list requests. It reports false if the request is
+// refused. Requests are told apart by their type, so a handler decoding
+// another type than its cmd suggests is still checked for what it does.
+// Request types not listed are refused, so a new request type needs a case
+// before its handler serves anyone.
+func authorizeRequest(uid int64, cmd uint8, reqPkt interface{}) bool {
+	switch r := reqPkt.(type) {
+	// Messages.
+	case *messages.Message:
+		if r.Author.Type == messages.MCT_None {
+			r.Author.Type = messages.MCT_User
+		}
+		if r.Author.Type != messages.MCT_User || !bindUid(uid, &r.Author.Id) {
+			return false
+		}
+		if r.From.Id != 0 && r.From != r.Author {
+			return false
+		}
+		for _, to := range append([]messages.MessageContact{r.To}, r.Ccs...) {
+			if to.Type == messages.MCT_Group && !relations.IsGroupMember(to.Id, uid) {
+				return false
+			}
+		}
+		return true
+	case *messages.GetMsgReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *messages.ReceiptReqPkt:
+		// Receipts are only given for one-to-one messages received.
+		if r.Contact.Type != messages.MCT_User || r.Contact.Id == uid {
+			return false
+		}
+		from := make(map[int64]bool)
+		for _, mid := range relations.MsgsFrom(uid, r.Mids, r.Contact) {
+			from[mid] = true
+		}
+		r.Mids = filterIds(r.Mids, func(mid int64) bool { return from[mid] })
+		return true
+	case *messages.GetReceiptsReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *messages.GetRencetContactsReqPacket:
+		return bindUid(uid, &r.Uid)
+	case *messages.GetMsgHistoryReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *messages.GetMsgBodysReqPkt:
+		r.Mids = filterIds(r.Mids, func(mid int64) bool { return relations.IsMsgInHistory(uid, mid) })
+		return true
+	case *messages.RemoveHistoryReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *messages.SetMsgPushReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *messages.GetMsgPushReqPkt:
+		return bindUid(uid, &r.Uid)
+
+	// Users.
+	case *users.SetUserInfoReqPkt:
+		return bindUid(uid, &r.Info.Uid)
+	case *users.GetUserInfoChangedReqPkt:
+		return bindUid(uid, &r.Uid)
+
+	// Corps, depts and workers.
+	case *corps.GetCidsReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *corps.GetCorpTreesReqPkt:
+		r.Cids = filterIds(r.Cids, func(cid int64) bool { return isWorkerOf(cid, uid) })
+		return true
+	case *corps.GetCorpChangedReqPkt:
+		r.Cids = filterIds(r.Cids, func(cid int64) bool { return isWorkerOf(cid, uid) })
+		return true
+	case *corps.CreateCorpReqPkt:
+		return bindUid(uid, &r.OwnerUid)
+	case *corps.GetCorpReqPkt:
+		return isWorkerOf(r.Cid, uid)
+	case *corps.Corp:
+		return relations.WorkerOfUid(r.Cid, uid).Permission >= corps.WorkerPermission_CorpAdmin
+	case *corps.RemoveCorpReqPkt:
+		return relations.WorkerOfUid(r.Cid, uid).Permission == corps.WorkerPermission_CorpOwner
+	case *corps.CreateDeptReqPkt:
+		if r.Pdid != 0 && relations.CidOfDid(r.Pdid) != r.Cid {
+			return false
+		}
+		return canManageDept(relations.WorkerOfUid(r.Cid, uid), r.Pdid)
+	case *corps.GetDeptReqPkt:
+		return isWorkerOf(relations.CidOfDid(r.Did), uid)
+	case *corps.Dept:
+		cid := relations.CidOfDid(r.Did)
+		if cid == 0 || (r.Pdid != 0 && relations.CidOfDid(r.Pdid) != cid) {
+			return false
+		}
+		r.Cid = cid
+		return canManageDept(relations.WorkerOfUid(cid, uid), r.Did)
+	case *corps.RemoveDeptReqPkt:
+		cid := relations.CidOfDid(r.Did)
+		return cid != 0 && relations.WorkerOfUid(cid, uid).Permission >= corps.WorkerPermission_CorpAdmin
+	case *corps.CreateWorkerReqPkt:
+		actor := relations.WorkerOfUid(r.Cid, uid)
+		return canManageDept(actor, r.Did) && r.Permission < actor.Permission
+	case *corps.GetWorkerReqPkt:
+		return isWorkerOf(relations.Worker(r.Wid).Cid, uid)
+	case *corps.Worker:
+		worker := relations.Worker(r.Wid)
+		if worker.Wid == 0 {
+			return false
+		}
+		r.Cid = worker.Cid
+		r.Uid = worker.Uid
+		if worker.Uid == uid {
+			// Workers edit their own contact details only.
+			return r.Permission == worker.Permission && r.Did == worker.Did && r.Status == worker.Status
+		}
+		actor := relations.WorkerOfUid(worker.Cid, uid)
+		return canManageWorker(actor, worker) && canManageDept(actor, r.Did) && r.Permission < actor.Permission
+	case *corps.BindWorkerUserReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *corps.RemoveWorkerReqPkt:
+		worker := relations.Worker(r.Wid)
+		return worker.Wid != 0 && canManageWorker(relations.WorkerOfUid(worker.Cid, uid), worker)
+
+	// Groups.
+	case *groups.CreateGroupReqPkt:
+		return bindUid(uid, &r.OwnerUid)
+	case *groups.RemoveGroupReqPkt:
+		return bindUid(uid, &r.RequestUid)
+	case *groups.Group:
+		return relations.GroupPermission(r.Gid, uid) >= groups.GroupMemberPermission_Admin
+	case *groups.GetGroupsReqPkt:
+		r.Gids = filterIds(r.Gids, func(gid int64) bool { return relations.IsGroupMember(gid, uid) })
+		return true
+	case *groups.GetGidsReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *groups.GroupMembersChangeReqPkt:
+		permission := relations.GroupPermission(r.Gid, uid)
+		if permission == groups.GroupMemberPermission_None {
+			return false
+		}
+		switch cmd {
+		case Cmd_AddGroupMembers:
+			for _, m := range r.Members {
+				if m.Permission > groups.GroupMemberPermission_Normal && m.Permission >= permission {
+					return false
+				}
+			}
+			return true
+		case Cmd_RemoveGroupMembers:
+			for _, m := range r.Members {
+				// Any member may leave, admins remove members below them.
+				if m.Uid != uid && (permission < groups.GroupMemberPermission_Admin || relations.GroupPermission(r.Gid, m.Uid) >= permission) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	case *groups.GroupMember:
+		permission := relations.GroupPermission(r.Gid, uid)
+		if permission == groups.GroupMemberPermission_None {
+			return false
+		}
+		if r.Uid == uid {
+			return r.Permission == permission
+		}
+		target := relations.GroupPermission(r.Gid, r.Uid)
+		return permission >= groups.GroupMemberPermission_Admin && target != groups.GroupMemberPermission_None &&
+			target < permission && r.Permission < permission
+	case *groups.GetGroupsMembersReqPkt:
+		r.Gids = filterIds(r.Gids, func(gid int64) bool { return relations.IsGroupMember(gid, uid) })
+		return true
+	case *groups.GetGroupChangedReqPkt:
+		r.Gids = filterIds(r.Gids, func(gid int64) bool { return relations.IsGroupMember(gid, uid) })
+		return true
+
+	// Rosters.
+	case *rosters.GetAllRostersReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *rosters.GetRostersReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *rosters.Roster:
+		return bindUid(uid, &r.Uid)
+	case *rosters.RemoveRosterReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *rosters.GetRosterChangedReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *rosters.RosterRequest:
+		return bindUid(uid, &r.FromUid) && r.ToUid != uid
+	case *rosters.GetRosterRequestReqPkt:
+		return bindUid(uid, &r.Uid)
+	case *rosters.HandleRosterRequestReqPkt:
+		// Only the user asked may accept or refuse a request.
+		return relations.RosterRequest(r.RequestId).ToUid == uid
+	case *rosters.IgnoreRequest:
+		return bindUid(uid, &r.Uid)
+
+	// File transfers.
+	case *FileTransferRequestPkt:
+		return bindUid(uid, &r.From)
+	case *HandleFileTransferRequestPkt:
+		return bindUid(uid, &r.To)
+	case *FileTransferStartLanNATReqPkt:
+		return bindUid(uid, &r.From)
+	case *FileTransferLocalNatFailedReqPkt:
+		return bindUid(uid, &r.From)
+
+	// Requests naming no user or resource, or checked by their handlers:
+	// users may see the infos of anyone, statuses and presences are
+	// filtered by relation, chat states are relayed to relations and
+	// sessions are revoked among the user's own.
+	case *users.GetUserInfosReqPkt, *users.SetUserStatusReqPkt, *users.GetUserStatusesReqPkt,
+		*GetPresencesReqPkt, *SubscribePresencesReqPkt, *ChatStatePkt, *RevokeSessionReqPkt,
+		*devices.AndroidDeviceStatusPkt, *devices.IosDeviceStatusPkt:
+		return true
+	}
+	logs.Logger.Warn("request type not authorized: ", fmt.Sprintf("%T", reqPkt), " cmd: ", fmt.Sprintf("0x%02x", cmd))
+	return false
+}
+
+// bindUid fills an empty uid field with the signed in uid and reports whether
+// the field names the signed in user.
+func bindUid(uid int64, field *int64) bool {
+	if *field == 0 {
+		*field = uid
+	}
+	return *field == uid
+}
+
+func isWorkerOf(cid, uid int64) bool {
+	return cid != 0 && relations.WorkerOfUid(cid, uid).Wid != 0
+}
+
+// canManageDept reports whether actor may change the dept did of its corp, 0
+// being the root of the corp. Corp admins manage every dept, dept admins
+// their own.
+func canManageDept(actor corps.Worker, did int64) bool {
+	if actor.Permission >= corps.WorkerPermission_CorpAdmin {
+		return true
+	}
+	return actor.Permission == corps.WorkerPermission_DeptAdmin && did != 0 && actor.Did == did
+}
+
+// canManageWorker reports whether actor may change or remove worker, which
+// needs a higher permission than the worker's.
+func canManageWorker(actor corps.Worker, worker corps.Worker) bool {
+	return actor.Cid == worker.Cid && canManageDept(actor, worker.Did) && worker.Permission < actor.Permission
+}
+
+func filterIds(ids []int64, allowed func(id int64) bool) (kept []int64) {
+	kept = make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if allowed(id) {
+			kept = append(kept, id)
+		}
+	}
+	return
+}
@@ -0,0 +1,407 @@
+package cmdhandler
+
+import (
+	"encoding/json"
+	"hug/core/corps"
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/core/rosters"
+	"hug/core/users"
+	"hug/imserver/connections"
+	"hug/logs"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeRelations struct {
+	members  map[int64]map[int64]int16
+	workers  map[int64]corps.Worker
+	depts    map[int64]int64
+	requests map[int64]rosters.RosterRequest
+	history  map[int64][]int64
+	from     map[int64]int64
+}
+
+func (f fakeRelations) IsGroupMember(gid, uid int64) bool {
+	return f.GroupPermission(gid, uid) != groups.GroupMemberPermission_None
+}
+
+func (f fakeRelations) GroupPermission(gid, uid int64) int16 {
+	return f.members[gid][uid]
+}
+
+func (f fakeRelations) WorkerOfUid(cid, uid int64) corps.Worker {
+	for _, worker := range f.workers {
+		if worker.Cid == cid && worker.Uid == uid {
+			return worker
+		}
+	}
+	return corps.Worker{}
+}
+
+func (f fakeRelations) Worker(wid int64) corps.Worker {
+	return f.workers[wid]
+}
+
+func (f fakeRelations) CidOfDid(did int64) int64 {
+	return f.depts[did]
+}
+
+func (f fakeRelations) RosterRequest(rrid int64) rosters.RosterRequest {
+	return f.requests[rrid]
+}
+
+func (f fakeRelations) MsgsFrom(uid int64, mids []int64, contact messages.MessageContact) (from []int64) {
+	for _, mid := range mids {
+		if contact.Type == messages.MCT_User && f.from[mid] == contact.Id && f.IsMsgInHistory(uid, mid) {
+			from = append(from, mid)
+		}
+	}
+	return
+}
+
+func (f fakeRelations) IsMsgInHistory(uid, mid int64) bool {
+	for _, id := range f.history[uid] {
+		if id == mid {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	alice int64 = iota + 1
+	bob
+	carol
+	dave
+	eve
+)
+
+// useFakeRelations replaces relations for one test.
+//
+// Group 10 has alice, carol as admin and dave as owner, group 20 only bob.
+// Corp 100 has alice, carol as corp admin and eve as admin of dept 110, corp
+// 200 is owned by bob. Roster request 50 goes from bob to alice. Alice got
+// message 7 from bob and 9 from carol, bob got 8 from alice.
+func useFakeRelations() (restore func()) {
+	old := relations
+	relations = fakeRelations{
+		members: map[int64]map[int64]int16{
+			10: {alice: groups.GroupMemberPermission_Normal, carol: groups.GroupMemberPermission_Admin, dave: groups.GroupMemberPermission_Owner},
+			20: {bob: groups.GroupMemberPermission_Owner},
+		},
+		workers: map[int64]corps.Worker{
+			1000: {Wid: 1000, Cid: 100, Uid: alice, Did: 111, Permission: corps.WorkerPermission_Normal},
+			1001: {Wid: 1001, Cid: 100, Uid: carol, Permission: corps.WorkerPermission_CorpAdmin},
+			1002: {Wid: 1002, Cid: 100, Uid: eve, Did: 110, Permission: corps.WorkerPermission_DeptAdmin},
+			1003: {Wid: 1003, Cid: 100, Did: 110, Permission: corps.WorkerPermission_Normal},
+			2000: {Wid: 2000, Cid: 200, Uid: bob, Permission: corps.WorkerPermission_CorpOwner},
+		},
+		depts:    map[int64]int64{110: 100, 111: 100, 210: 200},
+		requests: map[int64]rosters.RosterRequest{50: {RequestId: 50, FromUid: bob, ToUid: alice}},
+		history:  map[int64][]int64{alice: {7, 9}, bob: {8}},
+		from:     map[int64]int64{7: bob, 8: alice, 9: carol},
+	}
+	return func() { relations = old }
+}
+
+var (
+	toUser    = messages.MessageContact{Id: bob, Type: messages.MCT_User}
+	toGroup10 = messages.MessageContact{Id: 10, Type: messages.MCT_Group}
+	toGroup20 = messages.MessageContact{Id: 20, Type: messages.MCT_Group}
+	asAlice   = messages.MessageContact{Id: alice, Type: messages.MCT_User}
+	asBob     = messages.MessageContact{Id: bob, Type: messages.MCT_User}
+)
+
+// authzTests are requests of the fake relations and whether they pass.
+func authzTests() []struct {
+	name    string
+	uid     int64
+	cmd     uint8
+	reqPkt  interface{}
+	allowed bool
+} {
+	return []struct {
+		name    string
+		uid     int64
+		cmd     uint8
+		reqPkt  interface{}
+		allowed bool
+	}{
+		{"msg to user", alice, Cmd_Msg, &messages.Message{Author: asAlice, To: toUser}, true},
+		{"msg as other", alice, Cmd_Msg, &messages.Message{Author: asBob, To: toUser}, false},
+		{"msg from other", alice, Cmd_Msg, &messages.Message{Author: asAlice, From: asBob, To: toUser}, false},
+		{"msg as group", alice, Cmd_Msg, &messages.Message{Author: toGroup10, To: toUser}, false},
+		{"msg to own group", alice, Cmd_Msg, &messages.Message{Author: asAlice, To: toGroup10}, true},
+		{"msg to other group", alice, Cmd_Msg, &messages.Message{Author: asAlice, To: toGroup20}, false},
+		{"msg cc other group", alice, Cmd_Msg, &messages.Message{Author: asAlice, To: toUser, Ccs: []messages.MessageContact{toGroup20}}, false},
+		{"receipt for group", alice, Cmd_Receipt, &messages.ReceiptReqPkt{Contact: toGroup10, Mids: []int64{7}}, false},
+		{"receipt to self", alice, Cmd_Receipt, &messages.ReceiptReqPkt{Contact: asAlice, Mids: []int64{7}}, false},
+		{"receipts of other", alice, Cmd_GetReceipts, &messages.GetReceiptsReqPkt{Uid: bob}, false},
+		{"pull msgs of other", alice, Cmd_GetMsg, &messages.GetMsgReqPkt{Uid: bob}, false},
+		{"recent contacts of other", alice, Cmd_GetRecentContact, &messages.GetRencetContactsReqPacket{Uid: bob}, false},
+		{"history of other", alice, Cmd_GetMsgHistory, &messages.GetMsgHistoryReqPkt{Uid: bob}, false},
+		{"remove history of other", alice, Cmd_RemoveHistory, &messages.RemoveHistoryReqPkt{Uid: bob}, false},
+		{"set msg push of other", alice, Cmd_SetMsgPush, &messages.SetMsgPushReqPkt{Uid: bob}, false},
+		{"get msg push of other", alice, Cmd_GetMsgPush, &messages.GetMsgPushReqPkt{Uid: bob}, false},
+		{"own msg push", alice, Cmd_GetMsgPush, &messages.GetMsgPushReqPkt{Uid: alice}, true},
+
+		{"set info of other", alice, Cmd_SetUserInfo, &users.SetUserInfoReqPkt{Info: users.UserInfo{Uid: bob}}, false},
+		{"set own info", alice, Cmd_SetUserInfo, &users.SetUserInfoReqPkt{Info: users.UserInfo{Uid: alice}}, true},
+		{"info changes of other", alice, Cmd_GetUserInfoChanged, &users.GetUserInfoChangedReqPkt{Uid: bob}, false},
+
+		{"cids of other", alice, Cmd_GetCids, &corps.GetCidsReqPkt{Uid: bob}, false},
+		{"create corp for other", alice, Cmd_CreateCorp, &corps.CreateCorpReqPkt{OwnerUid: bob}, false},
+		{"get own corp", alice, Cmd_GetCorp, &corps.GetCorpReqPkt{Cid: 100}, true},
+		{"get other corp", alice, Cmd_GetCorp, &corps.GetCorpReqPkt{Cid: 200}, false},
+		{"set corp as worker", alice, Cmd_SetCorp, &corps.Corp{Cid: 100}, false},
+		{"set corp as admin", carol, Cmd_SetCorp, &corps.Corp{Cid: 100}, true},
+		{"set other corp", carol, Cmd_SetCorp, &corps.Corp{Cid: 200}, false},
+		{"remove corp as admin", carol, Cmd_RemoveCorp, &corps.RemoveCorpReqPkt{Cid: 100}, false},
+		{"remove corp as owner", bob, Cmd_RemoveCorp, &corps.RemoveCorpReqPkt{Cid: 200}, true},
+		{"remove other corp", bob, Cmd_RemoveCorp, &corps.RemoveCorpReqPkt{Cid: 100}, false},
+
+		{"create dept as worker", alice, Cmd_CreateDept, &corps.CreateDeptReqPkt{Cid: 100, Pdid: 111}, false},
+		{"create dept as dept admin", eve, Cmd_CreateDept, &corps.CreateDeptReqPkt{Cid: 100, Pdid: 110}, true},
+		{"create dept in other dept", eve, Cmd_CreateDept, &corps.CreateDeptReqPkt{Cid: 100, Pdid: 111}, false},
+		{"create dept under other corp", carol, Cmd_CreateDept, &corps.CreateDeptReqPkt{Cid: 100, Pdid: 210}, false},
+		{"create dept in other corp", carol, Cmd_CreateDept, &corps.CreateDeptReqPkt{Cid: 200}, false},
+		{"get own dept", alice, Cmd_GetDept, &corps.GetDeptReqPkt{Did: 110}, true},
+		{"get other dept", alice, Cmd_GetDept, &corps.GetDeptReqPkt{Did: 210}, false},
+		{"set dept as worker", alice, Cmd_SetDept, &corps.Dept{Did: 111, Cid: 100}, false},
+		{"set dept as admin", carol, Cmd_SetDept, &corps.Dept{Did: 111, Cid: 100}, true},
+		{"set dept of other corp", carol, Cmd_SetDept, &corps.Dept{Did: 210, Cid: 100}, false},
+		{"move dept to other corp", carol, Cmd_SetDept, &corps.Dept{Did: 111, Cid: 100, Pdid: 210}, false},
+		{"remove dept as dept admin", eve, Cmd_RemoveDept, &corps.RemoveDeptReqPkt{Did: 110}, false},
+		{"remove dept of other corp", carol, Cmd_RemoveDept, &corps.RemoveDeptReqPkt{Did: 210}, false},
+
+		{"create worker as worker", alice, Cmd_CreateWorker, &corps.CreateWorkerReqPkt{Cid: 100, Did: 111}, false},
+		{"create worker in own dept", eve, Cmd_CreateWorker, &corps.CreateWorkerReqPkt{Cid: 100, Did: 110, Permission: corps.WorkerPermission_Normal}, true},
+		{"create worker in other dept", eve, Cmd_CreateWorker, &corps.CreateWorkerReqPkt{Cid: 100, Did: 111}, false},
+		{"create admin as dept admin", eve, Cmd_CreateWorker, &corps.CreateWorkerReqPkt{Cid: 100, Did: 110, Permission: corps.WorkerPermission_DeptAdmin}, false},
+		{"create worker in other corp", carol, Cmd_CreateWorker, &corps.CreateWorkerReqPkt{Cid: 200}, false},
+		{"get worker of own corp", alice, Cmd_GetWorker, &corps.GetWorkerReqPkt{Wid: 1001}, true},
+		{"get worker of other corp", alice, Cmd_GetWorker, &corps.GetWorkerReqPkt{Wid: 2000}, false},
+		{"set own contact", alice, Cmd_SetWorker, &corps.Worker{Wid: 1000, Did: 111, Permission: corps.WorkerPermission_Normal}, true},
+		{"raise own permission", alice, Cmd_SetWorker, &corps.Worker{Wid: 1000, Did: 111, Permission: corps.WorkerPermission_CorpAdmin}, false},
+		{"set other worker as worker", alice, Cmd_SetWorker, &corps.Worker{Wid: 1003, Did: 110}, false},
+		{"set worker in own dept", eve, Cmd_SetWorker, &corps.Worker{Wid: 1003, Did: 110, Permission: corps.WorkerPermission_Normal}, true},
+		{"move worker out of own dept", eve, Cmd_SetWorker, &corps.Worker{Wid: 1003, Did: 111, Permission: corps.WorkerPermission_Normal}, false},
+		{"set worker of other dept", eve, Cmd_SetWorker, &corps.Worker{Wid: 1000, Did: 111, Permission: corps.WorkerPermission_Normal}, false},
+		{"set higher worker", eve, Cmd_SetWorker, &corps.Worker{Wid: 1001, Permission: corps.WorkerPermission_Normal}, false},
+		{"set worker of other corp", carol, Cmd_SetWorker, &corps.Worker{Wid: 2000}, false},
+		{"bind worker to other", alice, Cmd_BindWokerUser, &corps.BindWorkerUserReqPkt{Uid: bob}, false},
+		{"remove worker as worker", alice, Cmd_RemoveWorker, &corps.RemoveWorkerReqPkt{Wid: 1003}, false},
+		{"remove worker as admin", carol, Cmd_RemoveWorker, &corps.RemoveWorkerReqPkt{Wid: 1003}, true},
+		{"remove worker of other corp", carol, Cmd_RemoveWorker, &corps.RemoveWorkerReqPkt{Wid: 2000}, false},
+
+		{"create group for other", alice, Cmd_CreateGroup, &groups.CreateGroupReqPkt{OwnerUid: bob}, false},
+		{"remove group as other", alice, Cmd_RemoveGroup, &groups.RemoveGroupReqPkt{RequestUid: bob}, false},
+		{"set group as member", alice, Cmd_SetGroup, &groups.Group{Gid: 10}, false},
+		{"set group as admin", carol, Cmd_SetGroup, &groups.Group{Gid: 10}, true},
+		{"set other group", carol, Cmd_SetGroup, &groups.Group{Gid: 20}, false},
+		{"gids of other", alice, Cmd_GetGids, &groups.GetGidsReqPkt{Uid: bob}, false},
+		{"add member as member", alice, Cmd_AddGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: eve}}}, true},
+		{"add admin as member", alice, Cmd_AddGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: eve, Permission: groups.GroupMemberPermission_Admin}}}, false},
+		{"add member to other group", alice, Cmd_AddGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 20, Members: []groups.GroupMember{{Uid: eve}}}, false},
+		{"leave group", alice, Cmd_RemoveGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: alice}}}, true},
+		{"remove member as member", alice, Cmd_RemoveGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: carol}}}, false},
+		{"remove member as admin", carol, Cmd_RemoveGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: alice}}}, true},
+		{"remove owner as admin", carol, Cmd_RemoveGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: dave}}}, false},
+		{"remove member of other group", bob, Cmd_RemoveGroupMembers, &groups.GroupMembersChangeReqPkt{Gid: 10, Members: []groups.GroupMember{{Uid: alice}}}, false},
+		{"set own member name", alice, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: alice, Permission: groups.GroupMemberPermission_Normal}, true},
+		{"raise own member permission", alice, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: alice, Permission: groups.GroupMemberPermission_Owner}, false},
+		{"set other member as member", alice, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: carol, Permission: groups.GroupMemberPermission_Normal}, false},
+		{"set member as admin", carol, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: alice, Permission: groups.GroupMemberPermission_Normal}, true},
+		{"make admin as admin", carol, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: alice, Permission: groups.GroupMemberPermission_Admin}, false},
+		{"set owner as admin", carol, Cmd_SetGroupMember, &groups.GroupMember{Gid: 10, Uid: dave, Permission: groups.GroupMemberPermission_Normal}, false},
+
+		{"all rosters of other", alice, Cmd_GetAllRoster, &rosters.GetAllRostersReqPkt{Uid: bob}, false},
+		{"rosters of other", alice, Cmd_GetRosters, &rosters.GetRostersReqPkt{Uid: bob}, false},
+		{"set roster of other", alice, Cmd_SetRoster, &rosters.Roster{Uid: bob}, false},
+		{"remove roster of other", alice, Cmd_RemoveRoster, &rosters.RemoveRosterReqPkt{Uid: bob}, false},
+		{"roster changes of other", alice, Cmd_GetRosterChanged, &rosters.GetRosterChangedReqPkt{Uid: bob}, false},
+		{"roster request", alice, Cmd_RosterRequest, &rosters.RosterRequest{FromUid: alice, ToUid: bob}, true},
+		{"roster request as other", alice, Cmd_RosterRequest, &rosters.RosterRequest{FromUid: carol, ToUid: bob}, false},
+		{"roster request to self", alice, Cmd_RosterRequest, &rosters.RosterRequest{FromUid: alice, ToUid: alice}, false},
+		{"roster requests of other", alice, Cmd_GetRosterRequests, &rosters.GetRosterRequestReqPkt{Uid: bob}, false},
+		{"handle request to self", alice, Cmd_HandleRosterRequest, &rosters.HandleRosterRequestReqPkt{RequestId: 50}, true},
+		{"handle own request", bob, Cmd_HandleRosterRequest, &rosters.HandleRosterRequestReqPkt{RequestId: 50}, false},
+		{"handle request to other", carol, Cmd_HandleRosterRequest, &rosters.HandleRosterRequestReqPkt{RequestId: 50}, false},
+		{"ignore requests of other", alice, Cmd_SetIgnoreRosterRequest, &rosters.IgnoreRequest{Uid: bob}, false},
+
+		{"file transfer as other", alice, Cmd_FileTransferRequest, &FileTransferRequestPkt{From: bob, To: carol}, false},
+		{"file transfer", alice, Cmd_FileTransferRequest, &FileTransferRequestPkt{From: alice, To: bob}, true},
+		{"handle transfer to other", alice, Cmd_HandleDirectFileTransferRequest, &HandleFileTransferRequestPkt{From: bob, To: carol}, false},
+		{"lan nat as other", alice, Cmd_FileTransferStartLanNat, &FileTransferStartLanNATReqPkt{From: bob}, false},
+		{"nat failed as other", alice, Cmd_FileTransferLocalNATFailed, &FileTransferLocalNatFailedReqPkt{From: bob}, false},
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	defer useFakeRelations()()
+
+	for _, test := range authzTests() {
+		if allowed := authorizeRequest(test.uid, test.cmd, test.reqPkt); allowed != test.allowed {
+			t.Errorf("%s: allowed %v, expect %v", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAuthorizeRequestFills(t *testing.T) {
+	defer useFakeRelations()()
+
+	msg := &messages.Message{To: messages.MessageContact{Id: bob, Type: messages.MCT_User}}
+	if !authorizeRequest(alice, Cmd_Msg, msg) || msg.Author != (messages.MessageContact{Id: alice, Type: messages.MCT_User}) {
+		t.Errorf("author not filled: %+v", msg.Author)
+	}
+	gids := &groups.GetGidsReqPkt{}
+	if !authorizeRequest(alice, Cmd_GetGids, gids) || gids.Uid != alice {
+		t.Errorf("uid not filled: %d", gids.Uid)
+	}
+
+	// SetWorker and SetDept keep the stored corp and user.
+	worker := &corps.Worker{Wid: 1003, Cid: 200, Uid: bob, Did: 110, Permission: corps.WorkerPermission_Normal}
+	if !authorizeRequest(eve, Cmd_SetWorker, worker) || worker.Cid != 100 || worker.Uid != 0 {
+		t.Errorf("worker not bound to its corp: %+v", worker)
+	}
+	dept := &corps.Dept{Did: 111, Cid: 200}
+	if !authorizeRequest(carol, Cmd_SetDept, dept) || dept.Cid != 100 {
+		t.Errorf("dept not bound to its corp: %+v", dept)
+	}
+}
+
+func TestAuthorizeRequestFilters(t *testing.T) {
+	defer useFakeRelations()()
+
+	bodys := &messages.GetMsgBodysReqPkt{Mids: []int64{7, 8}}
+	corpTrees := &corps.GetCorpTreesReqPkt{Cids: []int64{100, 200}}
+	corpChanged := &corps.GetCorpChangedReqPkt{Cids: []int64{200, 100}}
+	groupList := &groups.GetGroupsReqPkt{Gids: []int64{10, 20}}
+	groupMembers := &groups.GetGroupsMembersReqPkt{Gids: []int64{20, 10}}
+	groupChanged := &groups.GetGroupChangedReqPkt{Gids: []int64{10, 20}}
+	receipt := &messages.ReceiptReqPkt{Contact: messages.MessageContact{Id: bob, Type: messages.MCT_User}, Mids: []int64{7, 8, 9}}
+	tests := []struct {
+		cmd    uint8
+		reqPkt interface{}
+		ids    *[]int64
+		expect []int64
+	}{
+		{Cmd_GetMsgBodys, bodys, &bodys.Mids, []int64{7}},
+		{Cmd_Receipt, receipt, &receipt.Mids, []int64{7}},
+		{Cmd_GetCorpTrees, corpTrees, &corpTrees.Cids, []int64{100}},
+		{Cmd_GetCorpChanged, corpChanged, &corpChanged.Cids, []int64{100}},
+		{Cmd_GetGroups, groupList, &groupList.Gids, []int64{10}},
+		{Cmd_GetGroupsMembers, groupMembers, &groupMembers.Gids, []int64{10}},
+		{Cmd_GetGroupChanged, groupChanged, &groupChanged.Gids, []int64{10}},
+	}
+	for _, test := range tests {
+		if !authorizeRequest(alice, test.cmd, test.reqPkt) {
+			t.Errorf("cmd 0x%02x refused", test.cmd)
+		}
+		if !reflect.DeepEqual(*test.ids, test.expect) {
+			t.Errorf("cmd 0x%02x: got ids %v, expect %v", test.cmd, *test.ids, test.expect)
+		}
+	}
+}
+
+func TestDecodeRequestForbidden(t *testing.T) {
+	defer useFakeRelations()()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := connections.New(server, make(chan connections.Packet, 1))
+	defer conn.Close()
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+	conn.AuthInfo.Uid = alice
+
+	var reqPkt groups.GetGidsReqPkt
+	go decodeRequest(connections.Packet{Conn: conn, Cmd: Cmd_GetGids, PktType: connections.Pkt_Type_Request, Sid: 9, Data: []byte(`{"uid":2}`)}, &reqPkt)
+	if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Error || pkt.Code != connections.PktErr_Forbidden || pkt.Sid != 9 {
+		t.Errorf("got %+v, expect forbidden", pkt)
+	}
+}
+
+func TestDecodeRequestTooLarge(t *testing.T) {
+	defer useFakeRelations()()
+
+	conn, client := newTestConn(t)
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+	conn.AuthInfo.Uid = alice
+	mids := make([]int64, messages.MaxGetMsgSize+1)
+	for i := range mids {
+		mids[i] = 7
+	}
+	data, err := json.Marshal(messages.ReceiptReqPkt{Contact: asBob, Mids: mids, Status: messages.ReceiptStatus_Read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqPkt messages.ReceiptReqPkt
+	go decodeRequest(connections.Packet{Conn: conn, Cmd: Cmd_Receipt, PktType: connections.Pkt_Type_Request, Sid: 9, Data: data}, &reqPkt)
+	if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Error || pkt.Code != connections.PktErr_BadRequest || pkt.Sid != 9 {
+		t.Errorf("got %+v, expect bad request", pkt)
+	}
+}
+
+// TestHandlersAuthorize sends the refused requests of authzTests through the
+// real handlers, so a handler decoding another request type than
+// authorizeRequest expects for its cmd shows up.
+func TestHandlersAuthorize(t *testing.T) {
+	defer useFakeRelations()()
+	cmdHandlers := NewCmdHanglers()
+	defer cmdHandlers.Stop(time.Second)
+
+	for cmd, h := range cmdHandlers.handlers {
+		if registered := reflect.ValueOf(h).Elem().FieldByName("Cmd").Uint(); registered != uint64(cmd) {
+			t.Errorf("handler of cmd 0x%02x registered under 0x%02x", registered, cmd)
+		}
+	}
+	for i, test := range authzTests() {
+		if test.allowed {
+			continue
+		}
+		data, err := json.Marshal(test.reqPkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, client := newTestConn(t)
+		conn.AuthInfo.AuthCode = users.AuthCode_None
+		conn.AuthInfo.Uid = test.uid
+		conn.AuthInfo.Capabilities = users.Capability_Receipts | users.Capability_MsgAck
+		sid := uint16(i)
+		cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: test.cmd, PktType: connections.Pkt_Type_Request, Sid: sid, Data: data})
+		if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Error || pkt.Code != connections.PktErr_Forbidden || pkt.Cmd != test.cmd || pkt.Sid != sid {
+			t.Errorf("%s: got %+v, expect forbidden", test.name, pkt)
+		}
+	}
+}
+
+// TestHandlersRequestTypesListed sends an empty request to every registered
+// handler, so a handler decoding a request type authorizeRequest does not
+// list shows up. Handlers get a connection each, as some block on the
+// notification channels core has not made.
+func TestHandlersRequestTypesListed(t *testing.T) {
+	defer useFakeRelations()()
+	testLog.Reset()
+	cmdHandlers := NewCmdHanglers()
+
+	for cmd := range cmdHandlers.handlers {
+		conn, client := newTestConn(t)
+		go io.Copy(ioutil.Discard, client)
+		conn.AuthInfo.AuthCode = users.AuthCode_None
+		conn.AuthInfo.Uid = alice
+		conn.AuthInfo.Capabilities = users.Capability_Receipts | users.Capability_MsgAck | users.Capability_OfflineReplay
+		cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: cmd, PktType: connections.Pkt_Type_Request, Sid: uint16(cmd), Data: []byte("{}")})
+	}
+	cmdHandlers.Stop(time.Second)
+	logs.Logger.Flush()
+
+	if logged := testLog.String(); strings.Contains(logged, "request type not authorized") {
+		t.Errorf("request types not listed by authorizeRequest:\n%s", logged)
+	}
+}
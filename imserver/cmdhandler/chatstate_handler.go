@@ -0,0 +1,93 @@
+package cmdhandler
+
+import (
+	"hug/core/groups"
+	"hug/core/messages"
+	"hug/imserver/connections"
+	"hug/logs"
+)
+
+// Chat states are shown to the peer while the user composes a message. They
+// are only relayed to online sessions, never stored nor pushed.
+const (
+	ChatState_None int8 = iota
+	ChatState_Typing
+	ChatState_Recording
+)
+
+// ChatStateRate limits Cmd_ChatState per connection unless cmd_rate_0x16 is
+// configured.
+var ChatStateRate = connections.CmdRate{Rate: 2, Burst: 5}
+
+// ChatStatePkt is sent by a client to To, a user or a group. The server sets
+// From and Author before relaying it: for a group From is the group and
+// Author the member who composes.
+type ChatStatePkt struct {
+	From   messages.MessageContact `json:"fr,omitempty"`
+	To     messages.MessageContact `json:"to,omitempty"`
+	Author messages.MessageContact `json:"ar,omitempty"`
+	State  int8                    `json:"s,omitempty"`
+}
+
+type ChatStateHandler struct {
+	CmdHandler
+}
+
+func (h *ChatStateHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_ChatState
+	cmdHandlers.handlers[h.Cmd] = h
+	if _, ok := connections.CmdRates[h.Cmd]; !ok {
+		connections.CmdRates[h.Cmd] = ChatStateRate
+	}
+}
+
+// packetIn relays the chat state to the online sessions of the peer, or of
+// the other group members. Like presences, it only reaches the relations of
+// the user. It is not answered.
+func (h *ChatStateHandler) packetIn(pkt connections.Packet) {
+	var reqPkt ChatStatePkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	if reqPkt.State < ChatState_None || reqPkt.State > ChatState_Recording || reqPkt.To.Id <= 0 {
+		logs.Logger.Warn("invalid chat state:", reqPkt.State, " to:", reqPkt.To.Id, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		return
+	}
+	uid := pkt.Conn.AuthInfo.Uid
+	reqPkt.Author = messages.MessageContact{Id: uid, Type: messages.MCT_User}
+	switch reqPkt.To.Type {
+	case messages.MCT_User:
+		if reqPkt.To.Id == uid {
+			return
+		}
+		relationUids := GetRelationUids(uid)
+		relations := make(map[int64]bool, len(relationUids))
+		for _, ruid := range relationUids {
+			relations[ruid] = true
+		}
+		if !isPresenceVisible(uid, relations, reqPkt.To.Id) {
+			logs.Logger.Warn("chat state to ", reqPkt.To.Id, " not a relation, user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+		reqPkt.From = reqPkt.Author
+		notifyUser(reqPkt.To.Id, h.Cmd, 0, reqPkt)
+	case messages.MCT_Group:
+		in, err := groups.IsMemberInGroup(reqPkt.To.Id, uid)
+		if err != nil || !in {
+			logs.Logger.Warn("chat state to group ", reqPkt.To.Id, " not a member, user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+		reqPkt.From = reqPkt.To
+		for _, member := range groups.GetGroupUids(reqPkt.To.Id) {
+			if member != uid {
+				notifyUser(member, h.Cmd, 0, reqPkt)
+			}
+		}
+	}
+	return
+}
+
+func NewChatStateHandlers(cmdHandlers *CmdHandlers) {
+	chatStateHandler := &ChatStateHandler{}
+	chatStateHandler.initHandler(cmdHandlers)
+}
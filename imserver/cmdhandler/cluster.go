@@ -0,0 +1,146 @@
+package cmdhandler
+
+import (
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/cluster"
+	"hug/imserver/connections"
+	"hug/logs"
+	"math/rand"
+)
+
+// clusterNode forwards packets to terminals connected to other nodes. It is
+// nil when the server runs alone.
+var clusterNode *cluster.Node
+
+// StartCluster joins the cluster as nodeId and receives forwards from other
+// nodes on hostPort, authenticated with secret. connections.Registry must be
+// shared by all nodes.
+func StartCluster(nodeId string, hostPort string, secret []byte) (err error) {
+	clusterNode = cluster.NewNode(nodeId, secret, handleForward)
+	err = clusterNode.Listen(hostPort)
+	return
+}
+
+// StopCluster stops receiving forwards.
+func StopCluster() {
+	if clusterNode != nil {
+		clusterNode.Close()
+	}
+}
+
+// notifyUser writes v as a cmd request to every session of uid except
+// exceptSession, forwarding it to the nodes of sessions connected elsewhere.
+// Pass 0 to reach every session.
+func notifyUser(uid int64, cmd uint8, exceptSession int64, v interface{}) {
+	writeLocal(uid, cmd, exceptSession, v)
+	forward(cluster.ForwardKind_Packet, uid, cmd, exceptSession, v)
+}
+
+// isSubscribed reports whether conn asked for notifications of cmd. Presence
+// notifications need a subscription, receipts Capability_Receipts.
+func isSubscribed(conn *connections.ClientConnection, cmd uint8) bool {
+	switch cmd {
+	case Cmd_PresenceChangedNotification:
+		return conn.IsPresenceSubscribed()
+	case Cmd_ReceiptNotification:
+		return conn.AuthInfo.HasCapability(users.Capability_Receipts)
+	}
+	return true
+}
+
+func writeLocal(uid int64, cmd uint8, exceptSession int64, v interface{}) (written bool) {
+	presence := connections.FindPresences(uid)
+	if presence != nil {
+		for _, conn := range presence.Sessions {
+			if conn.AuthInfo.SessionId == exceptSession || !isSubscribed(conn, cmd) {
+				continue
+			}
+			err := conn.WriteObject(cmd, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), v)
+			if err != nil {
+				logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
+				continue
+			}
+			written = true
+		}
+	}
+	return
+}
+
+// forward sends v to the other nodes sessions of uid are connected to. It
+// reports whether any node accepted it.
+func forward(kind uint8, uid int64, cmd uint8, exceptSession int64, v interface{}) (forwarded bool) {
+	if clusterNode == nil {
+		return
+	}
+	nodes := make(map[string]bool)
+	for _, s := range connections.FindRemoteSessions(uid) {
+		if s.Id != exceptSession {
+			nodes[s.Node] = true
+		}
+	}
+	if len(nodes) == 0 {
+		return
+	}
+	data, err := connections.MsgpackCodec.Marshal(v)
+	if err != nil {
+		logs.Logger.Critical("forward marshal error =", err, " uid:", uid)
+		return
+	}
+	f := cluster.Forward{Kind: kind, Uid: uid, Session: exceptSession, Cmd: cmd, Data: data}
+	for node := range nodes {
+		err = clusterNode.Send(node, f)
+		if err != nil {
+			logs.Logger.Warn("forward to node ", node, " error =", err, " uid:", uid)
+			continue
+		}
+		forwarded = true
+	}
+	return
+}
+
+// forwardConflict closes the session of uid connected to node, which was
+// evicted by a session signed in on this node.
+func forwardConflict(conflict connections.RemoteConflict) {
+	if clusterNode == nil {
+		return
+	}
+	f := cluster.Forward{Kind: cluster.ForwardKind_Conflict, Uid: conflict.Uid, Session: conflict.SessionId}
+	err := clusterNode.Send(conflict.Node, f)
+	if err != nil {
+		logs.Logger.Warn("forward conflict to node ", conflict.Node, " error =", err, " uid:", conflict.Uid)
+	}
+}
+
+func handleForward(f cluster.Forward) {
+	switch f.Kind {
+	case cluster.ForwardKind_Packet:
+		var v interface{}
+		err := connections.MsgpackCodec.Unmarshal(f.Data, &v)
+		if err != nil {
+			logs.Logger.Warn("forward unmarshal error =", err, " uid:", f.Uid)
+			return
+		}
+		writeLocal(f.Uid, f.Cmd, f.Session, v)
+	case cluster.ForwardKind_Message:
+		var msg messages.Message
+		err := connections.MsgpackCodec.Unmarshal(f.Data, &msg)
+		if err != nil {
+			logs.Logger.Warn("forward unmarshal error =", err, " uid:", f.Uid)
+			return
+		}
+		writeMessageLocal(f.Uid, msg)
+	case cluster.ForwardKind_Revoke:
+		revokeLocalSession(f.Uid, f.Session)
+	case cluster.ForwardKind_Conflict:
+		presence := connections.FindPresences(f.Uid)
+		if presence == nil {
+			return
+		}
+		if conn := presence.Session(f.Session); conn != nil {
+			connections.ConflictConnChan <- conn
+		}
+	default:
+		logs.Logger.Warn("invalid forward kind ", f.Kind, " uid:", f.Uid)
+	}
+}
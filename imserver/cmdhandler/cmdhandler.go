@@ -1,13 +1,13 @@
 package cmdhandler
 
 import (
-	"fmt"
 	"hug/core/corps"
 	"hug/core/groups"
-	"hug/core/users"
+	"hug/core/rosters"
 	"hug/imserver/connections"
 	"hug/logs"
 	"hug/utils"
+	"time"
 )
 
 const (
@@ -15,6 +15,11 @@ const (
 	Cmd_Auth
 	Cmd_ConflictNotification
 	Cmd_SignOut
+	Cmd_Ping
+	Cmd_ShutdownNotification
+	Cmd_GetSessions
+	Cmd_RevokeSession
+	Cmd_SessionRevokedNotification
 )
 const (
 	Cmd_Msg uint8 = 0x10 + iota
@@ -23,6 +28,10 @@ const (
 	Cmd_GetMsgHistory
 	Cmd_GetMsgBodys
 	Cmd_RemoveHistory
+	Cmd_ChatState
+	Cmd_Receipt
+	Cmd_ReceiptNotification
+	Cmd_GetReceipts
 )
 
 const (
@@ -30,6 +39,9 @@ const (
 	Cmd_SetUserInfo
 	Cmd_GetUserInfoChanged
 	Cmd_UserInfoChangedNotification
+	Cmd_SetUserStatus
+	Cmd_GetUserStatuses
+	Cmd_UserStatusChangedNotification
 )
 const (
 	Cmd_GetCids uint8 = 0x30 + iota
@@ -84,6 +96,12 @@ const (
 	Cmd_HandleRosterRequestNotification
 )
 
+const (
+	Cmd_GetPresences uint8 = 0x90 + iota
+	Cmd_SubscribePresences
+	Cmd_PresenceChangedNotification
+)
+
 const (
 	Cmd_FileTransferRequest uint8 = 0xA0 + iota
 	Cmd_HandleDirectFileTransferRequest
@@ -106,14 +124,23 @@ type CmdHandler struct {
 }
 
 type CmdHandlers struct {
-	PacketQueue chan connections.Packet
-	handlers    map[uint8](IHandler)
+	PacketQueue          chan connections.Packet
+	handlers             map[uint8](IHandler)
+	requiredCapabilities map[uint8]uint32
+	middlewares          []Middleware
+	dispatch             HandlerFunc
+	stop                 chan bool
+	stopped              chan bool
+	pool                 *workerPool
 }
 
 func NewCmdHanglers() (cmdHandlers *CmdHandlers) {
 	cmdHandlers = &CmdHandlers{
-		PacketQueue: make(chan connections.Packet, 512),
-		handlers:    make(map[uint8](IHandler)),
+		PacketQueue:          make(chan connections.Packet, 512),
+		handlers:             make(map[uint8](IHandler)),
+		requiredCapabilities: make(map[uint8]uint32),
+		stop:                 make(chan bool),
+		stopped:              make(chan bool),
 	}
 
 	NewMsgHandlers(cmdHandlers)
@@ -130,7 +157,15 @@ func NewCmdHanglers() (cmdHandlers *CmdHandlers) {
 	NewRosterHandlers(cmdHandlers)
 	NewRosterRequestHandlers(cmdHandlers)
 	NewFileTransferHandlers(cmdHandlers)
+	NewPingHandlers(cmdHandlers)
+	NewPresenceHandlers(cmdHandlers)
+	NewSessionHandlers(cmdHandlers)
+	NewChatStateHandlers(cmdHandlers)
+	NewReceiptHandlers(cmdHandlers)
+
+	cmdHandlers.Use(recoverPanic, measureCmd, logCmd, cmdHandlers.authorize)
 
+	cmdHandlers.pool = newWorkerPool(HandlerWorkers, cmdHandlers.dispatch)
 	go cmdHandlers.handleLoop()
 	return
 }
@@ -139,25 +174,47 @@ func (cmdHandlers *CmdHandlers) handleLoop() {
 	for {
 		select {
 		case packet := <-cmdHandlers.PacketQueue:
-			if packet.Conn.AuthInfo.AuthCode == users.AuthCode_None || packet.Cmd == Cmd_Auth {
-				hander, ok := cmdHandlers.handlers[packet.Cmd]
-				if !ok {
-					logs.Logger.Warn("Invalid cmd: ", fmt.Sprintf("0x%02x", packet.Cmd), " user:", packet.Conn.AuthInfo.Account, " addr:", packet.Conn.RemoteAddr())
-				} else {
-					//log.Println("Handle cmd:", packet.Cmd)
-					go hander.packetIn(packet)
-				}
-			} else {
-				if packet.Conn.AuthInfo.AuthCode == users.AuthCode_WaitAuth {
-					logs.Logger.Warn("not accept cmd: ", fmt.Sprintf("0x%02x", packet.Cmd), " before authed", " addr:", packet.Conn.RemoteAddr())
-					go packet.Conn.Close()
+			cmdHandlers.handlePacket(packet)
+		case <-cmdHandlers.stop:
+			for {
+				select {
+				case packet := <-cmdHandlers.PacketQueue:
+					cmdHandlers.handlePacket(packet)
+				default:
+					close(cmdHandlers.stopped)
+					return
 				}
 			}
-
 		}
-
 	}
+}
 
+// handlePacket queues packet for the workers, which run the middleware chain
+// and the handler of packet after the packets received before it on the
+// same connection.
+func (cmdHandlers *CmdHandlers) handlePacket(packet connections.Packet) {
+	cmdHandlers.pool.push(packet)
+}
+
+// Stop handles the packets left in PacketQueue and waits for the running
+// handlers. Packets must no longer be queued when Stop is called.
+func (cmdHandlers *CmdHandlers) Stop(timeout time.Duration) {
+	close(cmdHandlers.stop)
+	<-cmdHandlers.stopped
+	cmdHandlers.pool.stop(timeout)
+}
+
+// QueueStats returns how many packets wait to be handled.
+func (cmdHandlers *CmdHandlers) QueueStats() (stat QueueStat) {
+	stat = cmdHandlers.pool.stat()
+	stat.Received = len(cmdHandlers.PacketQueue)
+	return
+}
+
+// requireCapability refuses cmd on connections which did not negotiate
+// capability during Cmd_Auth.
+func (cmdHandlers *CmdHandlers) requireCapability(cmd uint8, capability uint32) {
+	cmdHandlers.requiredCapabilities[cmd] = capability
 }
 
 func GetRelationUids(uid int64) (uids []int64) {
@@ -167,6 +224,9 @@ func GetRelationUids(uid int64) (uids []int64) {
 	}
 	groupUids := groups.GetSameGroupUids(uid)
 	uids = append(uids, groupUids...)
+	for _, roster := range rosters.GetRostersOfUid(uid) {
+		uids = append(uids, roster.Ruid)
+	}
 	uids = utils.RemoveIntSliceDuplicate(uids)
 	return
 }
@@ -0,0 +1,347 @@
+package cmdhandler
+
+import (
+	"bytes"
+	"github.com/cihub/seelog"
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/connections"
+	"hug/logs"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Reset() {
+	b.lock.Lock()
+	b.buf.Reset()
+	b.lock.Unlock()
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// testLog gets the logs of every level, so tests can check what is logged.
+var testLog lockedBuffer
+
+func init() {
+	logger, err := seelog.LoggerFromWriterWithMinLevel(&testLog, seelog.TraceLvl)
+	if err != nil {
+		panic(err)
+	}
+	logs.UseLogger(logger)
+}
+
+type testHandler struct {
+	CmdHandler
+}
+
+func (h *testHandler) initHandler(cmdHandlers *CmdHandlers) {
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *testHandler) packetIn(pkt connections.Packet) {
+	// A request type authorizeRequest lets pass, Subscribe makes it panic.
+	var reqPkt SubscribePresencesReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	if reqPkt.Subscribe {
+		panic("test panic")
+	}
+	writeResponse(pkt, reqPkt)
+}
+
+// readPacket reads the next packet written to the client end of a pipe.
+func readPacket(t *testing.T, client net.Conn) (pkt connections.Packet) {
+	buf := make([]byte, 0, 256)
+	readBuf := make([]byte, 256)
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, err := client.Read(readBuf)
+		if err != nil {
+			t.Fatal("no packet from server:", err)
+		}
+		buf = append(buf, readBuf[:n]...)
+		if pkt, found := connections.ParseReceivedData(&buf); found {
+			return pkt
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	const testCmd uint8 = 0xF0
+	cmdHandlers := &CmdHandlers{
+		handlers:             make(map[uint8](IHandler)),
+		requiredCapabilities: make(map[uint8]uint32),
+	}
+	for _, cmd := range []uint8{testCmd, testCmd + 1} {
+		h := &testHandler{}
+		h.Cmd = cmd
+		h.initHandler(cmdHandlers)
+	}
+	cmdHandlers.requireCapability(testCmd+1, users.Capability_MsgPack)
+	cmdHandlers.Use(recoverPanic, measureCmd, logCmd, cmdHandlers.authorize)
+	cmdHandlers.pool = newWorkerPool(2, cmdHandlers.dispatch)
+	defer cmdHandlers.pool.stop(time.Second)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := connections.New(server, make(chan connections.Packet, 1))
+	defer conn.Close()
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+
+	tests := []struct {
+		name string
+		cmd  uint8
+		data string
+		code int8
+	}{
+		{"malformed", testCmd, "{", connections.PktErr_BadRequest},
+		{"unknown", testCmd + 2, "{}", connections.PktErr_UnknownCmd},
+		{"not negotiated", testCmd + 1, "{}", connections.PktErr_NotNegotiated},
+		{"panic", testCmd, `{"s":true}`, connections.PktErr_Internal},
+		{"auth again", Cmd_Auth, "{}", connections.PktErr_Forbidden},
+	}
+	for i, test := range tests {
+		sid := uint16(100 + i)
+		cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: test.cmd, PktType: connections.Pkt_Type_Request, Sid: sid, Data: []byte(test.data)})
+		pkt := readPacket(t, client)
+		if pkt.PktType != connections.Pkt_Type_Error || pkt.Code != test.code || pkt.Cmd != test.cmd || pkt.Sid != sid {
+			t.Errorf("%s: got %+v, expect error %d", test.name, pkt, test.code)
+		}
+	}
+
+	cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: testCmd, PktType: connections.Pkt_Type_Request, Sid: 7, Data: []byte("{}")})
+	if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Response || pkt.Sid != 7 {
+		t.Errorf("got %+v, expect a response", pkt)
+	}
+
+	// Before auth the error is written and the connection closed.
+	conn.AuthInfo.AuthCode = users.AuthCode_WaitAuth
+	cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: testCmd, PktType: connections.Pkt_Type_Request, Sid: 8, Data: []byte("{}")})
+	if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Error || pkt.Code != connections.PktErr_NotAuthorized || pkt.Sid != 8 {
+		t.Errorf("got %+v, expect not authorized", pkt)
+	}
+	select {
+	case <-conn.Done():
+	case <-time.After(3 * time.Second):
+		t.Error("connection not closed")
+	}
+}
+
+type countHandler struct {
+	CmdHandler
+	started chan bool
+	release chan bool
+	count   int32
+}
+
+func (h *countHandler) initHandler(cmdHandlers *CmdHandlers) {
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *countHandler) packetIn(pkt connections.Packet) {
+	if atomic.AddInt32(&h.count, 1) == 1 {
+		h.started <- true
+		<-h.release
+	}
+}
+
+// TestAckReplayPage acks a full page of replayed messages at once. Every ack
+// reaches the handler, none is answered and the send rate of Cmd_Msg is left.
+func TestAckReplayPage(t *testing.T) {
+	cmdHandlers := &CmdHandlers{
+		handlers:             make(map[uint8](IHandler)),
+		requiredCapabilities: make(map[uint8]uint32),
+	}
+	h := &countHandler{started: make(chan bool), release: make(chan bool)}
+	h.Cmd = Cmd_Msg
+	h.initHandler(cmdHandlers)
+	cmdHandlers.Use(recoverPanic, measureCmd, logCmd, cmdHandlers.authorize)
+	cmdHandlers.pool = newWorkerPool(2, cmdHandlers.dispatch)
+	defer cmdHandlers.pool.stop(time.Second)
+
+	conn, client := newTestConn(t)
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+	conn.AuthInfo.Capabilities = users.Capability_MsgAck
+
+	// The first ack holds the worker until the others are queued.
+	for sid := uint16(0); sid < messages.MaxGetMsgSize; sid++ {
+		cmdHandlers.handlePacket(connections.Packet{Conn: conn, Cmd: Cmd_Msg, PktType: connections.Pkt_Type_Response, Sid: sid, Data: []byte(`{"mid":1}`)})
+		if sid == 0 {
+			<-h.started
+		}
+	}
+	close(h.release)
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&h.count) < messages.MaxGetMsgSize && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if count := atomic.LoadInt32(&h.count); count != messages.MaxGetMsgSize {
+		t.Errorf("%d acks handled, expect %d", count, messages.MaxGetMsgSize)
+	}
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 64)); err == nil {
+		t.Errorf("%d bytes written in answer to acks", n)
+	}
+	for i := 0; i < int(connections.DefaultCmdRate.Burst); i++ {
+		if !conn.AllowCmd(Cmd_Msg) {
+			t.Fatalf("acks used the send rate of Cmd_Msg, %d messages allowed", i)
+		}
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	const testCmd uint8 = 0xF4
+	cmdHandlers := &CmdHandlers{
+		handlers:             make(map[uint8](IHandler)),
+		requiredCapabilities: make(map[uint8]uint32),
+	}
+	h := &testHandler{}
+	h.Cmd = testCmd
+	h.initHandler(cmdHandlers)
+	var order []string
+	trace := func(name string, drop bool) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(pkt connections.Packet) {
+				order = append(order, name)
+				if !drop {
+					next(pkt)
+				}
+			}
+		}
+	}
+	cmdHandlers.Use(measureCmd, trace("outer", false))
+	cmdHandlers.Use(trace("inner", true))
+
+	count := func() uint64 {
+		for _, stat := range CmdStats() {
+			if stat.Cmd == testCmd {
+				return stat.Count
+			}
+		}
+		return 0
+	}
+	before := count()
+	// The inner middleware drops the packet, nothing is written to conn.
+	cmdHandlers.dispatch(connections.Packet{Cmd: testCmd, Data: []byte("{}")})
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Errorf("got middleware order %v", order)
+	}
+	if count() != before+1 {
+		t.Error("cmd not counted in stats")
+	}
+}
+
+func TestReceiptNotificationNeedsCapability(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := connections.New(server, make(chan connections.Packet, 1))
+	defer conn.Close()
+
+	if isSubscribed(conn, Cmd_ReceiptNotification) {
+		t.Error("receipt notified without Capability_Receipts")
+	}
+	conn.AuthInfo.Capabilities = users.Capability_Receipts
+	if !isSubscribed(conn, Cmd_ReceiptNotification) {
+		t.Error("receipt not notified with Capability_Receipts")
+	}
+}
+
+// TestAuthDataNotLogged logs at every level while Cmd_Auth requests and
+// responses carrying credentials go through the connection, the middleware
+// chain, decodeRequest and AuthHandler.
+func TestAuthDataNotLogged(t *testing.T) {
+	// Not valid base64, so the auth fails before the database.
+	const secret = "c2VjcmV0LXNlY3JldA"
+	testLog.Reset()
+
+	cmdHandlers := &CmdHandlers{
+		handlers:             make(map[uint8](IHandler)),
+		requiredCapabilities: make(map[uint8]uint32),
+	}
+	h := &AuthHandler{}
+	h.initHandler(cmdHandlers)
+	cmdHandlers.Use(recoverPanic, measureCmd, logCmd, cmdHandlers.authorize)
+
+	packets := make(chan connections.Packet, 1)
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := connections.New(server, packets)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	data, err := connections.PrepareSendPacket(Cmd_Auth, connections.Pkt_Type_Request, 0, 1, []byte(`{"u":"YWxpY2U=","p":"`+secret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(data)
+	select {
+	case pkt := <-packets:
+		cmdHandlers.dispatch(pkt)
+	case <-time.After(3 * time.Second):
+		t.Fatal("auth packet not received")
+	}
+	decodeRequest(connections.Packet{Conn: conn, Cmd: Cmd_Auth, PktType: connections.Pkt_Type_Request, Sid: 2, Data: []byte(`{"p":"` + secret)}, &AuthReqPacket{})
+	conn.WriteObject(Cmd_Auth, connections.Pkt_Type_Response, 0, 3, AuthResPacket{Token: secret})
+	logs.Logger.Flush()
+
+	logged := testLog.String()
+	if !strings.Contains(logged, "<redacted>") {
+		t.Fatalf("auth packets not logged:\n%s", logged)
+	}
+	if strings.Contains(logged, secret) {
+		t.Errorf("credentials logged:\n%s", logged)
+	}
+}
+
+func TestHandleFileTransferPeersOffline(t *testing.T) {
+	conn, client := newTestConn(t)
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+	conn.AuthInfo.Uid = 1
+	h := &HandleFileTransferRequestHandler{}
+	h.Cmd = Cmd_HandleDirectFileTransferRequest
+	go h.packetIn(connections.Packet{Conn: conn, Cmd: h.Cmd, PktType: connections.Pkt_Type_Request, Sid: 7, Data: []byte(`{"fr":2,"to":1}`)})
+
+	pkt := readPacket(t, client)
+	if pkt.PktType != connections.Pkt_Type_Response || pkt.Sid != 7 || string(pkt.Data) != `{"c":1}` {
+		t.Fatalf("got %+v data %s, expect offline", pkt, pkt.Data)
+	}
+}
+
+// TestChatStateToStranger sends a chat state to a user without relation to
+// the sender, which the empty databases of the tests give.
+func TestChatStateToStranger(t *testing.T) {
+	testLog.Reset()
+	conn, _ := newTestConn(t)
+	conn.AuthInfo.AuthCode = users.AuthCode_None
+	conn.AuthInfo.Uid = 1
+	h := &ChatStateHandler{}
+	h.Cmd = Cmd_ChatState
+	h.packetIn(connections.Packet{Conn: conn, Cmd: h.Cmd, PktType: connections.Pkt_Type_Request, Sid: 7, Data: []byte(`{"to":{"id":2,"t":1},"s":1}`)})
+	logs.Logger.Flush()
+
+	if logged := testLog.String(); !strings.Contains(logged, "not a relation") {
+		t.Errorf("chat state to a stranger relayed:\n%s", logged)
+	}
+}
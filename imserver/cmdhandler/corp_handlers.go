@@ -1,11 +1,9 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/corps"
 	"hug/imserver/connections"
 	"hug/logs"
-	"math/rand"
 )
 
 type CreateCorpHandler struct {
@@ -19,6 +17,9 @@ func (h *CreateCorpHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *CreateCorpHandler) packetIn(pkt connections.Packet) {
 	var reqPkt corps.CreateCorpReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.CreateCorpResPkt
 	resPkt.Code = corps.CreateCorpCode_InvalidReq
 	resPkt.Cid = 0
@@ -26,7 +27,7 @@ func (h *CreateCorpHandler) packetIn(pkt connections.Packet) {
 		if resPkt.Code != corps.CreateCorpCode_None {
 			logs.Logger.Warn("create failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -36,11 +37,6 @@ func (h *CreateCorpHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Cid, resPkt.Code = corps.CreateCorp(reqPkt)
 	if resPkt.Code == corps.CreateCorpCode_None {
 		var worker corps.CreateWorkerReqPkt
@@ -77,9 +73,13 @@ func (h *GetCorpHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetCorpHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetCorpReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.Corp
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -89,13 +89,7 @@ func (h *GetCorpHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetCorpReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
-	resPkt, err = corps.GetCorp(reqPkt.Cid)
+	resPkt, _ = corps.GetCorp(reqPkt.Cid)
 	return
 }
 
@@ -109,6 +103,10 @@ func (h *SetCorpHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetCorpHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.Corp
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -117,12 +115,6 @@ func (h *SetCorpHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.Corp
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	corps.SetCorp(reqPkt)
 	return
 }
@@ -137,10 +129,14 @@ func (h *RemoveCorpHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *RemoveCorpHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.RemoveCorpReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.RemoveCorpResPkt
 	resPkt.Code = corps.RemoveCorpCode_InvalidReq
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -150,12 +146,6 @@ func (h *RemoveCorpHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.RemoveCorpReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = corps.RemoveCorp(reqPkt)
 	return
 }
@@ -172,7 +162,7 @@ func (h *RemoveCorpHandler) packetIn(pkt connections.Packet) {
 // func (h *GetCorpsOfUserHandler) packetIn(pkt connections.Packet) {
 // 	var resPkt corps.GetCorpsOfUserResPkt
 // 	defer func() {
-// 		resData, err := json.Marshal(resPkt)
+// 		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 // 		if err != nil {
 // 			log.Fatal("GetCorpsOfUserHandler json marshal respacket error:", err)
 // 		}
@@ -183,7 +173,7 @@ func (h *RemoveCorpHandler) packetIn(pkt connections.Packet) {
 // 		}
 // 	}()
 // 	var reqPkt corps.GetCorpsOfUserReqPkt
-// 	err := json.Unmarshal(pkt.Data, &reqPkt)
+// 	err := pkt.Conn.Codec().Unmarshal(pkt.Data, &reqPkt)
 // 	if err != nil {
 // 		log.Println("GetCorpsOfUserHandler error: json unmarshal error:", err)
 // 		return
@@ -205,10 +195,14 @@ func (h *GetCorpTreesHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetCorpTreesHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetCorpTreesReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	//log.Println("Start GetCorpTreesHandler...")
 	var resPkt corps.GetCorpTreesResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -218,13 +212,8 @@ func (h *GetCorpTreesHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetCorpTreesReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	//log.Println("Before corps.GetCorpTreesOfCids(...")
+	var err error
 	resPkt.Workers, resPkt.Depts, err = corps.GetCorpTreesOfCids(reqPkt.Cids)
 	if err != nil {
 		logs.Logger.Critical(err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
@@ -243,9 +232,13 @@ func (h *GetCidsHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetCidsHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetCidsReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.GetCidsResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -255,12 +248,7 @@ func (h *GetCidsHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetCidsReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
+	var err error
 	resPkt.Cids, err = corps.GetCidsOfUid(reqPkt.Uid)
 	if err != nil {
 		logs.Logger.Critical(err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
@@ -278,9 +266,13 @@ func (h *GetCorpChangedHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetCorpChangedHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetCorpChangedReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.GetCorpChangedResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -290,12 +282,6 @@ func (h *GetCorpChangedHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetCorpChangedReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Stamp = 0
 	resPkt.Notifications = make([]corps.CorpChangedNotification, 0, 5)
 	for _, cid := range reqPkt.Cids {
@@ -312,25 +298,12 @@ func SendCorpChangedNotificationLoop() {
 	var reqPkt corps.CorpChangedNotification
 	for {
 		reqPkt = <-corps.CorpChangedNotificationChan
-		wtBytes, err := json.Marshal(reqPkt)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 		uids, err := corps.GetUidsOfCorp(reqPkt.Cid)
 		if err != nil {
 			logs.Logger.Critical(err)
 		}
 		for _, uid := range uids {
-			presence := connections.FindPresences(uid)
-			if presence != nil {
-				for _, conn := range presence.Terminals {
-					err = conn.WritePacket(Cmd_CorpChangedNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-					if err != nil {
-						logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-						return
-					}
-				}
-			}
+			notifyUser(uid, Cmd_CorpChangedNotification, 0, reqPkt)
 		}
 	}
 }
@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/corps"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -17,11 +16,15 @@ func (h *CreateDeptHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *CreateDeptHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.CreateDeptReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.CreateDeptResPkt
 	resPkt.Code = corps.CreateDeptCode_InvalidReq
 	resPkt.Did = 0
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -31,12 +34,6 @@ func (h *CreateDeptHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.CreateDeptReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Did, resPkt.Code = corps.CreateDept(reqPkt)
 	return
 }
@@ -51,10 +48,14 @@ func (h *RemoveDeptHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *RemoveDeptHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.RemoveDeptReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.RemoveDeptResPkt
 	resPkt.Code = corps.RemoveDeptCode_InvalidReq
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -64,12 +65,6 @@ func (h *RemoveDeptHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.RemoveDeptReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = corps.RemoveDept(reqPkt)
 	return
 }
@@ -84,9 +79,13 @@ func (h *GetDeptHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetDeptHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetDeptReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.Dept
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -96,13 +95,7 @@ func (h *GetDeptHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetDeptReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
-		return
-	}
-	resPkt, err = corps.GetDept(reqPkt.Did)
+	resPkt, _ = corps.GetDept(reqPkt.Did)
 	return
 }
 
@@ -116,6 +109,10 @@ func (h *SetDeptHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetDeptHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.Dept
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -124,12 +121,6 @@ func (h *SetDeptHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.Dept
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	corps.SetDept(reqPkt)
 	return
 }
@@ -2,7 +2,6 @@ package cmdhandler
 
 import (
 	"crypto/md5"
-	"encoding/json"
 	"fmt"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -61,10 +60,14 @@ func (h *FileTransferRequestHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *FileTransferRequestHandler) packetIn(pkt connections.Packet) {
+	var reqPkt FileTransferRequestPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt FileTransferResPkt
 	resPkt.Code = FileTransferCode_None
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -74,25 +77,18 @@ func (h *FileTransferRequestHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt FileTransferRequestPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 
 	m := md5.New()
 	io.WriteString(m, reqPkt.Fid)
 	io.WriteString(m, reqPkt.Path)
 	reqPkt.SessionId = fmt.Sprintf("%x", m.Sum(nil))
 	reqPkt.FromTerminal = pkt.Conn.AuthInfo.TerminalType
-	reqData, err := json.Marshal(reqPkt)
 	toPresence := connections.FindPresences(reqPkt.To)
 	online := toPresence != nil
 	if online {
-		for _, conn := range toPresence.Terminals {
+		for _, conn := range toPresence.Sessions {
 			online = true
-			conn.WritePacket(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqData)
+			conn.WriteObject(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqPkt)
 
 		}
 	}
@@ -123,10 +119,14 @@ func (h *HandleFileTransferRequestHandler) initHandler(cmdHandlers *CmdHandlers)
 }
 
 func (h *HandleFileTransferRequestHandler) packetIn(pkt connections.Packet) {
+	var reqPkt HandleFileTransferRequestPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt FileTransferResPkt
 	resPkt.Code = FileTransferCode_None
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -136,20 +136,15 @@ func (h *HandleFileTransferRequestHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt HandleFileTransferRequestPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	reqPkt.ToTerminal = pkt.Conn.AuthInfo.TerminalType
-	reqData, err := json.Marshal(reqPkt)
 	toPresence := connections.FindPresences(reqPkt.From)
-	online := toPresence != nil
-	for terminalType, conn := range toPresence.Terminals {
-		if terminalType == reqPkt.FromTerminal {
-			online = true
-			conn.WritePacket(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqData)
+	online := false
+	if toPresence != nil {
+		for _, conn := range toPresence.Sessions {
+			if conn.AuthInfo.TerminalType == reqPkt.FromTerminal {
+				online = true
+				conn.WriteObject(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqPkt)
+			}
 		}
 	}
 	if !online {
@@ -158,9 +153,11 @@ func (h *HandleFileTransferRequestHandler) packetIn(pkt connections.Packet) {
 	}
 	//给自己的其他在线客户端发送处理消息
 	fromPresence := connections.FindPresences(reqPkt.To)
-	for terminalType, conn := range fromPresence.Terminals {
-		if terminalType != reqPkt.ToTerminal {
-			conn.WritePacket(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqData)
+	if fromPresence != nil {
+		for _, conn := range fromPresence.Sessions {
+			if conn.AuthInfo.TerminalType != reqPkt.ToTerminal {
+				conn.WriteObject(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqPkt)
+			}
 		}
 	}
 	return
@@ -185,14 +182,18 @@ type FileTransferStartLanNATHandler struct {
 
 func (h *FileTransferStartLanNATHandler) initHandler(cmdHandlers *CmdHandlers) {
 	h.Cmd = Cmd_FileTransferStartLanNat
-	cmdHandlers.handlers[Cmd_FileTransferStartLanNat] = h
+	cmdHandlers.handlers[h.Cmd] = h
 }
 
 func (h *FileTransferStartLanNATHandler) packetIn(pkt connections.Packet) {
+	var reqPkt FileTransferStartLanNATReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt FileTransferStartLanNATResPkt
 	resPkt.Code = FileTransferCode_None
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -202,20 +203,16 @@ func (h *FileTransferStartLanNATHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt FileTransferStartLanNATReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.SessionId = reqPkt.SessionId
 
 	toPresence := connections.FindPresences(reqPkt.To)
-	online := toPresence != nil
-	for terminalType, conn := range toPresence.Terminals {
-		if terminalType == reqPkt.ToTerminal {
-			online = true
-			conn.WritePacket(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), pkt.Data)
+	online := false
+	if toPresence != nil {
+		for _, conn := range toPresence.Sessions {
+			if conn.AuthInfo.TerminalType == reqPkt.ToTerminal {
+				online = true
+				conn.WriteObject(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqPkt)
+			}
 		}
 	}
 	if !online {
@@ -243,14 +240,18 @@ type FileTransferLocalNATFailedHandler struct {
 
 func (h *FileTransferLocalNATFailedHandler) initHandler(cmdHandlers *CmdHandlers) {
 	h.Cmd = Cmd_FileTransferLocalNATFailed
-	cmdHandlers.handlers[Cmd_FileTransferStartLanNat] = h
+	cmdHandlers.handlers[h.Cmd] = h
 }
 
 func (h *FileTransferLocalNATFailedHandler) packetIn(pkt connections.Packet) {
+	var reqPkt FileTransferLocalNatFailedReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt FileTransferLocalNatFailedResPkt
 	resPkt.Code = FileTransferCode_None
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -260,20 +261,16 @@ func (h *FileTransferLocalNATFailedHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt FileTransferLocalNatFailedReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.SessionId = reqPkt.SessionId
 
 	toPresence := connections.FindPresences(reqPkt.To)
-	online := toPresence != nil
-	for terminalType, conn := range toPresence.Terminals {
-		if terminalType == reqPkt.ToTerminal {
-			online = true
-			conn.WritePacket(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), pkt.Data)
+	online := false
+	if toPresence != nil {
+		for _, conn := range toPresence.Sessions {
+			if conn.AuthInfo.TerminalType == reqPkt.ToTerminal {
+				online = true
+				conn.WriteObject(Cmd_FileTransferRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), reqPkt)
+			}
 		}
 	}
 	if !online {
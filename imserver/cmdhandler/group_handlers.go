@@ -1,12 +1,10 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/groups"
 	"hug/core/users"
 	"hug/imserver/connections"
 	"hug/logs"
-	"math/rand"
 )
 
 type CreateGroupHandler struct {
@@ -20,6 +18,9 @@ func (h *CreateGroupHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *CreateGroupHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.CreateGroupReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.CreateGroupResPkt
 	resPkt.Code = groups.CreateGroupCode_InvalidReq
 	resPkt.Gid = 0
@@ -27,7 +28,7 @@ func (h *CreateGroupHandler) packetIn(pkt connections.Packet) {
 		if resPkt.Code != groups.CreateGroupCode_None {
 			logs.Logger.Info("create failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -37,11 +38,6 @@ func (h *CreateGroupHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt = groups.CreateGroup(reqPkt)
 	return
 }
@@ -57,13 +53,16 @@ func (h *RemoveGroupHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *RemoveGroupHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.RemoveGroupReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.RemoveGroupResPkt
 	resPkt.Code = groups.RemoveGroupCode_InvalidReq
 	defer func() {
 		if resPkt.Code != groups.RemoveGroupCode_None {
 			logs.Logger.Info("create failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -73,11 +72,6 @@ func (h *RemoveGroupHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = groups.RemoveGroup(reqPkt)
 	resPkt.Gid = reqPkt.Gid
 	return
@@ -96,7 +90,7 @@ func (h *RemoveGroupHandler) packetIn(pkt connections.Packet) {
 // 	var reqPkt groups.GetGroupsOfUserReqPkt
 // 	var resPkt groups.GetGroupsOfUserResPkt
 // 	defer func() {
-// 		resData, err := json.Marshal(resPkt)
+// 		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 // 		if err != nil {
 // 			log.Fatal("GetGroupsOfUserHandler json marshal respacket error:", err)
 // 		}
@@ -106,7 +100,7 @@ func (h *RemoveGroupHandler) packetIn(pkt connections.Packet) {
 // 			return
 // 		}
 // 	}()
-// 	err := json.Unmarshal(pkt.Data, &reqPkt)
+// 	err := pkt.Conn.Codec().Unmarshal(pkt.Data, &reqPkt)
 // 	if err != nil {
 // 		log.Println("GetGroupsOfUserHandler error: json unmarshal error:", err)
 // 		return
@@ -126,9 +120,12 @@ func (h *GetGidsHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetGidsHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.GetGidsReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GetGidsResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -138,11 +135,6 @@ func (h *GetGidsHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Gids = groups.GetGidsOfUid(reqPkt.Uid)
 	return
 }
@@ -158,9 +150,12 @@ func (h *GetGroupsHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetGroupsHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.GetGroupsReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GetGroupsResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -170,11 +165,6 @@ func (h *GetGroupsHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Groups = groups.GetGroups(reqPkt.Gids)
 	return
 }
@@ -189,12 +179,16 @@ func (h *SetGroupHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetGroupHandler) packetIn(pkt connections.Packet) {
+	var reqPkt groups.Group
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.SetGroupResPkt
 	defer func() {
 		if resPkt.Code != groups.SetGroupCode_None {
 			logs.Logger.Info("set group failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -204,13 +198,6 @@ func (h *SetGroupHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt groups.Group
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		resPkt.Code = groups.SetGroupCode_InvalidFormat
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	groups.SetGroup(reqPkt)
 	return
 }
@@ -225,9 +212,13 @@ func (h *GetGroupChangedHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetGroupChangedHandler) packetIn(pkt connections.Packet) {
+	var reqPkt groups.GetGroupChangedReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GetGroupChangedResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -237,12 +228,6 @@ func (h *GetGroupChangedHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt groups.GetGroupChangedReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Notifications = make([]groups.GroupChangedNotification, 0, 10)
 	resPkt.Stamp = 0
 	for _, gid := range reqPkt.Gids {
@@ -260,25 +245,12 @@ func SendGroupChangedNotificationLoop() {
 	for {
 		reqPkt = <-groups.GroupChangedNotificationChan
 		logs.Logger.Info("push group change notification: gid = ", reqPkt.Gid, " uid = ", reqPkt.Uid, " type = ", reqPkt.Type)
-		wtBytes, err := json.Marshal(reqPkt)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 		uids := groups.GetGroupUids(reqPkt.Gid)
 		if reqPkt.Type == groups.GroupChangedType_Removed && users.IsUidValid(reqPkt.Uid) {
 			uids = append(uids, reqPkt.Uid)
 		}
 		for _, uid := range uids {
-			presence := connections.FindPresences(uid)
-			if presence != nil {
-				for _, conn := range presence.Terminals {
-					err = conn.WritePacket(Cmd_GroupChangedNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-					if err != nil {
-						logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-						return
-					}
-				}
-			}
+			notifyUser(uid, Cmd_GroupChangedNotification, 0, reqPkt)
 		}
 		if reqPkt.Type == groups.GroupChangedType_Removed && reqPkt.Uid == 0 {
 			groups.DeleteAllMemberOfGroup(reqPkt.Gid)
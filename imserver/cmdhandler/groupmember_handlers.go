@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/groups"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -18,13 +17,16 @@ func (h *AddGroupMembersHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *AddGroupMembersHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.GroupMembersChangeReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GroupMembersChangeResPkt
 	resPkt.Code = groups.GroupMemberChangeCode_InvalidReq
 	defer func() {
 		if resPkt.Code != groups.GroupMemberChangeCode_None {
 			logs.Logger.Warn("create failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -34,11 +36,6 @@ func (h *AddGroupMembersHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = groups.AddGroupMembers(reqPkt)
 	return
 }
@@ -54,13 +51,16 @@ func (h *RemoveGroupMembersHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *RemoveGroupMembersHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.GroupMembersChangeReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GroupMembersChangeResPkt
 	resPkt.Code = groups.GroupMemberChangeCode_InvalidReq
 	defer func() {
 		if resPkt.Code != groups.GroupMemberChangeCode_None {
 			logs.Logger.Warn("create failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -70,11 +70,6 @@ func (h *RemoveGroupMembersHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = groups.RemoveGroupMembers(reqPkt)
 	return
 }
@@ -90,9 +85,12 @@ func (h *GetGroupsMembersHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetGroupsMembersHandler) packetIn(pkt connections.Packet) {
 	var reqPkt groups.GetGroupsMembersReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt groups.GetGroupsMembersResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -102,11 +100,6 @@ func (h *GetGroupsMembersHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Members = groups.GetGroupsMembers(reqPkt.Gids)
 	return
 }
@@ -121,6 +114,10 @@ func (h *SetGroupMemberHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetGroupMemberHandler) packetIn(pkt connections.Packet) {
+	var reqPkt groups.GroupMember
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -129,12 +126,6 @@ func (h *SetGroupMemberHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt groups.GroupMember
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	groups.SetGroupMember(reqPkt)
 	return
 }
@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/devices"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -33,6 +32,9 @@ func (h *SetIosDeviceStatusHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *SetIosDeviceStatusHandler) packetIn(pkt connections.Packet) {
 	var reqPkt devices.IosDeviceStatusPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -41,11 +43,6 @@ func (h *SetIosDeviceStatusHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	if pkt.Conn.AuthInfo.IosDevice.IsValid() {
 		devices.SetIosDeviceStatus(pkt.Conn.AuthInfo.IosDevice.Token, reqPkt.Status)
 	}
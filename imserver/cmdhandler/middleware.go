@@ -0,0 +1,228 @@
+package cmdhandler
+
+import (
+	"fmt"
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/connections"
+	"hug/logs"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// HandlerFunc handles one packet.
+type HandlerFunc func(pkt connections.Packet)
+
+// Middleware wraps the handling of every packet. It goes on with the packet
+// by calling next, or drops it by returning without calling next.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// SlowCmdDuration is how long a handler may run before it is logged as slow.
+var SlowCmdDuration = time.Second
+
+func init() {
+	// Cmd_Auth carries passwords and session tokens.
+	connections.RedactedCmds[Cmd_Auth] = true
+}
+
+// CmdStat counts the packets handled for one cmd.
+type CmdStat struct {
+	Cmd    uint8
+	Count  uint64
+	Panics uint64
+	// Total time spent in the handlers.
+	Time time.Duration
+	Max  time.Duration
+}
+
+type cmdStat struct {
+	count  uint64
+	panics uint64
+	nanos  int64
+	max    int64
+}
+
+var cmdStats [256]cmdStat
+
+// CmdStats returns the stats of the cmds handled since the server started.
+func CmdStats() (stats []CmdStat) {
+	for i := range cmdStats {
+		s := &cmdStats[i]
+		count := atomic.LoadUint64(&s.count)
+		if count == 0 {
+			continue
+		}
+		stats = append(stats, CmdStat{
+			Cmd:    uint8(i),
+			Count:  count,
+			Panics: atomic.LoadUint64(&s.panics),
+			Time:   time.Duration(atomic.LoadInt64(&s.nanos)),
+			Max:    time.Duration(atomic.LoadInt64(&s.max)),
+		})
+	}
+	return
+}
+
+// Use appends middlewares to the chain every packet goes through before its
+// handler, the first one being the outermost. It must be called before the
+// server accepts connections.
+func (cmdHandlers *CmdHandlers) Use(middlewares ...Middleware) {
+	cmdHandlers.middlewares = append(cmdHandlers.middlewares, middlewares...)
+	dispatch := HandlerFunc(cmdHandlers.route)
+	for i := len(cmdHandlers.middlewares) - 1; i >= 0; i-- {
+		dispatch = cmdHandlers.middlewares[i](dispatch)
+	}
+	cmdHandlers.dispatch = dispatch
+}
+
+func (cmdHandlers *CmdHandlers) route(pkt connections.Packet) {
+	if hander, ok := cmdHandlers.handlers[pkt.Cmd]; ok {
+		hander.packetIn(pkt)
+	}
+}
+
+// recoverPanic answers the request of a panicking handler with a
+// PktErr_Internal error, so one bad request does not stop the server.
+func recoverPanic(next HandlerFunc) HandlerFunc {
+	return func(pkt connections.Packet) {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.AddUint64(&cmdStats[pkt.Cmd].panics, 1)
+				logs.Logger.Critical("handle cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " panic: ", r, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "\n", string(debug.Stack()))
+				if pkt.PktType == connections.Pkt_Type_Request {
+					pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_Internal)
+				}
+			}
+		}()
+		next(pkt)
+	}
+}
+
+// measureCmd records the time spent handling each cmd in CmdStats.
+func measureCmd(next HandlerFunc) HandlerFunc {
+	return func(pkt connections.Packet) {
+		start := time.Now()
+		defer func() {
+			elapsed := time.Since(start)
+			s := &cmdStats[pkt.Cmd]
+			atomic.AddUint64(&s.count, 1)
+			atomic.AddInt64(&s.nanos, int64(elapsed))
+			for {
+				max := atomic.LoadInt64(&s.max)
+				if int64(elapsed) <= max || atomic.CompareAndSwapInt64(&s.max, max, int64(elapsed)) {
+					break
+				}
+			}
+			if elapsed > SlowCmdDuration {
+				logs.Logger.Warn("slow cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " took ", elapsed, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			}
+		}()
+		next(pkt)
+	}
+}
+
+// logCmd logs every packet received at debug level. Data of
+// connections.RedactedCmds is left out and long data is cut.
+func logCmd(next HandlerFunc) HandlerFunc {
+	return func(pkt connections.Packet) {
+		logs.Logger.Debug("cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " type: ", pkt.PktType, " sid: ", pkt.Sid, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " data: ", connections.LoggedData(pkt.Cmd, pkt.Data))
+		next(pkt)
+	}
+}
+
+// authorize refuses unknown cmds, cmds sent before Cmd_Auth succeeded,
+// Cmd_Auth sent after it succeeded, cmds of capabilities not negotiated and
+// cmds over their rate. Responses answer
+// packets the server wrote, such as the acks of Cmd_Msg, so they are not rate
+// limited and are dropped without an error packet when refused.
+func (cmdHandlers *CmdHandlers) authorize(next HandlerFunc) HandlerFunc {
+	return func(pkt connections.Packet) {
+		if pkt.PktType != connections.Pkt_Type_Request {
+			_, ok := cmdHandlers.handlers[pkt.Cmd]
+			if ok && pkt.Conn.AuthInfo.AuthCode == users.AuthCode_None && pkt.Conn.AuthInfo.HasCapability(cmdHandlers.requiredCapabilities[pkt.Cmd]) {
+				next(pkt)
+			}
+			return
+		}
+		if pkt.Conn.AuthInfo.AuthCode != users.AuthCode_None && pkt.Cmd != Cmd_Auth {
+			if pkt.Conn.AuthInfo.AuthCode == users.AuthCode_WaitAuth {
+				logs.Logger.Warn("not accept cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " before authed", " addr:", pkt.Conn.RemoteAddr())
+				err := pkt.Conn.WritePacketNotify(pkt.Cmd, connections.Pkt_Type_Error, connections.PktErr_NotAuthorized, pkt.Sid, nil, pkt.Conn.Close)
+				if err != nil {
+					go pkt.Conn.Close()
+				}
+			} else {
+				pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_NotAuthorized)
+			}
+			return
+		}
+		if pkt.Cmd == Cmd_Auth && pkt.Conn.AuthInfo.AuthCode == users.AuthCode_None {
+			// Signing in again would replace AuthInfo under the session
+			// already registered for the connection.
+			logs.Logger.Warn("auth again refused", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_Forbidden)
+			return
+		}
+		if _, ok := cmdHandlers.handlers[pkt.Cmd]; !ok {
+			logs.Logger.Warn("Invalid cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_UnknownCmd)
+			return
+		}
+		if !pkt.Conn.AuthInfo.HasCapability(cmdHandlers.requiredCapabilities[pkt.Cmd]) {
+			logs.Logger.Warn("cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " not negotiated", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_NotNegotiated)
+			return
+		}
+		if !pkt.Conn.AllowCmd(pkt.Cmd) {
+			logs.Logger.Warn("cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " rate limited", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_RateLimited)
+			return
+		}
+		next(pkt)
+	}
+}
+
+// decodeRequest unmarshals the data of pkt into reqPkt and authorizes it. A
+// malformed or oversized request is answered with a PktErr_BadRequest error,
+// a refused one with PktErr_Forbidden, and false is returned; the handler
+// then writes no response.
+func decodeRequest(pkt connections.Packet, reqPkt interface{}) bool {
+	err := pkt.Conn.Codec().Unmarshal(pkt.Data, reqPkt)
+	if err != nil {
+		logs.Logger.Warn("unmarshal request error:", err, " cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", connections.LoggedData(pkt.Cmd, pkt.Data))
+		pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_BadRequest)
+		return false
+	}
+	if !requestInBounds(reqPkt) {
+		logs.Logger.Warn("cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " too large", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_BadRequest)
+		return false
+	}
+	if !authorizeRequest(pkt.Conn.AuthInfo.Uid, pkt.Cmd, reqPkt) {
+		logs.Logger.Warn("cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " forbidden", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", connections.LoggedData(pkt.Cmd, pkt.Data))
+		pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_Forbidden)
+		return false
+	}
+	return true
+}
+
+// requestInBounds reports whether the lists of reqPkt are short enough to be
+// checked and served in one go.
+func requestInBounds(reqPkt interface{}) bool {
+	switch r := reqPkt.(type) {
+	case *messages.ReceiptReqPkt:
+		return len(r.Mids) <= messages.MaxGetMsgSize
+	case *messages.GetReceiptsReqPkt:
+		return len(r.Mids) <= messages.MaxGetMsgSize
+	}
+	return true
+}
+
+// writeResponse writes resPkt as the response to pkt.
+func writeResponse(pkt connections.Packet, resPkt interface{}) {
+	err := pkt.Conn.WriteObject(pkt.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resPkt)
+	if err != nil {
+		logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+	}
+}
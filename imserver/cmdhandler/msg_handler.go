@@ -1,10 +1,11 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/devices"
 	"hug/core/groups"
 	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/cluster"
 	"hug/imserver/connections"
 	"hug/logs"
 	"hug/utils/apns"
@@ -23,18 +24,20 @@ func (h *MsgHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *MsgHandler) packetIn(pkt connections.Packet) {
 	//log.Println("Message:  parse received msg from :", pkt.Conn.AuthInfo.Account, "msg =", string(pkt.Data))
+	if pkt.PktType == connections.Pkt_Type_Response {
+		h.ackIn(pkt)
+		return
+	}
 
 	var reqPkt messages.Message
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
+	if !decodeRequest(pkt, &reqPkt) {
 		return
 	}
 	var resPkt messages.MessageResPacket
 	resPkt.OriginalId = reqPkt.Id
 	resPkt.Mid = 0
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -69,12 +72,8 @@ func (h *MsgHandler) packetIn(pkt connections.Packet) {
 				logs.Logger.Warn("to id <= 0", " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 				continue
 			}
-			sended := h.SendMessage(to.Id, sendPkt)
-			if sended {
-				messages.CreateHistory(resPkt.Mid, to.Id, sendPkt.Author, messages.HistoryStatus_Sended, messages.MessageDir_In)
-			} else {
-				messages.CreateHistory(resPkt.Mid, to.Id, sendPkt.Author, messages.HistoryStatus_WaitToSend, messages.MessageDir_In)
-			}
+			messages.CreateHistory(resPkt.Mid, to.Id, sendPkt.Author, messages.HistoryStatus_WaitToSend, messages.MessageDir_In)
+			h.SendMessage(to.Id, sendPkt)
 		} else if to.Type == messages.MCT_Group {
 			members, err := groups.GetGroupMembers(to.Id)
 			if err == nil {
@@ -84,12 +83,8 @@ func (h *MsgHandler) packetIn(pkt connections.Packet) {
 						sendPkt.To.Type = messages.MCT_User
 						sendPkt.From = to
 
-						sended := h.SendMessage(m.Uid, sendPkt)
-						if sended {
-							messages.CreateHistory(resPkt.Mid, m.Uid, to, messages.HistoryStatus_Sended, messages.MessageDir_In)
-						} else {
-							messages.CreateHistory(resPkt.Mid, m.Uid, to, messages.HistoryStatus_WaitToSend, messages.MessageDir_In)
-						}
+						messages.CreateHistory(resPkt.Mid, m.Uid, to, messages.HistoryStatus_WaitToSend, messages.MessageDir_In)
+						h.SendMessage(m.Uid, sendPkt)
 					}
 				}
 			}
@@ -99,55 +94,114 @@ func (h *MsgHandler) packetIn(pkt connections.Packet) {
 	return
 }
 
+// SendMessage queues pkt for every online terminal of uid, on this node or
+// another one. The inbound history of uid stays HistoryStatus_WaitToSend
+// until one terminal has actually been written to, so messages dropped on
+// the way are redelivered.
 func (h *MsgHandler) SendMessage(uid int64, pkt messages.Message) (sended bool) {
-	sended = false
-	wtBytes, err := json.Marshal(pkt)
-	if err != nil {
-		logs.Logger.Critical("send packet json marshal error =", err, "from:", uid)
-		return
+	sended = writeMessageLocal(uid, pkt)
+	if forward(cluster.ForwardKind_Message, uid, Cmd_Msg, 0, pkt) {
+		sended = true
 	}
+	if messages.IsMsgPush(uid, pkt.From) && !users.IsDoNotDisturb(uid) {
+		//logs.Logger.Infof("Push message to %d", uid)
+		PushIosNotification(uid, pkt)
+		PushAndroidNotification(uid, pkt)
+	}
+	return
+
+}
 
+func writeMessageLocal(uid int64, pkt messages.Message) (sended bool) {
 	presence := connections.FindPresences(uid)
 	if presence != nil {
-		for _, conn := range presence.Terminals {
-			err = conn.WritePacket(Cmd_Msg, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-			sended = true
+		for _, conn := range presence.Sessions {
+			err := writeMessage(conn, uid, pkt, nil)
 			if err != nil {
-				logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-				return
+				logs.Logger.Warn("Conn write message packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
+				continue
 			}
+			sended = true
 		}
 	}
-	if messages.IsMsgPush(uid, pkt.From) {
-		//logs.Logger.Infof("Push message to %d", uid)
-		PushIosNotification(uid, pkt)
-		PushAndroidNotification(uid, pkt)
-	}
 	return
-
 }
 
-func (m *MsgHandler) SyncSendedMessage(sendConn *connections.ClientConnection, pkt messages.Message) {
-	wtBytes, err := json.Marshal(pkt)
+// writeMessage writes the inbound message pkt of uid to conn and calls
+// written, if not nil, once it has been written. The message is marked
+// HistoryStatus_Sended when conn acknowledges it if conn negotiated
+// Capability_MsgAck, or else as soon as it is written.
+func writeMessage(conn *connections.ClientConnection, uid int64, pkt messages.Message, written func()) (err error) {
+	wtBytes, err := conn.Codec().Marshal(pkt)
 	if err != nil {
-		logs.Logger.Critical("send packet json marshal error: ", err)
+		logs.Logger.Critical("send packet marshal error =", err, "from:", uid)
 		return
 	}
+	acked := conn.AuthInfo.HasCapability(users.Capability_MsgAck)
+	err = conn.WritePacketNotify(Cmd_Msg, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes, func() {
+		if !acked {
+			messages.SetMsgHistoryStatus(pkt.Id, uid, pkt.From, messages.HistoryStatus_Sended)
+		}
+		if written != nil {
+			written()
+		}
+	})
+	return
+}
 
-	presence := connections.FindPresences(sendConn.AuthInfo.Uid)
-	if presence != nil {
-		for terminal, conn := range presence.Terminals {
-			if terminal != sendConn.AuthInfo.TerminalType {
-				err = conn.WritePacket(Cmd_Msg, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-				if err != nil {
-					logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-					return
-				}
+// ackIn takes the response of a client to a Cmd_Msg written to it, which
+// holds the MessageResPacket with the id of the message received.
+func (h *MsgHandler) ackIn(pkt connections.Packet) {
+	if !pkt.Conn.AuthInfo.HasCapability(users.Capability_MsgAck) {
+		return
+	}
+	var ack messages.MessageResPacket
+	err := pkt.Conn.Codec().Unmarshal(pkt.Data, &ack)
+	if err != nil || ack.Mid <= 0 {
+		logs.Logger.Warn("invalid message ack: ", connections.LoggedData(pkt.Cmd, pkt.Data), " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		return
+	}
+	messages.AckMsgs(pkt.Conn.AuthInfo.Uid, []int64{ack.Mid})
+}
+
+// replayMsgs writes the inbound messages waiting to send to conn after it
+// signed in, a page at a time so its write queue does not overflow.
+func replayMsgs(conn *connections.ClientConnection) {
+	uid := conn.AuthInfo.Uid
+	var minMid int64
+	for {
+		msgs, more := messages.GetWaitToSendMsgs(uid, minMid, messages.MaxGetMsgSize)
+		if len(msgs) == 0 {
+			return
+		}
+		written := make(chan bool)
+		for i, msg := range msgs {
+			var notify func()
+			if i == len(msgs)-1 {
+				notify = func() { close(written) }
 			}
+			err := writeMessage(conn, uid, msg, notify)
+			if err != nil {
+				logs.Logger.Warn("replay message error =", err, " user:", conn.AuthInfo.Account, " addr:", conn.RemoteAddr())
+				return
+			}
+		}
+		if !more {
+			return
 		}
+		select {
+		case <-written:
+		case <-conn.Done():
+			return
+		}
+		minMid = msgs[len(msgs)-1].Id
 	}
 }
 
+func (m *MsgHandler) SyncSendedMessage(sendConn *connections.ClientConnection, pkt messages.Message) {
+	notifyUser(sendConn.AuthInfo.Uid, Cmd_Msg, sendConn.AuthInfo.SessionId, pkt)
+}
+
 func PushIosNotification(uid int64, msg messages.Message) {
 	payload := apns.Payload{}
 	payload.Aps.Alert.Body = "你收到一条新的消息"
@@ -197,13 +251,11 @@ func (h *GetRecentContactHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetRecentContactHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.GetRencetContactsReqPacket
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
+	if !decodeRequest(pkt, &reqPkt) {
 		return
 	}
 	resPkt := messages.GetRecentContacts(reqPkt)
-	resData, err := json.Marshal(resPkt)
+	resData, err := pkt.Conn.Codec().Marshal(resPkt)
 	if err != nil {
 		logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 	}
@@ -226,14 +278,12 @@ func (h *GetMsgHistoryHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (g *GetMsgHistoryHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.GetMsgHistoryReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
+	if !decodeRequest(pkt, &reqPkt) {
 		return
 	}
 
 	resPkt := messages.GetMsgHistory(reqPkt)
-	wtBytes, err := json.Marshal(resPkt)
+	wtBytes, err := pkt.Conn.Codec().Marshal(resPkt)
 	if err != nil {
 		logs.Logger.Critical("Marshal message response data error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		return
@@ -258,14 +308,12 @@ func (h *GetMsgBodysHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (g *GetMsgBodysHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.GetMsgBodysReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
+	if !decodeRequest(pkt, &reqPkt) {
 		return
 	}
 
 	resPkt := messages.GetMsgBodys(reqPkt)
-	wtBytes, err := json.Marshal(resPkt)
+	wtBytes, err := pkt.Conn.Codec().Marshal(resPkt)
 	if err != nil {
 		logs.Logger.Critical("Marshal message response data error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		return
@@ -279,6 +327,25 @@ func (g *GetMsgBodysHandler) packetIn(pkt connections.Packet) {
 	return
 }
 
+// GetMsgHandler answers pulls of the inbound messages waiting to send.
+type GetMsgHandler struct {
+	CmdHandler
+}
+
+func (h *GetMsgHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_GetMsg
+	cmdHandlers.handlers[h.Cmd] = h
+	cmdHandlers.requireCapability(h.Cmd, users.Capability_MsgAck)
+}
+
+func (h *GetMsgHandler) packetIn(pkt connections.Packet) {
+	var reqPkt messages.GetMsgReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	writeResponse(pkt, messages.GetMsg(reqPkt))
+}
+
 type RemoveHistoryHandler struct {
 	CmdHandler
 }
@@ -290,10 +357,13 @@ func (h *RemoveHistoryHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *RemoveHistoryHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.RemoveHistoryReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt messages.RemoveHistoryResPkt
 	resPkt.Code = messages.RemoveHistoryCode_InvalidFormat
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -303,11 +373,6 @@ func (h *RemoveHistoryHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = messages.RemoveHistory(reqPkt.Uid, reqPkt.Contact, reqPkt.Mids)
 	return
 }
@@ -327,4 +392,7 @@ func NewMsgHandlers(cmdHandlers *CmdHandlers) {
 
 	removeHistoryHandler := &RemoveHistoryHandler{}
 	removeHistoryHandler.initHandler(cmdHandlers)
+
+	getMsgHandler := &GetMsgHandler{}
+	getMsgHandler.initHandler(cmdHandlers)
 }
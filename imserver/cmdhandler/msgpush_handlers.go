@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/messages"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -18,12 +17,15 @@ func (h *SetMsgPushHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *SetMsgPushHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.SetMsgPushReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt messages.SetMsgPushResPkt
 	defer func() {
 		if resPkt.Code != messages.SetMsgPushCode_None {
 			logs.Logger.Info("set message push failed. code =", resPkt.Code, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
 		}
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -33,12 +35,6 @@ func (h *SetMsgPushHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		resPkt.Code = messages.SetMsgPushCode_InvalidRequest
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt = messages.SetMsgPush(reqPkt)
 	return
 }
@@ -54,9 +50,12 @@ func (h *GetMsgPushHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetMsgPushHandler) packetIn(pkt connections.Packet) {
 	var reqPkt messages.GetMsgPushReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt messages.GetMsgPushResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -66,11 +65,6 @@ func (h *GetMsgPushHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Uid = reqPkt.Uid
 	resPkt.Contact = reqPkt.Contact
 	resPkt.Push = messages.IsMsgPush(reqPkt.Uid, reqPkt.Contact)
@@ -0,0 +1,78 @@
+package cmdhandler
+
+import (
+	"hug/imserver/connections"
+	"hug/logs"
+	"math/rand"
+	"time"
+)
+
+const (
+	PingInterval = 30 * time.Second
+	PingTimeout  = 10 * time.Second
+)
+
+// PingHandler answers pings from clients and collects the pongs of pings
+// sent by the server. A pong is a Cmd_Ping packet of type Pkt_Type_Response
+// with the sid of the ping.
+type PingHandler struct {
+	CmdHandler
+}
+
+func (h *PingHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_Ping
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *PingHandler) packetIn(pkt connections.Packet) {
+	if pkt.PktType == connections.Pkt_Type_Response {
+		if !pkt.Conn.Pong(pkt.Sid) {
+			logs.Logger.Info("unexpected pong sid: ", pkt.Sid, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		}
+		return
+	}
+	var resData []byte
+	err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+	if err != nil {
+		logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+	}
+	return
+}
+
+func NewPingHandlers(cmdHandlers *CmdHandlers) {
+	pingHandler := &PingHandler{}
+	pingHandler.initHandler(cmdHandlers)
+}
+
+// heartbeatLoop pings an authed connection once it has been quiet for
+// PingInterval and closes it if the pong does not arrive within PingTimeout,
+// so half-open connections are dropped long before KeepAliveDuration.
+func heartbeatLoop(conn *connections.ClientConnection) {
+	for {
+		select {
+		case <-conn.Shutdown:
+			return
+		case <-time.After(PingInterval):
+		}
+		if time.Since(conn.LastSeen()) < PingInterval {
+			continue
+		}
+		sid := uint16(rand.Intn(0xFFFF))
+		conn.StartPing(sid)
+		var wtBytes []byte
+		err := conn.WritePacket(Cmd_Ping, connections.Pkt_Type_Request, 0, sid, wtBytes)
+		if err != nil {
+			logs.Logger.Warn("Conn write ping packet error =", err, " user:", conn.AuthInfo.Account, " addr:", conn.RemoteAddr())
+		}
+		select {
+		case <-conn.Shutdown:
+			return
+		case <-time.After(PingTimeout):
+		}
+		if conn.IsPingPending(sid) {
+			logs.Logger.Info("ping timeout user: ", conn.AuthInfo.Account, " addr: ", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package cmdhandler
+
+import (
+	"hug/imserver/connections"
+	"hug/logs"
+)
+
+// UserPresence is the online status of a user and the terminal types it is
+// connected with.
+type UserPresence struct {
+	Uid       int64   `json:"u"`
+	Online    bool    `json:"o,omitempty"`
+	Terminals []int16 `json:"ts,omitempty"`
+}
+
+// MaxGetPresences bounds the uids of one GetPresencesReqPkt.
+const MaxGetPresences = 200
+
+type GetPresencesReqPkt struct {
+	Uids []int64 `json:"us,omitempty"`
+}
+
+type GetPresencesResPkt struct {
+	Presences []UserPresence `json:"ps,omitempty"`
+}
+
+type SubscribePresencesReqPkt struct {
+	Subscribe bool `json:"s,omitempty"`
+}
+
+type SubscribePresencesResPkt struct {
+	Code int8 `json:"c,omitempty"`
+}
+
+// PresenceChangedNotification is sent to the related users of Uid, who
+// subscribed with Cmd_SubscribePresences, when it comes online, goes offline
+// or changes terminals.
+type PresenceChangedNotification struct {
+	UserPresence
+}
+
+func getUserPresence(uid int64) (presence UserPresence) {
+	presence.Uid = uid
+	presence.Terminals = connections.LookupTerminals(uid)
+	presence.Online = len(presence.Terminals) > 0
+	return
+}
+
+// isPresenceVisible reports whether uid may see the presence of ruid, which
+// is only shared with its relations.
+func isPresenceVisible(uid int64, relations map[int64]bool, ruid int64) bool {
+	return uid == ruid || relations[ruid]
+}
+
+type GetPresencesHandler struct {
+	CmdHandler
+}
+
+func (h *GetPresencesHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_GetPresences
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+// packetIn returns the presences of the requested uids, or of all relations
+// if none is requested. Uids which are not relations are left out.
+func (h *GetPresencesHandler) packetIn(pkt connections.Packet) {
+	var reqPkt GetPresencesReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt GetPresencesResPkt
+	defer func() {
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
+		if err != nil {
+			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		}
+		err = pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+		if err != nil {
+			logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+	}()
+	uid := pkt.Conn.AuthInfo.Uid
+	relationUids := GetRelationUids(uid)
+	uids := reqPkt.Uids
+	if len(uids) == 0 {
+		uids = relationUids
+	} else if len(uids) > MaxGetPresences {
+		uids = uids[:MaxGetPresences]
+	}
+	relations := make(map[int64]bool, len(relationUids))
+	for _, ruid := range relationUids {
+		relations[ruid] = true
+	}
+	resPkt.Presences = make([]UserPresence, 0, len(uids))
+	for _, ruid := range uids {
+		if isPresenceVisible(uid, relations, ruid) {
+			resPkt.Presences = append(resPkt.Presences, getUserPresence(ruid))
+		}
+	}
+	return
+}
+
+type SubscribePresencesHandler struct {
+	CmdHandler
+}
+
+func (h *SubscribePresencesHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_SubscribePresences
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *SubscribePresencesHandler) packetIn(pkt connections.Packet) {
+	var reqPkt SubscribePresencesReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt SubscribePresencesResPkt
+	defer func() {
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
+		if err != nil {
+			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		}
+		err = pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+		if err != nil {
+			logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+	}()
+	pkt.Conn.SubscribePresences(reqPkt.Subscribe)
+	return
+}
+
+// SendPresenceChangedNotificationLoop notifies the relations of the users
+// whose presence changed. Changes made while it is busy are coalesced, so
+// each user is looked up once however often it signed in or out meanwhile.
+func SendPresenceChangedNotificationLoop() {
+	var notification PresenceChangedNotification
+	for range connections.PresenceChangedChan {
+		for _, uid := range connections.TakePresenceChanges(64) {
+			notification.UserPresence = getUserPresence(uid)
+			for _, ruid := range GetRelationUids(uid) {
+				notifyUser(ruid, Cmd_PresenceChangedNotification, 0, notification)
+			}
+		}
+	}
+}
+
+func NewPresenceHandlers(cmdHandlers *CmdHandlers) {
+	getPresencesHandler := &GetPresencesHandler{}
+	getPresencesHandler.initHandler(cmdHandlers)
+
+	subscribePresencesHandler := &SubscribePresencesHandler{}
+	subscribePresencesHandler.initHandler(cmdHandlers)
+	go SendPresenceChangedNotificationLoop()
+}
@@ -0,0 +1,87 @@
+package cmdhandler
+
+import (
+	"hug/core/messages"
+	"hug/core/users"
+	"hug/imserver/connections"
+	"time"
+)
+
+// ReceiptHandler stores the delivered and read receipts a recipient gives
+// for one-to-one messages and notifies the terminals of the sender. Read
+// receipts also reach the other terminals of the recipient, so they stop
+// showing the messages as unread.
+type ReceiptHandler struct {
+	CmdHandler
+}
+
+func (h *ReceiptHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_Receipt
+	cmdHandlers.handlers[h.Cmd] = h
+	cmdHandlers.requireCapability(h.Cmd, users.Capability_Receipts)
+}
+
+func (h *ReceiptHandler) packetIn(pkt connections.Packet) {
+	var reqPkt messages.ReceiptReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt messages.ReceiptResPkt
+	defer func() { writeResponse(pkt, resPkt) }()
+	if reqPkt.Status != messages.ReceiptStatus_Delivered && reqPkt.Status != messages.ReceiptStatus_Read {
+		resPkt.Code = messages.ReceiptCode_InvalidFormat
+		return
+	}
+	uid := pkt.Conn.AuthInfo.Uid
+	notification := messages.ReceiptNotification{
+		From:   messages.MessageContact{Id: uid, Type: messages.MCT_User},
+		To:     reqPkt.Contact,
+		Mids:   make([]int64, 0, len(reqPkt.Mids)),
+		Status: reqPkt.Status,
+		Stamp:  time.Now().UnixNano() / 1000000,
+	}
+	changed, err := messages.SetReceipts(reqPkt.Mids, uid, reqPkt.Status, notification.Stamp)
+	if err != nil {
+		resPkt.Code = messages.ReceiptCode_DatabaseErr
+	}
+	notification.Mids = append(notification.Mids, changed...)
+	if reqPkt.Status == messages.ReceiptStatus_Read {
+		messages.AckMsgs(uid, reqPkt.Mids)
+	}
+	if len(notification.Mids) == 0 {
+		return
+	}
+	notifyUser(reqPkt.Contact.Id, Cmd_ReceiptNotification, 0, notification)
+	if reqPkt.Status == messages.ReceiptStatus_Read {
+		notifyUser(uid, Cmd_ReceiptNotification, pkt.Conn.AuthInfo.SessionId, notification)
+	}
+	return
+}
+
+// GetReceiptsHandler returns the receipts of messages the user sent or
+// received, for terminals which missed the notifications.
+type GetReceiptsHandler struct {
+	CmdHandler
+}
+
+func (h *GetReceiptsHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_GetReceipts
+	cmdHandlers.handlers[h.Cmd] = h
+	cmdHandlers.requireCapability(h.Cmd, users.Capability_Receipts)
+}
+
+func (h *GetReceiptsHandler) packetIn(pkt connections.Packet) {
+	var reqPkt messages.GetReceiptsReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	writeResponse(pkt, messages.GetReceipts(reqPkt))
+}
+
+func NewReceiptHandlers(cmdHandlers *CmdHandlers) {
+	receiptHandler := &ReceiptHandler{}
+	receiptHandler.initHandler(cmdHandlers)
+
+	getReceiptsHandler := &GetReceiptsHandler{}
+	getReceiptsHandler.initHandler(cmdHandlers)
+}
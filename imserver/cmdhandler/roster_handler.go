@@ -1,11 +1,9 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/rosters"
 	"hug/imserver/connections"
 	"hug/logs"
-	"math/rand"
 )
 
 type GetAllRosterHandler struct {
@@ -19,9 +17,12 @@ func (h *GetAllRosterHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetAllRosterHandler) packetIn(pkt connections.Packet) {
 	var reqPkt rosters.GetAllRostersReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt rosters.GetAllRostersResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -31,11 +32,6 @@ func (h *GetAllRosterHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Rosters = rosters.GetRostersOfUid(reqPkt.Uid)
 	resPkt.Uid = reqPkt.Uid
 	return
@@ -52,9 +48,12 @@ func (h *GetRostersHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *GetRostersHandler) packetIn(pkt connections.Packet) {
 	var reqPkt rosters.GetRostersReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt rosters.GetRostersResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -64,11 +63,6 @@ func (h *GetRostersHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Rosters, _ = rosters.GetRosters(reqPkt.Uid, reqPkt.Ruids)
 	resPkt.Uid = reqPkt.Uid
 	return
@@ -85,9 +79,12 @@ func (h *SetRosterHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *SetRosterHandler) packetIn(pkt connections.Packet) {
 	var reqPkt rosters.Roster
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt rosters.SetRosterResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -97,11 +94,6 @@ func (h *SetRosterHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = rosters.SetRoster(reqPkt)
 	return
 }
@@ -117,9 +109,12 @@ func (h *RemoveRosterHandler) initHandler(cmdHandlers *CmdHandlers) {
 
 func (h *RemoveRosterHandler) packetIn(pkt connections.Packet) {
 	var reqPkt rosters.RemoveRosterReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt rosters.RemoveRosterResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -129,11 +124,6 @@ func (h *RemoveRosterHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = rosters.RemoveRoster(reqPkt)
 	resPkt.Uid = reqPkt.Uid
 	resPkt.Ruid = reqPkt.Ruid
@@ -150,9 +140,13 @@ func (h *GetRosterChangedHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetRosterChangedHandler) packetIn(pkt connections.Packet) {
+	var reqPkt rosters.GetRosterChangedReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt rosters.GetRosterChangedResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -162,12 +156,6 @@ func (h *GetRosterChangedHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt rosters.GetRosterChangedReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), "reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Notifications, resPkt.Stamp = rosters.GetRosterChanges(reqPkt.Uid, reqPkt.Stamp)
 	return
 }
@@ -176,21 +164,8 @@ func SendRosterChangedNotificationLoop() {
 	var reqPkt rosters.RosterChangedNotification
 	for {
 		reqPkt = <-rosters.RosterChangedNotificationChan
-		wtBytes, err := json.Marshal(reqPkt)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 
-		presence := connections.FindPresences(reqPkt.Uid)
-		if presence != nil {
-			for _, conn := range presence.Terminals {
-				err = conn.WritePacket(Cmd_RosterChangedNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-				if err != nil {
-					logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-					return
-				}
-			}
-		}
+		notifyUser(reqPkt.Uid, Cmd_RosterChangedNotification, 0, reqPkt)
 	}
 }
 
@@ -1,11 +1,9 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/rosters"
 	"hug/imserver/connections"
 	"hug/logs"
-	"math/rand"
 )
 
 type RosterRequestHandler struct {
@@ -18,11 +16,14 @@ func (h *RosterRequestHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *RosterRequestHandler) packetIn(pkt connections.Packet) {
-	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var reqPkt rosters.RosterRequest
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var resPkt rosters.RosterRequestResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -32,31 +33,13 @@ func (h *RosterRequestHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	request, code := rosters.CreateRosterRequest(reqPkt)
 	resPkt.Code = code
 	resPkt.RequestId = request.RequestId
 	logs.Logger.Infof("code = %v requestId = %v", code, request.RequestId)
 	if resPkt.Code == rosters.HandleRosterRequestCode_None {
-		wtBytes, err := json.Marshal(request)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 
-		presence := connections.FindPresences(request.ToUid)
-		if presence != nil {
-			for _, conn := range presence.Terminals {
-				err = conn.WritePacket(Cmd_RosterRequest, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-				if err != nil {
-					logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-					return
-				}
-			}
-		}
+		notifyUser(request.ToUid, Cmd_RosterRequest, 0, request)
 	}
 	return
 }
@@ -71,11 +54,14 @@ func (h *GetRosterRequestsHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetRosterRequestsHandler) packetIn(pkt connections.Packet) {
-	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var reqPkt rosters.GetRosterRequestReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var resPkt rosters.GetRosterReqeustResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -85,11 +71,6 @@ func (h *GetRosterRequestsHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt = rosters.GetRosterReqeusts(reqPkt)
 	return
 }
@@ -104,11 +85,14 @@ func (h *HandleRosterRequestHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *HandleRosterRequestHandler) packetIn(pkt connections.Packet) {
-	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var reqPkt rosters.HandleRosterRequestReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var resPkt rosters.HandleRosterRequestResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -118,11 +102,6 @@ func (h *HandleRosterRequestHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt = rosters.HandleRosterRequest(reqPkt)
 	return
 }
@@ -137,11 +116,14 @@ func (h *SetIgnoreRosterRequestHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetIgnoreRosterRequestHandler) packetIn(pkt connections.Packet) {
-	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var reqPkt rosters.IgnoreRequest
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	logs.Logger.Infof("handle cmd = 0x%02x", h.Cmd)
 	var resPkt rosters.SetIgnoreRequestResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -151,11 +133,6 @@ func (h *SetIgnoreRosterRequestHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt = rosters.SetIgnoreRequest(reqPkt)
 	return
 }
@@ -164,21 +141,8 @@ func SendHandleRosterRequestNotificationLoop() {
 	var reqPkt rosters.HandleRosterRequestNotification
 	for {
 		reqPkt = <-rosters.HandleRosterRequestNotificationChan
-		wtBytes, err := json.Marshal(reqPkt)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 
-		presence := connections.FindPresences(reqPkt.FromUid)
-		if presence != nil {
-			for _, conn := range presence.Terminals {
-				err = conn.WritePacket(Cmd_HandleRosterRequestNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-				if err != nil {
-					logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-					return
-				}
-			}
-		}
+		notifyUser(reqPkt.FromUid, Cmd_HandleRosterRequestNotification, 0, reqPkt)
 	}
 }
 
@@ -0,0 +1,147 @@
+package cmdhandler
+
+import (
+	"hug/core/users"
+	"hug/imserver/cluster"
+	"hug/imserver/connections"
+	"hug/logs"
+	"math/rand"
+)
+
+// SessionInfo is a signed in session of the user. Current marks the session
+// the request came from. SignInTime is in milliseconds.
+type SessionInfo struct {
+	Id              int64  `json:"id"`
+	TerminalType    int16  `json:"tt,omitempty"`
+	TerminalSystem  string `json:"ts,omitempty"`
+	TerminalVersion string `json:"tv,omitempty"`
+	RemoteAddr      string `json:"a,omitempty"`
+	SignInTime      int64  `json:"si,omitempty"`
+	Current         bool   `json:"cur,omitempty"`
+}
+
+type GetSessionsResPkt struct {
+	Sessions []SessionInfo `json:"ss,omitempty"`
+}
+
+type RevokeSessionReqPkt struct {
+	SessionId int64 `json:"id"`
+}
+
+type RevokeSessionResPkt struct {
+	Code int8 `json:"c,omitempty"`
+}
+
+const (
+	RevokeSessionCode_None int8 = iota
+	RevokeSessionCode_NotFound
+	RevokeSessionCode_Current
+	RevokeSessionCode_Failed
+)
+
+type GetSessionsHandler struct {
+	CmdHandler
+}
+
+func (h *GetSessionsHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_GetSessions
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+// packetIn returns the sessions of the user on every node, oldest first.
+func (h *GetSessionsHandler) packetIn(pkt connections.Packet) {
+	var resPkt GetSessionsResPkt
+	defer func() { writeResponse(pkt, resPkt) }()
+	sessions := connections.LookupSessions(pkt.Conn.AuthInfo.Uid)
+	resPkt.Sessions = make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		resPkt.Sessions = append(resPkt.Sessions, SessionInfo{
+			Id:              s.Id,
+			TerminalType:    s.TerminalType,
+			TerminalSystem:  s.TerminalSystem,
+			TerminalVersion: s.TerminalVersion,
+			RemoteAddr:      s.RemoteAddr,
+			SignInTime:      s.SignInTime,
+			Current:         s.Id == pkt.Conn.AuthInfo.SessionId,
+		})
+	}
+	return
+}
+
+type RevokeSessionHandler struct {
+	CmdHandler
+}
+
+func (h *RevokeSessionHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_RevokeSession
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+// packetIn closes another session of the user, wherever it is connected.
+// The current session signs out with Cmd_SignOut instead.
+func (h *RevokeSessionHandler) packetIn(pkt connections.Packet) {
+	var reqPkt RevokeSessionReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt RevokeSessionResPkt
+	defer func() { writeResponse(pkt, resPkt) }()
+	uid := pkt.Conn.AuthInfo.Uid
+	if reqPkt.SessionId == pkt.Conn.AuthInfo.SessionId {
+		resPkt.Code = RevokeSessionCode_Current
+		return
+	}
+	resPkt.Code = RevokeSessionCode_NotFound
+	for _, s := range connections.LookupSessions(uid) {
+		if s.Id != reqPkt.SessionId {
+			continue
+		}
+		logs.Logger.Info("revoke session ", s.Id, " on node ", s.Node, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		if s.Node == connections.LocalNode {
+			if revokeLocalSession(uid, s.Id) {
+				resPkt.Code = RevokeSessionCode_None
+			}
+		} else if clusterNode != nil {
+			err := clusterNode.Send(s.Node, cluster.Forward{Kind: cluster.ForwardKind_Revoke, Uid: uid, Session: s.Id})
+			if err != nil {
+				logs.Logger.Warn("forward revoke to node ", s.Node, " error =", err, " uid:", uid)
+				resPkt.Code = RevokeSessionCode_Failed
+			} else {
+				resPkt.Code = RevokeSessionCode_None
+			}
+		}
+		break
+	}
+	return
+}
+
+// revokeLocalSession closes the session sessionId of uid connected to this
+// node, after invalidating its session token and push device. It reports
+// whether the session was found.
+func revokeLocalSession(uid int64, sessionId int64) (revoked bool) {
+	presence := connections.FindPresences(uid)
+	if presence == nil {
+		return
+	}
+	conn := presence.Session(sessionId)
+	if conn == nil {
+		return
+	}
+	revoked = true
+	users.RevokeSessionToken(conn.AuthInfo.SessionTokenId)
+	releasePushDevice(conn)
+	err := conn.WritePacketNotify(Cmd_SessionRevokedNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), nil, conn.Close)
+	if err != nil {
+		logs.Logger.Warn(err, " user:", conn.AuthInfo.Account, " addr:", conn.RemoteAddr())
+		go conn.Close()
+	}
+	return
+}
+
+func NewSessionHandlers(cmdHandlers *CmdHandlers) {
+	getSessionsHandler := &GetSessionsHandler{}
+	getSessionsHandler.initHandler(cmdHandlers)
+
+	revokeSessionHandler := &RevokeSessionHandler{}
+	revokeSessionHandler.initHandler(cmdHandlers)
+}
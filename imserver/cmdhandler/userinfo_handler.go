@@ -1,11 +1,9 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/users"
 	"hug/imserver/connections"
 	"hug/logs"
-	"math/rand"
 )
 
 type GetUserInfosHandler struct {
@@ -18,9 +16,13 @@ func (h *GetUserInfosHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetUserInfosHandler) packetIn(pkt connections.Packet) {
+	var reqPkt users.GetUserInfosReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt users.GetUserInfosResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -30,12 +32,6 @@ func (h *GetUserInfosHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt users.GetUserInfosReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Infos, _ = users.GetUserInfos(reqPkt.Uids)
 	return
 }
@@ -50,9 +46,13 @@ func (h *SetUserInfosHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetUserInfosHandler) packetIn(pkt connections.Packet) {
+	var reqPkt users.SetUserInfoReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt users.SetUserInfoResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -62,16 +62,6 @@ func (h *SetUserInfosHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt users.SetUserInfoReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
-	if reqPkt.Info.Uid != pkt.Conn.AuthInfo.Uid {
-		resPkt.Code = users.SetUserInfoCOde_NoPermission
-		return
-	}
 	resPkt.Code, resPkt.Stamp = users.UpdateUserInfo(reqPkt)
 	return
 }
@@ -86,9 +76,13 @@ func (h *GetUserInfoChangedHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetUserInfoChangedHandler) packetIn(pkt connections.Packet) {
+	var reqPkt users.GetUserInfoChangedReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt users.GetUserInfoChangedResPkt
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -98,12 +92,6 @@ func (h *GetUserInfoChangedHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt users.GetUserInfoChangedReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	uids := GetRelationUids(reqPkt.Uid)
 	changedUids := make([]int64, 0, len(uids))
 	for _, tempUid := range uids {
@@ -119,22 +107,103 @@ func SendUserInfoChangedNotificationLoop() {
 	var reqPkt users.UserInfoChangedNotificationPkt
 	for {
 		reqPkt.Uid = <-users.UserInfoChangedNotificationChan
-		wtBytes, err := json.Marshal(reqPkt)
-		if err != nil {
-			logs.Logger.Critical("json marshal respacket error:", err)
-		}
 		uids := GetRelationUids(reqPkt.Uid)
 		for _, uid := range uids {
-			presence := connections.FindPresences(uid)
-			if presence != nil {
-				for _, conn := range presence.Terminals {
-					err = conn.WritePacket(Cmd_UserInfoChangedNotification, connections.Pkt_Type_Request, 0, uint16(rand.Intn(0xFFFF)), wtBytes)
-					if err != nil {
-						logs.Logger.Warn("Conn write response packet error =", err, "user:", conn.AuthInfo.Account, "addr:", conn.RemoteAddr())
-						return
-					}
-				}
-			}
+			notifyUser(uid, Cmd_UserInfoChangedNotification, 0, reqPkt)
+		}
+	}
+}
+
+type SetUserStatusHandler struct {
+	CmdHandler
+}
+
+func (h *SetUserStatusHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_SetUserStatus
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *SetUserStatusHandler) packetIn(pkt connections.Packet) {
+	var reqPkt users.SetUserStatusReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt users.SetUserStatusResPkt
+	defer func() {
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
+		if err != nil {
+			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		}
+		err = pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+		if err != nil {
+			logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+	}()
+	resPkt.Code, resPkt.Stamp = users.SetUserStatus(pkt.Conn.AuthInfo.Uid, reqPkt)
+	return
+}
+
+type GetUserStatusesHandler struct {
+	CmdHandler
+}
+
+func (h *GetUserStatusesHandler) initHandler(cmdHandlers *CmdHandlers) {
+	h.Cmd = Cmd_GetUserStatuses
+	cmdHandlers.handlers[h.Cmd] = h
+}
+
+func (h *GetUserStatusesHandler) packetIn(pkt connections.Packet) {
+	var reqPkt users.GetUserStatusesReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
+	var resPkt users.GetUserStatusesResPkt
+	defer func() {
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
+		if err != nil {
+			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		}
+		err = pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+		if err != nil {
+			logs.Logger.Warn("Conn write response packet error =", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+			return
+		}
+	}()
+	uids := reqPkt.Uids
+	if len(uids) > users.MaxGetUserStatuses {
+		uids = uids[:users.MaxGetUserStatuses]
+	}
+	// Statuses are shared with the relations only, like presences.
+	uid := pkt.Conn.AuthInfo.Uid
+	relations := make(map[int64]bool)
+	for _, ruid := range GetRelationUids(uid) {
+		relations[ruid] = true
+	}
+	visible := make([]int64, 0, len(uids))
+	for _, ruid := range uids {
+		if isPresenceVisible(uid, relations, ruid) {
+			visible = append(visible, ruid)
+		}
+	}
+	resPkt.Statuses = users.GetUserStatuses(visible)
+	return
+}
+
+// SendUserStatusChangedNotificationLoop sends the new status to the relations
+// of the user and to its own other terminals.
+func SendUserStatusChangedNotificationLoop() {
+	var reqPkt users.UserStatusChangedNotificationPkt
+	for {
+		uid := <-users.UserStatusChangedNotificationChan
+		statuses := users.GetUserStatuses([]int64{uid})
+		if len(statuses) == 0 {
+			continue
+		}
+		reqPkt.Status = statuses[0]
+		uids := append(GetRelationUids(uid), uid)
+		for _, ruid := range uids {
+			notifyUser(ruid, Cmd_UserStatusChangedNotification, 0, reqPkt)
 		}
 	}
 }
@@ -149,5 +218,12 @@ func NewUserInfoHandlers(cmdHandlers *CmdHandlers) {
 	getUserInfoChangedHandler := &GetUserInfoChangedHandler{}
 	getUserInfoChangedHandler.initHandler(cmdHandlers)
 
+	setUserStatusHandler := &SetUserStatusHandler{}
+	setUserStatusHandler.initHandler(cmdHandlers)
+
+	getUserStatusesHandler := &GetUserStatusesHandler{}
+	getUserStatusesHandler.initHandler(cmdHandlers)
+
 	go SendUserInfoChangedNotificationLoop()
+	go SendUserStatusChangedNotificationLoop()
 }
@@ -1,7 +1,6 @@
 package cmdhandler
 
 import (
-	"encoding/json"
 	"hug/core/corps"
 	"hug/imserver/connections"
 	"hug/logs"
@@ -17,11 +16,15 @@ func (h *CreateWorkerHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *CreateWorkerHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.CreateWorkerReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.CreateWorkerResPkt
 	resPkt.Code = corps.CreateWorkerCode_InvalidReq
 	resPkt.Wid = 0
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -31,12 +34,6 @@ func (h *CreateWorkerHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.CreateWorkerReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Wid, resPkt.Code = corps.CreateWorker(reqPkt)
 	return
 }
@@ -54,7 +51,7 @@ func (h *CreateWorkerHandler) packetIn(pkt connections.Packet) {
 // 	var resPkt corps.ChangeWorkerDeptResPkt
 // 	resPkt.Code = corps.ChangeWorkerDeptCode_InvalidReq
 // 	defer func() {
-// 		resData, err := json.Marshal(resPkt)
+// 		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 // 		if err != nil {
 // 			log.Fatal("ChangeWorkerDeptHandler json marshal respacket error:", err)
 // 		}
@@ -65,7 +62,7 @@ func (h *CreateWorkerHandler) packetIn(pkt connections.Packet) {
 // 		}
 // 	}()
 // 	var reqPkt corps.ChangeWorkerDeptReqPkt
-// 	err := json.Unmarshal(pkt.Data, &reqPkt)
+// 	err := pkt.Conn.Codec().Unmarshal(pkt.Data, &reqPkt)
 // 	if err != nil {
 // 		log.Println("ChangeWorkerDeptHandler error: json unmarshal error:", err)
 // 		return
@@ -84,10 +81,14 @@ func (h *RemoveWorkerHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *RemoveWorkerHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.RemoveWorkerReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.RemoveWorkerResPkt
 	resPkt.Code = corps.RemoveWorkerCode_InvalidReq
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -97,12 +98,6 @@ func (h *RemoveWorkerHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.RemoveWorkerReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = corps.RemoveWorker(reqPkt)
 	return
 }
@@ -117,10 +112,14 @@ func (h *BindWorkerUserHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *BindWorkerUserHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.BindWorkerUserReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.BindWorkerUserResPkt
 	resPkt.Code = corps.BindWorkerUserCode_InvalidReq
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -130,12 +129,6 @@ func (h *BindWorkerUserHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.BindWorkerUserReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	resPkt.Code = corps.BindWorkerUser(reqPkt)
 	return
 }
@@ -150,9 +143,13 @@ func (h *GetWorkerHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *GetWorkerHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.GetWorkerReqPkt
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	var resPkt corps.Worker
 	defer func() {
-		resData, err := json.Marshal(resPkt)
+		resData, err := pkt.Conn.Codec().Marshal(resPkt)
 		if err != nil {
 			logs.Logger.Critical("json marshal respacket error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
 		}
@@ -162,13 +159,7 @@ func (h *GetWorkerHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.GetWorkerReqPkt
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
-	resPkt, err = corps.GetWorker(reqPkt.Wid)
+	resPkt, _ = corps.GetWorker(reqPkt.Wid)
 	return
 }
 
@@ -182,6 +173,10 @@ func (h *SetWorkerHandler) initHandler(cmdHandlers *CmdHandlers) {
 }
 
 func (h *SetWorkerHandler) packetIn(pkt connections.Packet) {
+	var reqPkt corps.Worker
+	if !decodeRequest(pkt, &reqPkt) {
+		return
+	}
 	defer func() {
 		var resData []byte
 		err := pkt.Conn.WritePacket(h.Cmd, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
@@ -190,12 +185,6 @@ func (h *SetWorkerHandler) packetIn(pkt connections.Packet) {
 			return
 		}
 	}()
-	var reqPkt corps.Worker
-	err := json.Unmarshal(pkt.Data, &reqPkt)
-	if err != nil {
-		logs.Logger.Warn("json unmarshal error:", err, " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr(), " reqpkt :", string(pkt.Data))
-		return
-	}
 	corps.SetWorker(reqPkt)
 	return
 }
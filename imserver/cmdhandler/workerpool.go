@@ -0,0 +1,163 @@
+package cmdhandler
+
+import (
+	"fmt"
+	"hug/imserver/connections"
+	"hug/logs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of the packet handling. They can be changed by the server
+// configuration before NewCmdHanglers is called.
+var (
+	// HandlerWorkers is how many packets are handled at the same time.
+	HandlerWorkers = 64
+	// ConnQueueMaxPackets is how many packets of one connection may wait for
+	// a worker. Requests over it are answered with PktErr_Busy.
+	ConnQueueMaxPackets = 64
+	// ConnQueueMaxResponses is how many more packets may wait if they are
+	// responses, so the acks of a replayed page of messages all get in.
+	// Responses over it are dropped.
+	ConnQueueMaxResponses = 256
+)
+
+// QueueStat is a snapshot of the packets waiting to be handled.
+type QueueStat struct {
+	// Packets received and not yet handed to the workers.
+	Received int
+	// Packets waiting for a worker and the connections they came from.
+	Queued      int
+	Connections int
+	Workers     int
+	// Workers running a handler.
+	Busy int
+	// Packets refused since the server started because the queue of their
+	// connection was full.
+	Rejected uint64
+}
+
+// workerPool handles packets with a fixed number of workers. The packets of
+// one connection wait in their own queue and are handled one after another,
+// in the order they were received. Connections with packets take turns, one
+// packet each, so a busy client does not hold the workers.
+type workerPool struct {
+	handle   HandlerFunc
+	workers  int
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queues   map[*connections.ClientConnection][]connections.Packet
+	ready    []*connections.ClientConnection
+	queued   int
+	busy     int
+	stopping bool
+	rejected uint64
+	done     sync.WaitGroup
+}
+
+func newWorkerPool(workers int, handle HandlerFunc) (pool *workerPool) {
+	pool = &workerPool{
+		handle:  handle,
+		workers: workers,
+		queues:  make(map[*connections.ClientConnection][]connections.Packet),
+	}
+	pool.cond = sync.NewCond(&pool.lock)
+	pool.done.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return
+}
+
+// push queues pkt behind the packets of its connection. A connection is in
+// queues from its first waiting packet until a worker has handled its last
+// one, and in ready while no worker holds it.
+func (pool *workerPool) push(pkt connections.Packet) {
+	pool.lock.Lock()
+	queue, scheduled := pool.queues[pkt.Conn]
+	max := ConnQueueMaxPackets
+	if pkt.PktType != connections.Pkt_Type_Request {
+		max += ConnQueueMaxResponses
+	}
+	if len(queue) >= max {
+		pool.lock.Unlock()
+		atomic.AddUint64(&pool.rejected, 1)
+		logs.Logger.Warn("handler queue full, refuse cmd: ", fmt.Sprintf("0x%02x", pkt.Cmd), " user:", pkt.Conn.AuthInfo.Account, " addr:", pkt.Conn.RemoteAddr())
+		if pkt.PktType == connections.Pkt_Type_Request {
+			pkt.Conn.WriteError(pkt.Cmd, pkt.Sid, connections.PktErr_Busy)
+		}
+		return
+	}
+	pool.queues[pkt.Conn] = append(queue, pkt)
+	pool.queued++
+	if !scheduled {
+		pool.ready = append(pool.ready, pkt.Conn)
+		pool.cond.Signal()
+	}
+	pool.lock.Unlock()
+}
+
+func (pool *workerPool) work() {
+	defer pool.done.Done()
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for {
+		for len(pool.ready) == 0 && !pool.stopping {
+			pool.cond.Wait()
+		}
+		if len(pool.ready) == 0 {
+			return
+		}
+		conn := pool.ready[0]
+		pool.ready[0] = nil
+		pool.ready = pool.ready[1:]
+		queue := pool.queues[conn]
+		pkt := queue[0]
+		pool.queues[conn] = queue[1:]
+		pool.queued--
+		pool.busy++
+
+		pool.lock.Unlock()
+		pool.handle(pkt)
+		pool.lock.Lock()
+
+		pool.busy--
+		if len(pool.queues[conn]) == 0 {
+			delete(pool.queues, conn)
+		} else {
+			pool.ready = append(pool.ready, conn)
+			pool.cond.Signal()
+		}
+	}
+}
+
+// stop lets the workers handle the packets queued and waits until they quit.
+// No packet may be pushed after stop is called.
+func (pool *workerPool) stop(timeout time.Duration) {
+	pool.lock.Lock()
+	pool.stopping = true
+	pool.cond.Broadcast()
+	pool.lock.Unlock()
+	quit := make(chan bool)
+	go func() {
+		pool.done.Wait()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-time.After(timeout):
+		logs.Logger.Warn("wait handlers timeout")
+	}
+}
+
+func (pool *workerPool) stat() (stat QueueStat) {
+	pool.lock.Lock()
+	stat.Queued = pool.queued
+	stat.Connections = len(pool.queues)
+	stat.Busy = pool.busy
+	pool.lock.Unlock()
+	stat.Workers = pool.workers
+	stat.Rejected = atomic.LoadUint64(&pool.rejected)
+	return
+}
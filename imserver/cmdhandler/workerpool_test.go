@@ -0,0 +1,108 @@
+package cmdhandler
+
+import (
+	"hug/imserver/connections"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestConn(t *testing.T) (conn *connections.ClientConnection, client net.Conn) {
+	server, client := net.Pipe()
+	conn = connections.New(server, make(chan connections.Packet, 1))
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return
+}
+
+func TestWorkerPoolOrder(t *testing.T) {
+	const packets = 200
+	conns := make([]*connections.ClientConnection, 8)
+	for i := range conns {
+		conns[i], _ = newTestConn(t)
+	}
+	var lock sync.Mutex
+	handled := make(map[*connections.ClientConnection][]uint16)
+	var running, maxRunning int32
+	pool := newWorkerPool(4, func(pkt connections.Packet) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(pkt.Sid%3) * time.Millisecond)
+		lock.Lock()
+		handled[pkt.Conn] = append(handled[pkt.Conn], pkt.Sid)
+		lock.Unlock()
+		atomic.AddInt32(&running, -1)
+	})
+	old := ConnQueueMaxPackets
+	ConnQueueMaxPackets = packets
+	defer func() { ConnQueueMaxPackets = old }()
+
+	for sid := uint16(0); sid < packets; sid++ {
+		for _, conn := range conns {
+			pool.push(connections.Packet{Conn: conn, Sid: sid})
+		}
+	}
+	pool.stop(10 * time.Second)
+
+	for _, conn := range conns {
+		sids := handled[conn]
+		if len(sids) != packets {
+			t.Fatalf("handled %d packets of a connection, expect %d", len(sids), packets)
+		}
+		for i, sid := range sids {
+			if sid != uint16(i) {
+				t.Fatalf("packet %d handled at %d", sid, i)
+			}
+		}
+	}
+	if maxRunning > 4 {
+		t.Errorf("%d packets handled at the same time, expect at most 4", maxRunning)
+	}
+	if stat := pool.stat(); stat.Queued != 0 || stat.Connections != 0 || stat.Busy != 0 {
+		t.Errorf("got %+v after stop, expect empty queues", stat)
+	}
+}
+
+func TestWorkerPoolFull(t *testing.T) {
+	old := ConnQueueMaxPackets
+	ConnQueueMaxPackets = 2
+	defer func() { ConnQueueMaxPackets = old }()
+
+	release := make(chan bool)
+	started := make(chan bool)
+	pool := newWorkerPool(1, func(pkt connections.Packet) {
+		if pkt.Sid == 1 {
+			started <- true
+			<-release
+		}
+	})
+	defer pool.stop(time.Second)
+	conn, client := newTestConn(t)
+	other, _ := newTestConn(t)
+
+	// Sid 1 holds the worker, 2 and 3 fill the queue of conn.
+	pool.push(connections.Packet{Conn: conn, PktType: connections.Pkt_Type_Request, Cmd: Cmd_Msg, Sid: 1})
+	<-started
+	for sid := uint16(2); sid <= 4; sid++ {
+		pool.push(connections.Packet{Conn: conn, PktType: connections.Pkt_Type_Request, Cmd: Cmd_Msg, Sid: sid})
+	}
+	pool.push(connections.Packet{Conn: other, PktType: connections.Pkt_Type_Request, Cmd: Cmd_Msg, Sid: 5})
+
+	if pkt := readPacket(t, client); pkt.PktType != connections.Pkt_Type_Error || pkt.Code != connections.PktErr_Busy || pkt.Sid != 4 {
+		t.Errorf("got %+v, expect busy", pkt)
+	}
+	stat := pool.stat()
+	if stat.Queued != 3 || stat.Connections != 2 || stat.Busy != 1 || stat.Rejected != 1 || stat.Workers != 1 {
+		t.Errorf("got %+v", stat)
+	}
+	close(release)
+}
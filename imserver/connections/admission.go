@@ -0,0 +1,233 @@
+package connections
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CmdRate is the packet rate allowed for a cmd on one connection: Rate
+// packets per second on average and bursts of up to Burst packets.
+type CmdRate struct {
+	Rate  float64
+	Burst float64
+}
+
+// Admission limits. They can be changed by the server configuration before
+// any connection is accepted.
+var (
+	MaxConnectionsPerIP = 64
+	// Auth attempts allowed per minute for one account and for one IP.
+	AuthAttemptsPerAccount = 10
+	AuthAttemptsPerIP      = 30
+	DefaultCmdRate         = CmdRate{Rate: 20, Burst: 40}
+	CmdRates               = make(map[uint8]CmdRate)
+)
+
+var rejectedConnections uint64
+var rejectedAuthAttempts uint64
+var rateLimitedPackets uint64
+
+// RejectedConnections returns how many connections were refused because
+// their IP had too many connections open.
+func RejectedConnections() uint64 {
+	return atomic.LoadUint64(&rejectedConnections)
+}
+
+// RejectedAuthAttempts returns how many Cmd_Auth packets were refused
+// because their account or IP tried too often.
+func RejectedAuthAttempts() uint64 {
+	return atomic.LoadUint64(&rejectedAuthAttempts)
+}
+
+// RateLimitedPackets returns how many packets were refused because their
+// connection sent the cmd too fast.
+func RateLimitedPackets() uint64 {
+	return atomic.LoadUint64(&rateLimitedPackets)
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// keyedLimiter keeps one bucket per key. Buckets that refilled completely
+// carry no state and are dropped when the map grows.
+type keyedLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+const keyedLimiterSweepSize = 4096
+
+func newKeyedLimiter() *keyedLimiter {
+	return &keyedLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *keyedLimiter) allow(key string, perMinute int, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= keyedLimiterSweepSize {
+			l.sweep(now)
+		}
+		b = newTokenBucket(float64(perMinute)/60, float64(perMinute), now)
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+func (l *keyedLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	authAccountLimiter = newKeyedLimiter()
+	authIPLimiter      = newKeyedLimiter()
+	ipConnections      = make(map[string]int)
+	ipConnectionsLock  sync.Mutex
+)
+
+func hostOf(addr net.Addr) (host string) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return
+}
+
+// Accept creates a connection for conn unless its IP already has
+// MaxConnectionsPerIP connections open. A refused conn gets a
+// PktErr_TooManyConnections error packet and is closed.
+func Accept(conn net.Conn, packetChan chan Packet) (c *ClientConnection, ok bool) {
+	host, ok := Admit(conn)
+	if !ok {
+		if buf, err := PrepareSendPacket(0, Pkt_Type_Error, PktErr_TooManyConnections, 0, nil); err == nil {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			conn.Write(buf)
+		}
+		conn.Close()
+		return
+	}
+	c = AcceptAdmitted(conn, host, packetChan)
+	return
+}
+
+// Admit counts conn against the connections of its IP, unless the IP
+// already has MaxConnectionsPerIP connections open. An admitted conn must
+// be passed to AcceptAdmitted, or given back with ReleaseAdmission.
+func Admit(conn net.Conn) (host string, ok bool) {
+	host = hostOf(conn.RemoteAddr())
+	ipConnectionsLock.Lock()
+	if ipConnections[host] >= MaxConnectionsPerIP {
+		ipConnectionsLock.Unlock()
+		atomic.AddUint64(&rejectedConnections, 1)
+		return
+	}
+	ipConnections[host]++
+	ipConnectionsLock.Unlock()
+	ok = true
+	return
+}
+
+// ReleaseAdmission gives back the admission of a conn closed before
+// AcceptAdmitted, when its TLS handshake failed for instance.
+func ReleaseAdmission(host string) {
+	releaseHost(host)
+}
+
+// AcceptAdmitted creates a connection for conn, admitted for host by Admit.
+func AcceptAdmitted(conn net.Conn, host string, packetChan chan Packet) (c *ClientConnection) {
+	c = newClientConnection(conn, packetChan)
+	c.admittedHost = host
+	c.start()
+	return
+}
+
+func releaseHost(host string) {
+	ipConnectionsLock.Lock()
+	ipConnections[host]--
+	if ipConnections[host] <= 0 {
+		delete(ipConnections, host)
+	}
+	ipConnectionsLock.Unlock()
+}
+
+// AllowAuthFromIP reports whether the IP of c may try to authenticate again.
+func (c *ClientConnection) AllowAuthFromIP() bool {
+	if authIPLimiter.allow(hostOf(c.RemoteAddr()), AuthAttemptsPerIP, time.Now()) {
+		return true
+	}
+	atomic.AddUint64(&rejectedAuthAttempts, 1)
+	return false
+}
+
+// AllowAuthForAccount reports whether account may try to authenticate again.
+func AllowAuthForAccount(account string) bool {
+	if authAccountLimiter.allow(account, AuthAttemptsPerAccount, time.Now()) {
+		return true
+	}
+	atomic.AddUint64(&rejectedAuthAttempts, 1)
+	return false
+}
+
+// AllowCmd reports whether c may send one more packet of cmd, according to
+// CmdRates or DefaultCmdRate.
+func (c *ClientConnection) AllowCmd(cmd uint8) bool {
+	now := time.Now()
+	c.cmdRatesLock.Lock()
+	if c.cmdBuckets == nil {
+		c.cmdBuckets = make(map[uint8]*tokenBucket)
+	}
+	b, ok := c.cmdBuckets[cmd]
+	if !ok {
+		rate, ok := CmdRates[cmd]
+		if !ok {
+			rate = DefaultCmdRate
+		}
+		b = newTokenBucket(rate.Rate, rate.Burst, now)
+		c.cmdBuckets[cmd] = b
+	}
+	allowed := b.allow(now)
+	c.cmdRatesLock.Unlock()
+	if !allowed {
+		atomic.AddUint64(&rateLimitedPackets, 1)
+	}
+	return allowed
+}
+
+// WriteError answers the packet cmd/sid with a Pkt_Type_Error packet.
+func (c *ClientConnection) WriteError(cmd uint8, sid uint16, code int8) (err error) {
+	err = c.WritePacket(cmd, Pkt_Type_Error, code, sid, nil)
+	return
+}
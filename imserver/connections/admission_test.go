@@ -0,0 +1,99 @@
+package connections
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("burst packet %d refused", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("packet allowed over burst")
+	}
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("packet refused after refill")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("refill allowed more than the rate")
+	}
+}
+
+func TestKeyedLimiterSweep(t *testing.T) {
+	l := newKeyedLimiter()
+	now := time.Now()
+	for i := 0; i < keyedLimiterSweepSize; i++ {
+		l.allow(string(rune(i)), 60, now)
+	}
+	l.allow("new", 60, now.Add(time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after sweep, expect 1", len(l.buckets))
+	}
+}
+
+func TestAcceptLimitsConnectionsPerIP(t *testing.T) {
+	defer func(max int) { MaxConnectionsPerIP = max }(MaxConnectionsPerIP)
+	MaxConnectionsPerIP = 1
+	rejected := RejectedConnections()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	c, ok := Accept(server, make(chan Packet, 1))
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+
+	server2, client2 := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client2)
+		received <- data
+	}()
+	if _, ok := Accept(server2, make(chan Packet, 1)); ok {
+		t.Fatal("second connection from the same ip accepted")
+	}
+	data := <-received
+	pkt, found := ParseReceivedData(&data)
+	if !found || pkt.PktType != Pkt_Type_Error || pkt.Code != PktErr_TooManyConnections {
+		t.Errorf("got %+v, expect a too many connections error", pkt)
+	}
+	if RejectedConnections() != rejected+1 {
+		t.Errorf("rejected connections not counted")
+	}
+
+	c.Close()
+	<-c.Done()
+	server3, client3 := net.Pipe()
+	defer client3.Close()
+	c3, ok := Accept(server3, make(chan Packet, 1))
+	if !ok {
+		t.Fatal("connection refused after the first one closed")
+	}
+	c3.Close()
+}
+
+func TestAllowCmd(t *testing.T) {
+	defer delete(CmdRates, 0x10)
+	CmdRates[0x10] = CmdRate{Rate: 1, Burst: 2}
+	c := &ClientConnection{}
+	limited := RateLimitedPackets()
+	if !c.AllowCmd(0x10) || !c.AllowCmd(0x10) {
+		t.Fatal("burst refused")
+	}
+	if c.AllowCmd(0x10) {
+		t.Fatal("cmd allowed over its rate")
+	}
+	if !c.AllowCmd(0x11) {
+		t.Fatal("other cmd limited by the rate of 0x10")
+	}
+	if RateLimitedPackets() != limited+1 {
+		t.Errorf("rate limited packet not counted")
+	}
+}
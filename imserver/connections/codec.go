@@ -0,0 +1,62 @@
+package connections
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack"
+	"hug/core/users"
+)
+
+// Codec encodes the data of request and response packets. JSON is used
+// unless the connection negotiated users.Capability_MsgPack in Cmd_Auth.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec uses the json tags as map keys, so the binary encoding has the
+// same field names as the JSON one.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := msgpack.NewEncoder(&b).UseJSONTag(true).Encode(v)
+	return b.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(v)
+}
+
+var (
+	JsonCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+func (c *ClientConnection) Codec() Codec {
+	if c.AuthInfo.HasCapability(users.Capability_MsgPack) {
+		return MsgpackCodec
+	}
+	return JsonCodec
+}
+
+// WriteObject encodes v with the codec of the connection and writes it as
+// the packet data.
+func (c *ClientConnection) WriteObject(cmd uint8, pktType uint8, code int8, sid uint16, v interface{}) (err error) {
+	data, err := c.Codec().Marshal(v)
+	if err != nil {
+		return
+	}
+	err = c.WritePacket(cmd, pktType, code, sid, data)
+	return
+}
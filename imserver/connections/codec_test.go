@@ -0,0 +1,76 @@
+package connections
+
+import (
+	"bytes"
+	"hug/core/messages"
+	"hug/core/users"
+	"reflect"
+	"testing"
+)
+
+func testMessage() messages.Message {
+	return messages.Message{
+		From:   messages.MessageContact{Id: 10001, Type: messages.MCT_User},
+		To:     messages.MessageContact{Id: 20002, Type: messages.MCT_Group},
+		Author: messages.MessageContact{Id: 10001, Type: messages.MCT_User},
+		Stamp:  1450000000000,
+		Id:     123456,
+		Items: []messages.MessageItem{
+			{ItemType: messages.MIT_Text, Data: "hello"},
+			{ItemType: messages.MIT_Voice, Data: "a.amr", VoiceDuration: 3},
+		},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JsonCodec, MsgpackCodec} {
+		msg := testMessage()
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded messages.Message
+		err = codec.Unmarshal(data, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Item data is decoded as interface{} and compared separately.
+		if decoded.Items[0].Data != "hello" || decoded.Items[1].Data != "a.amr" {
+			t.Errorf("%T: got item data %v, %v", codec, decoded.Items[0].Data, decoded.Items[1].Data)
+		}
+		decoded.Items[0].Data = msg.Items[0].Data
+		decoded.Items[1].Data = msg.Items[1].Data
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("%T: got %+v, expect %+v", codec, decoded, msg)
+		}
+	}
+}
+
+func TestMsgpackUsesJsonTags(t *testing.T) {
+	data, err := MsgpackCodec.Marshal(messages.MessageContact{Id: 1, Type: messages.MCT_User})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("id")) || bytes.Contains(data, []byte("Id")) {
+		t.Errorf("msgpack data %q does not use json tags", data)
+	}
+}
+
+func TestMsgpackIsSmaller(t *testing.T) {
+	jsonData, _ := JsonCodec.Marshal(testMessage())
+	msgpackData, _ := MsgpackCodec.Marshal(testMessage())
+	if len(msgpackData) >= len(jsonData) {
+		t.Errorf("msgpack %d bytes, json %d bytes", len(msgpackData), len(jsonData))
+	}
+}
+
+func TestConnectionCodec(t *testing.T) {
+	c := &ClientConnection{}
+	if c.Codec() != JsonCodec {
+		t.Errorf("json should be the default codec")
+	}
+	c.AuthInfo.Capabilities = users.Capability_MsgPack
+	if c.Codec() != MsgpackCodec {
+		t.Errorf("msgpack should be used after negotiation")
+	}
+}
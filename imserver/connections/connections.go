@@ -7,6 +7,8 @@ import (
 	"hug/logs"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,82 +16,169 @@ const (
 	AuthDuration      = 5 * time.Second
 	KeepAliveDuration = 300 * time.Second
 	AuthPacketMaxSize = 1024
+	FlushDuration     = 2 * time.Second
 )
 
 type ClientConnection struct {
-	conn              net.Conn
-	AuthInfo          users.AuthInfo
-	Shutdown          chan bool
-	kill              chan bool
-	packetChan        chan Packet
-	WriteChan         chan []byte
-	receivedBufChache []byte
-	socketBuf         []byte
-	Identifier        int64
-	authed            chan bool
+	conn               net.Conn
+	AuthInfo           users.AuthInfo
+	Shutdown           chan bool
+	kill               chan bool
+	packetChan         chan Packet
+	writeQueue         *writeQueue
+	receivedBufChache  []byte
+	socketBuf          []byte
+	Identifier         int64
+	authed             int32
+	shutdownOnce       sync.Once
+	done               chan bool
+	lastSeen           int64
+	heartbeatLock      sync.Mutex
+	pingSid            uint16
+	pingPending        bool
+	pingSent           time.Time
+	rtt                time.Duration
+	readLock           sync.Mutex
+	draining           bool
+	readerDone         chan bool
+	writerDone         chan bool
+	admittedHost       string
+	cmdRatesLock       sync.Mutex
+	cmdBuckets         map[uint8]*tokenBucket
+	presenceSubscribed int32
 }
 
-func New(conn net.Conn, packetChan chan Packet) {
-	c := &ClientConnection{
+func New(conn net.Conn, packetChan chan Packet) (c *ClientConnection) {
+	c = newClientConnection(conn, packetChan)
+	c.start()
+	return
+}
+
+func newClientConnection(conn net.Conn, packetChan chan Packet) (c *ClientConnection) {
+	c = &ClientConnection{
 		conn:              conn,
 		Shutdown:          make(chan bool),
 		kill:              make(chan bool),
 		packetChan:        packetChan,
-		WriteChan:         make(chan []byte, 8),
+		writeQueue:        newWriteQueue(),
 		receivedBufChache: make([]byte, 0, 256),
 		socketBuf:         make([]byte, 256, 256),
 		Identifier:        time.Now().UnixNano(),
-		authed:            make(chan bool),
+		done:              make(chan bool),
+		readerDone:        make(chan bool),
+		writerDone:        make(chan bool),
 	}
 	c.AuthInfo.Account = ""
 	c.AuthInfo.AuthCode = users.AuthCode_WaitAuth
-	go c.Listen()
 	return
+}
 
+func (c *ClientConnection) start() {
+	addLiveConnection(c)
+	go c.Listen()
 }
 
 func (c *ClientConnection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
-func (c *ClientConnection) Listen() {
-	defer func() {
-		if err := recover(); err != nil {
-			logs.Logger.Info("Connection terminated: ", err, " user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
-			if c.AuthInfo.AuthCode == users.AuthCode_None {
-				KilledPresenceChan <- c
-				if c.AuthInfo.IosDevice.IsValid() {
-					devices.SetIosDeviceStatus(c.AuthInfo.IosDevice.Token, devices.IosDeviceStatus_Background)
-				} else if c.AuthInfo.AndroidDevice.IsValid() {
-					devices.SetIosDeviceStatus(c.AuthInfo.AndroidDevice.Alias, devices.AndroidDeviceStatus_Background)
-				}
-			}
-			c.quitLoops()
-			logs.Logger.Info("Delete connection: ", c.conn.RemoteAddr())
-		}
-	}()
+// Done is closed once the connection has been shut down and its socket closed.
+func (c *ClientConnection) Done() <-chan bool {
+	return c.done
+}
+
+// LastSeen returns when data was last received from the client.
+func (c *ClientConnection) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastSeen))
+}
+
+// StartPing records a ping sent to the client with sid.
+func (c *ClientConnection) StartPing(sid uint16) {
+	c.heartbeatLock.Lock()
+	c.pingSid = sid
+	c.pingPending = true
+	c.pingSent = time.Now()
+	c.heartbeatLock.Unlock()
+}
+
+// Pong records the answer to the ping with sid and measures the round trip
+// time. It reports false if no such ping is pending.
+func (c *ClientConnection) Pong(sid uint16) bool {
+	c.heartbeatLock.Lock()
+	defer c.heartbeatLock.Unlock()
+	if !c.pingPending || c.pingSid != sid {
+		return false
+	}
+	c.pingPending = false
+	c.rtt = time.Since(c.pingSent)
+	return true
+}
+
+// IsPingPending reports whether the ping with sid is still unanswered.
+func (c *ClientConnection) IsPingPending(sid uint16) bool {
+	c.heartbeatLock.Lock()
+	defer c.heartbeatLock.Unlock()
+	return c.pingPending && c.pingSid == sid
+}
+
+// RTT returns the round trip time measured by the last answered ping.
+func (c *ClientConnection) RTT() time.Duration {
+	c.heartbeatLock.Lock()
+	defer c.heartbeatLock.Unlock()
+	return c.rtt
+}
+
+// SubscribePresences turns presence notifications of the connection on or off.
+func (c *ClientConnection) SubscribePresences(subscribe bool) {
+	if subscribe {
+		atomic.StoreInt32(&c.presenceSubscribed, 1)
+	} else {
+		atomic.StoreInt32(&c.presenceSubscribed, 0)
+	}
+}
 
-	go c.listenBeforeAuth(c.kill)
+func (c *ClientConnection) IsPresenceSubscribed() bool {
+	return atomic.LoadInt32(&c.presenceSubscribed) == 1
+}
+
+func (c *ClientConnection) isAuthed() bool {
+	return atomic.LoadInt32(&c.authed) == 1
+}
+
+// Listen starts one blocking reader and one writer for the connection and
+// waits for Shutdown. Idle connections cost nothing but a parked goroutine;
+// keepalive is enforced with read deadlines.
+func (c *ClientConnection) Listen() {
+	go c.readLoop()
 	go c.writeSocketLoop(c.kill)
 
-	select {
-	case <-c.Shutdown:
-		panic("Shutting down connection.")
+	<-c.Shutdown
+	logs.Logger.Info("Connection terminated user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
+	if c.isAuthed() {
+		KilledPresenceChan <- c
+		if c.AuthInfo.IosDevice.IsValid() {
+			devices.SetIosDeviceStatus(c.AuthInfo.IosDevice.Token, devices.IosDeviceStatus_Background)
+		} else if c.AuthInfo.AndroidDevice.IsValid() {
+			devices.SetAndroidDeviceStatus(c.AuthInfo.AndroidDevice.Alias, devices.AndroidDeviceStatus_Background)
+		}
 	}
+	c.quitLoops()
+	removeLiveConnection(c)
+	if len(c.admittedHost) > 0 {
+		releaseHost(c.admittedHost)
+	}
+	close(c.done)
+	logs.Logger.Info("Delete connection: ", c.conn.RemoteAddr())
 }
 
+// quitLoops stops the writer, which flushes what is still queued, and closes
+// the socket, which unblocks the reader.
 func (c *ClientConnection) quitLoops() {
 	logs.Logger.Info("quiteloop connection user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
 	select {
 	case c.kill <- true:
 		logs.Logger.Info("kill connection user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
-	case <-time.After(time.Second):
-		logs.Logger.Info("kill connection timeout user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
-	}
-
-	select {
-	case c.kill <- true:
-		logs.Logger.Info("kill connection user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
+		<-c.writerDone
 	case <-time.After(time.Second):
 		logs.Logger.Info("kill connection timeout user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
 	}
@@ -103,8 +192,9 @@ func (c *ClientConnection) SetAuthResult(info users.AuthInfo) {
 	// }()
 	if info.AuthCode == users.AuthCode_None {
 		c.AuthInfo = info
+		atomic.StoreInt32(&c.authed, 1)
+		c.setReadDeadline(time.Now().Add(KeepAliveDuration))
 		NewPresenceChan <- c
-		c.authed <- true
 		logs.Logger.Info("New connection authed. user:", info.Account, " addr:", c.RemoteAddr())
 	} else {
 		logs.Logger.Info("New connection authed failed. user:", info.Account, " addr:", c.RemoteAddr(), " code:", info.AuthCode)
@@ -119,23 +209,45 @@ func (c *ClientConnection) handlePacketIn(packet Packet) {
 	// }()
 	select {
 	case c.packetChan <- packet:
-		logs.Logger.Info("Received packet cmd = ", fmt.Sprintf("0x%02x", packet.Cmd), " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr(), " data: ", string(packet.Data))
 	}
 
 }
 
-func (c *ClientConnection) Write(data []byte) {
-	select {
-	case c.WriteChan <- data:
-	case <-time.After(time.Second):
-	}
+func (c *ClientConnection) Write(data []byte) (err error) {
+	err = c.WriteNotify(data, nil)
+	return
+}
 
+// WriteNotify queues data for the socket and calls written, if not nil,
+// once data has been written. Data refused here or dropped later because
+// the connection closed never calls written.
+func (c *ClientConnection) WriteNotify(data []byte, written func()) (err error) {
+	err, slow := c.writeQueue.push(writeItem{data: data, written: written})
+	if err != nil {
+		logs.Logger.Warn("write queue full, drop ", len(data), " bytes user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+		if slow {
+			atomic.AddUint64(&slowConsumerDisconnects, 1)
+			logs.Logger.Warn("slow consumer, close connection user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+			c.Close()
+		}
+	}
+	return
 }
 
 func (c *ClientConnection) WritePacket(cmd uint8, pktType uint8, code int8, sid uint16, data []byte) (err error) {
+	err = c.WritePacketNotify(cmd, pktType, code, sid, data, nil)
+	return
+}
+
+// WritePacketNotify is WritePacket with the written callback of WriteNotify.
+func (c *ClientConnection) WritePacketNotify(cmd uint8, pktType uint8, code int8, sid uint16, data []byte, written func()) (err error) {
 	var wtBuf []byte
-	logs.Logger.Info("Conn write packet: cmd: ", fmt.Sprintf("0x%02x", cmd), " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr(), " data = ", string(data))
-	wtBuf, err = StreamPacket(cmd, pktType, code, sid, data)
+	logs.Logger.Debug("Conn write packet: cmd: ", fmt.Sprintf("0x%02x", cmd), " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr(), " data = ", LoggedData(cmd, data))
+	if c.AuthInfo.HasCapability(users.Capability_Compression) {
+		wtBuf, err = StreamCompressedPacket(cmd, pktType, code, sid, data)
+	} else {
+		wtBuf, err = StreamPacket(cmd, pktType, code, sid, data)
+	}
 	if err != nil {
 		return
 	}
@@ -143,126 +255,139 @@ func (c *ClientConnection) WritePacket(cmd uint8, pktType uint8, code int8, sid
 	if err != nil {
 		return
 	}
-	c.Write(wtBuf)
+	err = c.WriteNotify(wtBuf, written)
 	return
 }
 
 func (c *ClientConnection) Close() {
-	logs.Logger.Info("Start close connection: user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
-	select {
-	case c.Shutdown <- true:
-
-	case <-time.After(1 * time.Second):
-
-	}
+	c.shutdownOnce.Do(func() {
+		logs.Logger.Info("Start close connection: user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
+		close(c.Shutdown)
+	})
 }
 
-func (c *ClientConnection) readSocket() (n int, err error) {
-	//logs.Logger.Info("readSocket")
-	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-	n, err = c.conn.Read(c.socketBuf)
-	if err != nil {
-		if err == io.EOF {
-			go c.Close()
+func (c *ClientConnection) readLoop() {
+	defer func() {
+		close(c.readerDone)
+		logs.Logger.Info("quit readLoop user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+	}()
+	c.setReadDeadline(time.Now().Add(AuthDuration))
+	for {
+		n, err := c.conn.Read(c.socketBuf)
+		if n > 0 {
+			atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+			if c.isAuthed() {
+				c.setReadDeadline(time.Now().Add(KeepAliveDuration))
+			}
+			c.bufferReceived(n)
+		}
+		if c.isDraining() {
+			return
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if c.isAuthed() {
+					logs.Logger.Info("keepalive timeout user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+				} else {
+					logs.Logger.Info("Auth timeout addr: ", c.conn.RemoteAddr())
+				}
+			} else if err != io.EOF {
+				logs.Logger.Info("read socket error: ", err, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+			}
+			c.Close()
+			return
 		}
-		return
-	}
-	if n == 0 {
-		return
 	}
-	//logs.Logger.Info("read socket: ", n, " bytes ：", c.socketBuf[:n])
+}
+
+func (c *ClientConnection) bufferReceived(n int) {
 	c.receivedBufChache = append(c.receivedBufChache, c.socketBuf[:n]...)
 
-	if c.AuthInfo.AuthCode != users.AuthCode_None && len(c.receivedBufChache) > AuthPacketMaxSize {
-		go c.Close()
+	if !c.isAuthed() && len(c.receivedBufChache) > AuthPacketMaxSize {
+		c.Close()
 	} else if len(c.receivedBufChache) >= Pkt_Data_Index {
 		for {
 			packet, found := ParseReceivedData(&(c.receivedBufChache))
 			if found {
 				packet.Conn = c
-				go c.handlePacketIn(packet)
+				// Queued by the reader itself, so packets keep their order
+				// and a full packet queue slows the reader down.
+				atomic.AddInt64(&pendingPackets, 1)
+				c.handlePacketIn(packet)
+				atomic.AddInt64(&pendingPackets, -1)
 			} else {
 				break
 			}
 		}
 	}
-
-	return
 }
 
-func (c *ClientConnection) listenBeforeAuth(quit chan bool) {
+func (c *ClientConnection) writeSocketLoop(quit chan bool) {
 	defer func() {
-		logs.Logger.Info("quit listenBeforeAuth user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+		close(c.writerDone)
+		logs.Logger.Info("quit writeSocketLoop user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
 	}()
-	timer := time.NewTimer(AuthDuration)
 	for {
 		select {
 		case <-quit:
-			logs.Logger.Info("kill listenBeforeAuth user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			return
-		case <-c.authed:
-			go c.listenAfterAuth(quit)
-			logs.Logger.Info("quit listenBeforeAuth when authed user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+			logs.Logger.Info("kill writeSocketLoop user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+			c.writeItems(time.Now().Add(FlushDuration))
 			return
-		case <-timer.C:
-			logs.Logger.Info("Auth timeout addr: ", c.conn.RemoteAddr())
-			go c.Close()
+		case <-c.done:
 			return
-		default:
-			_, err := c.readSocket()
-			if err == io.EOF {
-				logs.Logger.Info("quit listenBeforeAuth when read error: ", err, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-				return
-			}
+		case <-c.writeQueue.signal:
+			c.writeItems(time.Time{})
 		}
 	}
 }
 
-func (c *ClientConnection) listenAfterAuth(quit chan bool) {
-	defer func() {
-		logs.Logger.Info("quit listenAfterAuth user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-	}()
-	timer := time.NewTimer(KeepAliveDuration)
-	for {
-		select {
-		case <-quit:
-			logs.Logger.Info("kill listenAfterAuth user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			return
-		case <-timer.C:
-			logs.Logger.Info("keepalive timeout user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			go c.Close()
+// writeItems writes everything queued. Each write gets its own deadline
+// unless deadline is set, which then bounds all of them.
+func (c *ClientConnection) writeItems(deadline time.Time) {
+	for _, item := range c.writeQueue.popAll() {
+		if deadline.IsZero() {
+			c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		} else {
+			c.conn.SetWriteDeadline(deadline)
+		}
+		n, err := c.conn.Write(item.data)
+		if err != nil {
+			logs.Logger.Warn("write socket error: ", err, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+			c.Close()
 			return
-		default:
-			n, err := c.readSocket()
-			if err == nil && n > 0 {
-				timer.Reset(KeepAliveDuration)
-			} else if err == io.EOF {
-				logs.Logger.Info("quit listenAfterAuth when read error: ", err, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-				return
-			}
+		}
+		logs.Logger.Info("Wrote socket n = ", n, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
+		if item.written != nil {
+			atomic.AddInt64(&pendingCallbacks, 1)
+			go func(written func()) {
+				written()
+				atomic.AddInt64(&pendingCallbacks, -1)
+			}(item.written)
 		}
 	}
 }
 
-func (c *ClientConnection) writeSocketLoop(quit chan bool) {
-	defer func() {
-		logs.Logger.Info("quit writeSocketLoop user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-	}()
-	for {
-		select {
-		case <-quit:
-			logs.Logger.Info("kill writeSocketLoop user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			return
-		case data := <-c.WriteChan:
-			c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			n, err := c.conn.Write(data)
-			if err != nil {
-				logs.Logger.Warn("write socket error: ", err, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			} else if n != len(data) {
-				logs.Logger.Warn("wrote socket error: wrote n = ", n, " but datalen = ", len(data), " user:", c.AuthInfo.Account, " addr:", c.conn.RemoteAddr())
-			} else {
-				logs.Logger.Info("Wrote socket n = ", n, " user: ", c.AuthInfo.Account, " addr: ", c.conn.RemoteAddr())
-			}
-		}
+// setReadDeadline moves the read deadline unless StopReading already cut the
+// reader off.
+func (c *ClientConnection) setReadDeadline(t time.Time) {
+	c.readLock.Lock()
+	if !c.draining {
+		c.conn.SetReadDeadline(t)
 	}
+	c.readLock.Unlock()
+}
+
+func (c *ClientConnection) isDraining() bool {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	return c.draining
+}
+
+// stopReading unblocks the reader and makes it quit without closing the
+// connection, so responses can still be written.
+func (c *ClientConnection) stopReading() {
+	c.readLock.Lock()
+	c.draining = true
+	c.conn.SetReadDeadline(time.Now())
+	c.readLock.Unlock()
 }
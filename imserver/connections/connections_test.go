@@ -0,0 +1,81 @@
+package connections
+
+import (
+	"hug/logs"
+	"net"
+	"testing"
+	"time"
+)
+
+func init() {
+	logs.DisableLog()
+}
+
+func TestConnectionClosedByPeer(t *testing.T) {
+	server, client := net.Pipe()
+	c := New(server, make(chan Packet, 1))
+	client.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not shut down after peer closed")
+	}
+}
+
+func TestConnectionCloseTwice(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := New(server, make(chan Packet, 1))
+	c.Close()
+	c.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not shut down after Close")
+	}
+	if _, err := client.Write([]byte{Pkt_STX}); err == nil {
+		t.Error("socket still open after Close")
+	}
+}
+
+func TestConnectionReadsPacket(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	packetChan := make(chan Packet, 1)
+	c := New(server, packetChan)
+	defer c.Close()
+	buf, _ := PrepareSendPacket(1, Pkt_Type_Request, 0, 9, []byte("{}"))
+	go client.Write(buf)
+	select {
+	case pkt := <-packetChan:
+		if pkt.Sid != 9 || pkt.Conn != c {
+			t.Errorf("got sid %d conn %p", pkt.Sid, pkt.Conn)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("packet not received")
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	c := &ClientConnection{}
+	if c.Pong(1) {
+		t.Error("pong accepted without ping")
+	}
+	c.StartPing(7)
+	time.Sleep(10 * time.Millisecond)
+	if c.Pong(8) {
+		t.Error("pong accepted with wrong sid")
+	}
+	if !c.IsPingPending(7) {
+		t.Error("ping should still be pending")
+	}
+	if !c.Pong(7) {
+		t.Error("pong not accepted")
+	}
+	if c.IsPingPending(7) {
+		t.Error("ping still pending after pong")
+	}
+	if c.RTT() < 10*time.Millisecond {
+		t.Errorf("got rtt %v", c.RTT())
+	}
+}
@@ -0,0 +1,85 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package connections
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	idleBenchConns    = 2000
+	idleBenchDuration = 500 * time.Millisecond
+)
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkIdle opens idleBenchConns connections, keeps them idle and reports
+// the process CPU time spent per second of idling.
+func benchmarkIdle(b *testing.B, open func(server net.Conn) (closeConn func())) {
+	clients := make([]net.Conn, 0, idleBenchConns)
+	closers := make([]func(), 0, idleBenchConns)
+	for i := 0; i < idleBenchConns; i++ {
+		server, client := net.Pipe()
+		clients = append(clients, client)
+		closers = append(closers, open(server))
+	}
+	defer func() {
+		for i := range clients {
+			closers[i]()
+			clients[i].Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	b.ResetTimer()
+	var cpu time.Duration
+	for i := 0; i < b.N; i++ {
+		start := cpuTime()
+		time.Sleep(idleBenchDuration)
+		cpu += cpuTime() - start
+	}
+	b.StopTimer()
+	cpuPerSecond := float64(cpu) / float64(time.Millisecond) / (float64(b.N) * idleBenchDuration.Seconds())
+	b.ReportMetric(cpuPerSecond, "cpu-ms/idle-s")
+}
+
+func BenchmarkIdleConnections(b *testing.B) {
+	benchmarkIdle(b, func(server net.Conn) func() {
+		c := New(server, make(chan Packet, 1))
+		// Keep the connection past the auth deadline for the whole run.
+		atomic.StoreInt32(&c.authed, 1)
+		server.SetReadDeadline(time.Now().Add(KeepAliveDuration))
+		return c.Close
+	})
+}
+
+// BenchmarkIdlePollingConnections reproduces the previous reader, which
+// polled the socket with a 50 ms read deadline, for comparison.
+func BenchmarkIdlePollingConnections(b *testing.B) {
+	benchmarkIdle(b, func(server net.Conn) func() {
+		quit := make(chan bool)
+		go func() {
+			buf := make([]byte, 256)
+			for {
+				select {
+				case <-quit:
+					server.Close()
+					return
+				default:
+					server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+					server.Read(buf)
+				}
+			}
+		}()
+		return func() { close(quit) }
+	})
+}
@@ -1,7 +1,11 @@
 package connections
 
 import (
+	"bytes"
+	"compress/flate"
 	"errors"
+	"io"
+	"io/ioutil"
 	"math/rand"
 )
 
@@ -18,6 +22,38 @@ const (
 	Pkt_Type_Error
 )
 
+// Codes of Pkt_Type_Error packets. An error packet answers a request with
+// the cmd and sid of the request, in place of its response.
+const (
+	PktErr_None int8 = iota
+	PktErr_TooManyConnections
+	PktErr_TooManyAuthAttempts
+	PktErr_RateLimited
+	// The request data could not be decoded, or it lists more ids than one
+	// request may.
+	PktErr_BadRequest
+	PktErr_UnknownCmd
+	// The cmd is not accepted before a successful Cmd_Auth.
+	PktErr_NotAuthorized
+	// The cmd needs a capability not negotiated during Cmd_Auth.
+	PktErr_NotNegotiated
+	// The handler failed unexpectedly.
+	PktErr_Internal
+	// The signed in user may not make the request.
+	PktErr_Forbidden
+	// Too many packets of the connection wait to be handled.
+	PktErr_Busy
+)
+
+// Pkt_Flag_Compressed is set in the type byte when the packet data is
+// deflated. It is only sent to peers which negotiated compression.
+const (
+	Pkt_Flag_Compressed uint8 = 0x80
+	Pkt_Type_Mask       uint8 = 0x7F
+)
+
+const Pkt_Compress_Threshold = 1024
+
 const (
 	Pkt_Encrypt_Seed uint8  = 0xA5
 	Pkt_Max_Data_Len uint32 = 0xFFFFFF
@@ -56,7 +92,7 @@ func UnStreamPacket(buf []byte) (packet Packet, err error) {
 		buf[i] = buf[i] ^ decryptKey
 	}
 	packet.Cmd = buf[Pkt_Cmd_INdex]
-	packet.PktType = buf[Pkt_Type_Index]
+	packet.PktType = buf[Pkt_Type_Index] & Pkt_Type_Mask
 	packet.Code = int8(buf[Pkt_Code_Index])
 	packet.Sid = uint16(buf[Pkt_Sid_Index1])
 	packet.Sid = packet.Sid << 8
@@ -64,6 +100,40 @@ func UnStreamPacket(buf []byte) (packet Packet, err error) {
 	if len(buf) > Pkt_Data_Index {
 		packet.Data = buf[Pkt_Data_Index:]
 	}
+	if buf[Pkt_Type_Index]&Pkt_Flag_Compressed != 0 {
+		packet.Data, err = decompressData(packet.Data)
+	}
+	return
+}
+
+func compressData(data []byte) (compressed []byte, err error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	compressed = b.Bytes()
+	return
+}
+
+func decompressData(data []byte) (decompressed []byte, err error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	decompressed, err = ioutil.ReadAll(io.LimitReader(r, int64(Pkt_Max_Data_Len)+1))
+	if err != nil {
+		return
+	}
+	if len(decompressed) > int(Pkt_Max_Data_Len) {
+		err = errors.New("Decompressed data too large")
+	}
 	return
 }
 
@@ -85,6 +155,22 @@ func StreamPacket(cmd uint8, pktType uint8, code int8, sid uint16, data []byte)
 	return
 }
 
+// StreamCompressedPacket works like StreamPacket, but deflates data that is
+// at least Pkt_Compress_Threshold bytes long if that makes it smaller.
+func StreamCompressedPacket(cmd uint8, pktType uint8, code int8, sid uint16, data []byte) (buf []byte, err error) {
+	if len(data) < Pkt_Compress_Threshold {
+		return StreamPacket(cmd, pktType, code, sid, data)
+	}
+	compressed, err := compressData(data)
+	if err != nil {
+		return
+	}
+	if len(compressed) >= len(data) {
+		return StreamPacket(cmd, pktType, code, sid, data)
+	}
+	return StreamPacket(cmd, pktType|Pkt_Flag_Compressed, code, sid, compressed)
+}
+
 func PrepareSendPacket(cmd uint8, pktType uint8, code int8, sid uint16, data []byte) (buf []byte, err error) {
 	buf, err = StreamPacket(cmd, pktType, code, sid, data)
 	if err != nil {
@@ -182,3 +268,22 @@ STARTFIND:
 	return
 
 }
+
+// RedactedCmds are the cmds whose data holds credentials, such as passwords
+// and session tokens, in requests or responses. Their data is never logged.
+var RedactedCmds = make(map[uint8]bool)
+
+// MaxLoggedData is how many bytes of packet data are logged at most.
+const MaxLoggedData = 512
+
+// LoggedData returns data of a packet of cmd as it may be logged: left out
+// for RedactedCmds and cut after MaxLoggedData.
+func LoggedData(cmd uint8, data []byte) string {
+	if RedactedCmds[cmd] {
+		return "<redacted>"
+	}
+	if len(data) > MaxLoggedData {
+		return string(data[:MaxLoggedData]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,96 @@
+package connections
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func roundTrip(t *testing.T, buf []byte) (packet Packet) {
+	sendBuf, err := PrepareSendData(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, found := ParseReceivedData(&sendBuf)
+	if !found {
+		t.Fatal("packet not found")
+	}
+	if len(sendBuf) != 0 {
+		t.Fatalf("%d bytes left after parsing", len(sendBuf))
+	}
+	return
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	data := []byte{'{', Pkt_STX, Pkt_DLE, Pkt_ETX, '}'}
+	buf, err := StreamPacket(0x10, Pkt_Type_Request, -1, 0xABCD, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := roundTrip(t, buf)
+	if packet.Cmd != 0x10 || packet.PktType != Pkt_Type_Request || packet.Code != -1 || packet.Sid != 0xABCD {
+		t.Errorf("got cmd 0x%02x type %d code %d sid 0x%04x", packet.Cmd, packet.PktType, packet.Code, packet.Sid)
+	}
+	if !bytes.Equal(packet.Data, data) {
+		t.Errorf("got data %v, expect %v", packet.Data, data)
+	}
+}
+
+func TestCompressedPacketRoundTrip(t *testing.T) {
+	data := []byte(`{"ms":[` + strings.Repeat(`{"ar":{"id":1,"t":1},"bd":[{"t":1,"d":"hello"}]},`, 100) + `{}]}`)
+	buf, err := StreamCompressedPacket(0x31, Pkt_Type_Response, 0, 7, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainBuf, err := StreamPacket(0x31, Pkt_Type_Response, 0, 7, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) >= len(plainBuf) {
+		t.Errorf("compressed packet is %d bytes, plain packet is %d bytes", len(buf), len(plainBuf))
+	}
+	packet := roundTrip(t, buf)
+	if packet.Cmd != 0x31 || packet.PktType != Pkt_Type_Response || packet.Sid != 7 {
+		t.Errorf("got cmd 0x%02x type %d sid %d", packet.Cmd, packet.PktType, packet.Sid)
+	}
+	if !bytes.Equal(packet.Data, data) {
+		t.Errorf("decompressed data does not match")
+	}
+}
+
+func TestCompressedPacketBelowThreshold(t *testing.T) {
+	data := []byte(`{"c":0}`)
+	buf, err := StreamCompressedPacket(0x01, Pkt_Type_Response, 0, 1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := buf[Pkt_Key_Index] ^ Pkt_Encrypt_Seed
+	if (buf[Pkt_Type_Index]^key)&Pkt_Flag_Compressed != 0 {
+		t.Errorf("small packet should not be compressed")
+	}
+	packet := roundTrip(t, buf)
+	if !bytes.Equal(packet.Data, data) {
+		t.Errorf("got data %s, expect %s", packet.Data, data)
+	}
+}
+
+func TestInvalidCompressedPacketDropped(t *testing.T) {
+	buf, err := StreamPacket(0x10, Pkt_Type_Request|Pkt_Flag_Compressed, 0, 1, []byte("not deflated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := StreamPacket(0x11, Pkt_Type_Request, 0, 2, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendBuf, _ := PrepareSendData(buf)
+	nextBuf, _ := PrepareSendData(next)
+	sendBuf = append(sendBuf, nextBuf...)
+	packet, found := ParseReceivedData(&sendBuf)
+	if !found {
+		t.Fatal("packet not found")
+	}
+	if packet.Cmd != 0x11 || packet.Sid != 2 {
+		t.Errorf("got cmd 0x%02x sid %d, expect the packet after the invalid one", packet.Cmd, packet.Sid)
+	}
+}
@@ -1,39 +1,230 @@
 package connections
 
 import (
+	"hug/imserver/cluster"
 	"hug/logs"
+	"sort"
 	"sync"
+	"time"
 )
 
+// Presence holds the sessions of a user connected to this node, oldest
+// first. Only manageLoop changes it, under presencesLock; other goroutines
+// get a copy from FindPresences.
 type Presence struct {
-	Terminals map[int16](*ClientConnection)
+	Sessions []*ClientConnection
+}
+
+// Session returns the connection of sessionId, or nil.
+func (p *Presence) Session(sessionId int64) *ClientConnection {
+	for _, c := range p.Sessions {
+		if c.AuthInfo.SessionId == sessionId {
+			return c
+		}
+	}
+	return nil
+}
+
+// TerminalSessions returns the sessions of terminalType, oldest first.
+func (p *Presence) TerminalSessions(terminalType int16) (conns []*ClientConnection) {
+	for _, c := range p.Sessions {
+		if c.AuthInfo.TerminalType == terminalType {
+			conns = append(conns, c)
+		}
+	}
+	return
+}
+
+func (p *Presence) remove(conn *ClientConnection) {
+	sessions := make([]*ClientConnection, 0, len(p.Sessions))
+	for _, c := range p.Sessions {
+		if c != conn {
+			sessions = append(sessions, c)
+		}
+	}
+	presencesLock.Lock()
+	p.Sessions = sessions
+	presencesLock.Unlock()
+}
+
+// LastSeen returns the latest time data was received from any session.
+func (p *Presence) LastSeen() (lastSeen time.Time) {
+	for _, c := range p.Sessions {
+		if t := c.LastSeen(); t.After(lastSeen) {
+			lastSeen = t
+		}
+	}
+	return
+}
+
+// RTTs returns the last measured round trip time of every session.
+func (p *Presence) RTTs() (rtts map[int64]time.Duration) {
+	rtts = make(map[int64]time.Duration, len(p.Sessions))
+	for _, c := range p.Sessions {
+		rtts[c.AuthInfo.SessionId] = c.RTT()
+	}
+	return
+}
+
+// RemoteConflict is a session connected to Node which was evicted by a newer
+// session of Uid signed in on this node.
+type RemoteConflict struct {
+	Node      string
+	Uid       int64
+	SessionId int64
 }
 
 var presences map[int64](*Presence)
 var NewPresenceChan chan *ClientConnection
 var KilledPresenceChan chan *ClientConnection
 var ConflictConnChan chan *ClientConnection
+var RemoteConflictChan chan RemoteConflict
+
+// PresenceChangedChan is signalled when users came online, went offline or
+// changed sessions on this node. TakePresenceChanges returns them.
+var PresenceChangedChan chan bool
+var presenceChangesLock sync.Mutex
+var presenceChanges map[int64]bool
 var presencesLock sync.RWMutex
 
+// evictedSession is a session of this node the registry evicted for a newer
+// one, which manageLoop closes.
+type evictedSession struct {
+	uid       int64
+	sessionId int64
+}
+
+var evictedSessionChan chan evictedSession
+var reregisterChan chan bool
+var heartbeatStop chan bool
+
+// registryTasks runs the calls changing Registry one at a time and in order,
+// so that manageLoop never waits for a remote registry.
+var registryTasks = &taskQueue{wake: make(chan bool, 1)}
+
+type taskQueue struct {
+	lock  sync.Mutex
+	tasks []func()
+	wake  chan bool
+}
+
+func (q *taskQueue) push(task func()) {
+	q.lock.Lock()
+	q.tasks = append(q.tasks, task)
+	q.lock.Unlock()
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// runPending runs the queued tasks until there is none left.
+func (q *taskQueue) runPending() {
+	for {
+		q.lock.Lock()
+		if len(q.tasks) == 0 {
+			q.lock.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		q.lock.Unlock()
+		task()
+	}
+}
+
+func (q *taskQueue) loop() {
+	for range q.wake {
+		q.runPending()
+	}
+}
+
+// Registry shares the presences of all nodes and LocalNode names this node
+// in it. They are set before StartManagePresences when running in a cluster.
+var (
+	Registry  cluster.PresenceRegistry = cluster.NewMemoryRegistry()
+	LocalNode                          = "local"
+)
+
 func StartManagePresences() {
 	presences = make(map[int64](*Presence))
 	NewPresenceChan = make(chan *ClientConnection, 128)
 	KilledPresenceChan = make(chan *ClientConnection, 128)
 	ConflictConnChan = make(chan *ClientConnection, 16)
+	RemoteConflictChan = make(chan RemoteConflict, 16)
+	PresenceChangedChan = make(chan bool, 1)
+	presenceChanges = make(map[int64]bool)
+	evictedSessionChan = make(chan evictedSession, 16)
+	reregisterChan = make(chan bool, 1)
+	heartbeatStop = make(chan bool)
+	err := Registry.UnregisterNode(LocalNode)
+	if err != nil {
+		logs.Logger.Critical("clear presences of node ", LocalNode, " error: ", err)
+	}
+	_, err = Registry.Heartbeat(LocalNode)
+	if err != nil {
+		logs.Logger.Warn("registry heartbeat error: ", err)
+	}
+	go registryTasks.loop()
 	go manageLoop()
+	go heartbeatLoop(heartbeatStop)
+}
+
+// StopPresences stops the heartbeats and removes the sessions of this node
+// from Registry after the calls already queued, waiting at most timeout.
+func StopPresences(timeout time.Duration) {
+	close(heartbeatStop)
+	done := make(chan error, 1)
+	registryTasks.push(func() { done <- Registry.UnregisterNode(LocalNode) })
+	select {
+	case err := <-done:
+		if err != nil {
+			logs.Logger.Warn("clear presences of node ", LocalNode, " error: ", err)
+		}
+	case <-time.After(timeout):
+		logs.Logger.Warn("clear presences of node ", LocalNode, " timeout")
+	}
+}
+
+// heartbeatLoop keeps the sessions of this node in Registry, and registers
+// them again if the registry expired them, after a network partition for
+// instance.
+func heartbeatLoop(stop chan bool) {
+	ticker := time.NewTicker(cluster.NodeTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		known, err := Registry.Heartbeat(LocalNode)
+		if err != nil {
+			logs.Logger.Warn("registry heartbeat error: ", err)
+			continue
+		}
+		if !known {
+			logs.Logger.Warn("registry lost the sessions of node ", LocalNode, ", register them again")
+			select {
+			case reregisterChan <- true:
+			default:
+			}
+		}
+	}
 }
 
 func newPresence(uid int64) (p *Presence) {
 	logs.Logger.Info("new presence uid = ", uid)
-	p = &Presence{
-		Terminals: make(map[int16](*ClientConnection)),
-	}
-	presencesLock.RLock()
+	p = &Presence{}
+	presencesLock.Lock()
 	presences[uid] = p
-	presencesLock.RUnlock()
+	presencesLock.Unlock()
 	return
 }
 
+// getPresence returns the presence of uid, created if needed. Like
+// findPresence, it is only called by manageLoop.
 func getPresence(uid int64) (p *Presence) {
 	p, ok := presences[uid]
 	if ok == false {
@@ -49,41 +240,201 @@ func manageLoop() {
 			insertNewConnection(c)
 		case c := <-KilledPresenceChan:
 			removeKilledConnection(c)
+		case e := <-evictedSessionChan:
+			closeEvictedSession(e.uid, e.sessionId)
+		case <-reregisterChan:
+			for _, p := range presences {
+				for _, c := range p.Sessions {
+					registerSession(c)
+				}
+			}
 		}
 	}
 }
 
 func removeKilledConnection(conn *ClientConnection) {
-	p := FindPresences(conn.AuthInfo.Uid)
+	p := findPresence(conn.AuthInfo.Uid)
 	if p != nil {
-		c, exist := p.Terminals[conn.AuthInfo.TerminalType]
-		if exist && c.Identifier == conn.Identifier {
+		if p.Session(conn.AuthInfo.SessionId) == conn {
 			logs.Logger.Info("remove killed conn", " addr:", conn.RemoteAddr(), " info:", conn.AuthInfo.String())
-			presencesLock.RLock()
-			delete(p.Terminals, conn.AuthInfo.TerminalType)
-			presencesLock.RUnlock()
+			p.remove(conn)
+			uid, sessionId, info := conn.AuthInfo.Uid, conn.AuthInfo.SessionId, conn.AuthInfo.String()
+			registryTasks.push(func() {
+				err := Registry.Unregister(uid, sessionId)
+				if err != nil {
+					logs.Logger.Critical("unregister presence error: ", err, " info:", info)
+				}
+			})
+			presenceChanged(conn.AuthInfo.Uid)
 		}
-		if len(p.Terminals) == 0 {
-			presencesLock.RLock()
+		if len(p.Sessions) == 0 {
+			presencesLock.Lock()
 			delete(presences, conn.AuthInfo.Uid)
-			presencesLock.RUnlock()
+			presencesLock.Unlock()
 		}
 	}
 }
 
+// insertNewConnection adds the session of conn. Sessions of the same
+// terminal type beyond conn.AuthInfo.MaxSessions are closed, oldest first:
+// at once on this node, and on whichever node they are connected to once
+// the registry answers.
 func insertNewConnection(conn *ClientConnection) {
 	logs.Logger.Info("insert new conn.", " addr:", conn.RemoteAddr(), " info:", conn.AuthInfo.String())
 	presence := getPresence(conn.AuthInfo.Uid)
-	oldConn, ok := presence.Terminals[conn.AuthInfo.TerminalType]
-	presence.Terminals[conn.AuthInfo.TerminalType] = conn
-	if ok {
-		logs.Logger.Info("Connection Conflict.", " user:", conn.AuthInfo.Account, " addr:", conn.RemoteAddr())
+	sessions := append(append(make([]*ClientConnection, 0, len(presence.Sessions)+1), presence.Sessions...), conn)
+	presencesLock.Lock()
+	presence.Sessions = sessions
+	presencesLock.Unlock()
+	_, evicted := cluster.EvictSessions(localSessions(presence), conn.AuthInfo.TerminalType, conn.AuthInfo.MaxSessions)
+	for _, s := range evicted {
+		closeEvictedSession(conn.AuthInfo.Uid, s.Id)
+	}
+	registerSession(conn)
+	presenceChanged(conn.AuthInfo.Uid)
+}
+
+// registerSession queues the registration of the session of conn. Evicted
+// sessions of this node are sent back to manageLoop, those of other nodes
+// to RemoteConflictChan.
+func registerSession(conn *ClientConnection) {
+	uid, maxSessions, info := conn.AuthInfo.Uid, conn.AuthInfo.MaxSessions, conn.AuthInfo.String()
+	session := cluster.Session{
+		Id:              conn.AuthInfo.SessionId,
+		TerminalType:    conn.AuthInfo.TerminalType,
+		TerminalSystem:  conn.AuthInfo.TerminalSystem,
+		TerminalVersion: conn.AuthInfo.TerminalVersion,
+		RemoteAddr:      conn.RemoteAddr().String(),
+		SignInTime:      conn.AuthInfo.SignInTime,
+		Node:            LocalNode,
+	}
+	registryTasks.push(func() {
+		evicted, err := Registry.Register(uid, session, maxSessions)
+		if err != nil {
+			logs.Logger.Critical("register presence error: ", err, " info:", info)
+			return
+		}
+		for _, s := range evicted {
+			if s.Node != LocalNode {
+				logs.Logger.Info("Connection Conflict on node ", s.Node, " info:", info)
+				RemoteConflictChan <- RemoteConflict{Node: s.Node, Uid: uid, SessionId: s.Id}
+				continue
+			}
+			evictedSessionChan <- evictedSession{uid: uid, sessionId: s.Id}
+		}
+	})
+}
+
+// closeEvictedSession closes the session sessionId of uid if it is still
+// connected to this node.
+func closeEvictedSession(uid, sessionId int64) {
+	presence := findPresence(uid)
+	if presence == nil {
+		return
+	}
+	if oldConn := presence.Session(sessionId); oldConn != nil {
+		logs.Logger.Info("Connection Conflict.", " user:", oldConn.AuthInfo.Account, " addr:", oldConn.RemoteAddr())
+		presence.remove(oldConn)
 		ConflictConnChan <- oldConn
 	}
+}
+
+// presenceChanged records that the presence of uid changed without waiting
+// for the notifications: changes of the same uid not yet taken are sent once.
+func presenceChanged(uid int64) {
+	presenceChangesLock.Lock()
+	presenceChanges[uid] = true
+	presenceChangesLock.Unlock()
+	select {
+	case PresenceChangedChan <- true:
+	default:
+	}
+}
+
+// TakePresenceChanges returns up to max uids whose presence changed since
+// they were last taken, signalling PresenceChangedChan again if more remain.
+func TakePresenceChanges(max int) (uids []int64) {
+	presenceChangesLock.Lock()
+	defer presenceChangesLock.Unlock()
+	for uid := range presenceChanges {
+		if len(uids) == max {
+			select {
+			case PresenceChangedChan <- true:
+			default:
+			}
+			return
+		}
+		uids = append(uids, uid)
+		delete(presenceChanges, uid)
+	}
+	return
+}
 
+func localSessions(p *Presence) (sessions []cluster.Session) {
+	sessions = make([]cluster.Session, 0, len(p.Sessions))
+	for _, c := range p.Sessions {
+		sessions = append(sessions, cluster.Session{Id: c.AuthInfo.SessionId, TerminalType: c.AuthInfo.TerminalType, Node: LocalNode})
+	}
+	return
 }
 
+// LookupTerminals returns the terminal types uid is online with on any node.
+func LookupTerminals(uid int64) (terminals []int16) {
+	sessions, err := Registry.Lookup(uid)
+	if err != nil {
+		logs.Logger.Critical("lookup presence error: ", err, " uid:", uid)
+	}
+	seen := make(map[int16]bool, len(sessions))
+	terminals = make([]int16, 0, len(sessions))
+	for _, s := range sessions {
+		if !seen[s.TerminalType] {
+			seen[s.TerminalType] = true
+			terminals = append(terminals, s.TerminalType)
+		}
+	}
+	sort.Slice(terminals, func(i, j int) bool { return terminals[i] < terminals[j] })
+	return
+}
+
+// LookupSessions returns every session of uid on any node, oldest first.
+func LookupSessions(uid int64) (sessions []cluster.Session) {
+	sessions, err := Registry.Lookup(uid)
+	if err != nil {
+		logs.Logger.Critical("lookup presence error: ", err, " uid:", uid)
+	}
+	return
+}
+
+// FindRemoteSessions returns the sessions of uid connected to other nodes.
+func FindRemoteSessions(uid int64) (sessions []cluster.Session) {
+	all, err := Registry.Lookup(uid)
+	if err != nil {
+		logs.Logger.Critical("lookup presence error: ", err, " uid:", uid)
+	}
+	for _, s := range all {
+		if s.Node != LocalNode {
+			sessions = append(sessions, s)
+		}
+	}
+	return
+}
+
+// FindPresences returns a copy of the presence of uid, or nil if uid has no
+// session on this node.
 func FindPresences(uid int64) (p *Presence) {
+	presencesLock.RLock()
+	defer presencesLock.RUnlock()
+	live, ok := presences[uid]
+	if !ok {
+		return
+	}
+	p = &Presence{Sessions: make([]*ClientConnection, len(live.Sessions))}
+	copy(p.Sessions, live.Sessions)
+	return
+}
+
+// findPresence returns the presence of uid manageLoop changes, or nil.
+func findPresence(uid int64) (p *Presence) {
 	p, ok := presences[uid]
 	if ok == false {
 		p = nil
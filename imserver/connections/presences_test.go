@@ -0,0 +1,175 @@
+package connections
+
+import (
+	"hug/core/users"
+	"hug/imserver/cluster"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLookupTerminals(t *testing.T) {
+	defer func(r cluster.PresenceRegistry) { Registry = r }(Registry)
+	Registry = cluster.NewMemoryRegistry()
+	Registry.Register(5, cluster.Session{Id: 1, TerminalType: 3, Node: LocalNode}, 0)
+	Registry.Register(5, cluster.Session{Id: 2, TerminalType: 1, Node: "other"}, 0)
+	Registry.Register(5, cluster.Session{Id: 3, TerminalType: 3, Node: "other"}, 0)
+
+	if terminals := LookupTerminals(5); !reflect.DeepEqual(terminals, []int16{1, 3}) {
+		t.Errorf("got terminals %v", terminals)
+	}
+	remote := []cluster.Session{{Id: 2, TerminalType: 1, Node: "other"}, {Id: 3, TerminalType: 3, Node: "other"}}
+	if sessions := FindRemoteSessions(5); !reflect.DeepEqual(sessions, remote) {
+		t.Errorf("got remote sessions %v", sessions)
+	}
+	if terminals := LookupTerminals(6); len(terminals) != 0 {
+		t.Errorf("offline user got terminals %v", terminals)
+	}
+}
+
+func TestSubscribePresences(t *testing.T) {
+	c := &ClientConnection{}
+	if c.IsPresenceSubscribed() {
+		t.Error("subscribed by default")
+	}
+	c.SubscribePresences(true)
+	if !c.IsPresenceSubscribed() {
+		t.Error("not subscribed")
+	}
+	c.SubscribePresences(false)
+	if c.IsPresenceSubscribed() {
+		t.Error("still subscribed")
+	}
+}
+
+func TestPresenceChangesCoalesced(t *testing.T) {
+	PresenceChangedChan = make(chan bool, 1)
+	presenceChanges = make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		presenceChanged(int64(i % 3))
+	}
+	<-PresenceChangedChan
+	uids := TakePresenceChanges(2)
+	if len(uids) != 2 || len(PresenceChangedChan) != 1 {
+		t.Fatalf("took %v, expect 2 uids and a signal for the last one", uids)
+	}
+	<-PresenceChangedChan
+	uids = append(uids, TakePresenceChanges(2)...)
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if !reflect.DeepEqual(uids, []int64{0, 1, 2}) || len(PresenceChangedChan) != 0 {
+		t.Fatalf("took %v, expect every uid once", uids)
+	}
+}
+
+func TestInsertSessionsEvictsOldest(t *testing.T) {
+	defer func(r cluster.PresenceRegistry) { Registry = r }(Registry)
+	Registry = cluster.NewMemoryRegistry()
+	presences = make(map[int64](*Presence))
+	ConflictConnChan = make(chan *ClientConnection, 4)
+	RemoteConflictChan = make(chan RemoteConflict, 4)
+	PresenceChangedChan = make(chan bool, 1)
+	presenceChanges = make(map[int64]bool)
+	evictedSessionChan = make(chan evictedSession, 4)
+	Registry.Register(5, cluster.Session{Id: 1, TerminalType: 1, Node: "other"}, 0)
+
+	newSession := func(id int64, terminalType int16) *ClientConnection {
+		conn, _ := net.Pipe()
+		return &ClientConnection{conn: conn, AuthInfo: users.AuthInfo{Uid: 5, SessionId: id, TerminalType: terminalType, MaxSessions: 2}}
+	}
+	a, b, c, mobile := newSession(2, 1), newSession(3, 1), newSession(4, 1), newSession(5, 2)
+	insertNewConnection(a)
+	insertNewConnection(mobile)
+	insertNewConnection(b)
+	if len(RemoteConflictChan) != 0 {
+		t.Fatal("registry called from the presence loop")
+	}
+	registryTasks.runPending()
+	if conflict := <-RemoteConflictChan; conflict != (RemoteConflict{Node: "other", Uid: 5, SessionId: 1}) {
+		t.Fatalf("got remote conflict %+v", conflict)
+	}
+	// Sessions of this node are evicted without waiting for the registry.
+	insertNewConnection(c)
+	if conn := <-ConflictConnChan; conn != a {
+		t.Fatalf("evicted session %d, expect 2", conn.AuthInfo.SessionId)
+	}
+	registryTasks.runPending()
+	if e := <-evictedSessionChan; e != (evictedSession{uid: 5, sessionId: 2}) {
+		t.Fatalf("registry evicted %+v, expect session 2", e)
+	}
+	closeEvictedSession(5, 2)
+	p := FindPresences(5)
+	if sessions := p.TerminalSessions(1); len(sessions) != 2 || sessions[0] != b || sessions[1] != c {
+		t.Fatalf("got sessions %v", sessions)
+	}
+	if p.Session(5) != mobile {
+		t.Fatal("other terminal type was evicted")
+	}
+
+	// With a newer remote session, the registry also evicts c, which this
+	// node alone kept.
+	Registry.Register(5, cluster.Session{Id: 6, TerminalType: 1, Node: "other"}, 0)
+	d := newSession(7, 1)
+	insertNewConnection(d)
+	if conn := <-ConflictConnChan; conn != b {
+		t.Fatalf("evicted session %d, expect 3", conn.AuthInfo.SessionId)
+	}
+	registryTasks.runPending()
+	for _, id := range []int64{3, 4} {
+		if e := <-evictedSessionChan; e != (evictedSession{uid: 5, sessionId: id}) {
+			t.Fatalf("registry evicted %+v, expect session %d", e, id)
+		}
+		closeEvictedSession(5, id)
+	}
+	if len(RemoteConflictChan) != 0 {
+		t.Fatal("newest remote session evicted")
+	}
+	if conn := <-ConflictConnChan; conn != c {
+		t.Fatalf("evicted session %d, expect 4", conn.AuthInfo.SessionId)
+	}
+
+	// The evicted sessions closing must not remove the others.
+	removeKilledConnection(a)
+	removeKilledConnection(b)
+	removeKilledConnection(c)
+	registryTasks.runPending()
+	if p = FindPresences(5); len(p.Sessions) != 2 || p.Session(7) != d {
+		t.Fatalf("after remove got %d sessions", len(p.Sessions))
+	}
+	if sessions := LookupSessions(5); len(sessions) != 3 || sessions[2].Id != 7 || sessions[2].RemoteAddr != "pipe" || sessions[2].Node != LocalNode {
+		t.Fatalf("registry got %v", sessions)
+	}
+}
+
+func TestFindPresencesWhileChanging(t *testing.T) {
+	defer func(r cluster.PresenceRegistry) { Registry = r }(Registry)
+	Registry = cluster.NewMemoryRegistry()
+	presences = make(map[int64](*Presence))
+	ConflictConnChan = make(chan *ClientConnection, 64)
+	RemoteConflictChan = make(chan RemoteConflict, 64)
+	PresenceChangedChan = make(chan bool, 1)
+	presenceChanges = make(map[int64]bool)
+	evictedSessionChan = make(chan evictedSession, 64)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if p := FindPresences(9); p != nil {
+				p.TerminalSessions(1)
+				p.Session(1)
+			}
+		}
+	}()
+	for i := int64(1); i <= 100; i++ {
+		conn, _ := net.Pipe()
+		c := &ClientConnection{conn: conn, AuthInfo: users.AuthInfo{Uid: 9, SessionId: i, TerminalType: 1}}
+		insertNewConnection(c)
+		removeKilledConnection(c)
+	}
+	<-done
+	registryTasks.runPending()
+	if p := FindPresences(9); p != nil {
+		t.Fatalf("got %d sessions after all closed", len(p.Sessions))
+	}
+}
@@ -0,0 +1,94 @@
+package connections
+
+import (
+	"hug/logs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	liveConnections     = make(map[*ClientConnection]bool)
+	liveConnectionsLock sync.Mutex
+	// pendingPackets counts packets parsed by readers but not yet queued.
+	pendingPackets int64
+	// pendingCallbacks counts written callbacks still running.
+	pendingCallbacks int64
+)
+
+func addLiveConnection(c *ClientConnection) {
+	liveConnectionsLock.Lock()
+	liveConnections[c] = true
+	liveConnectionsLock.Unlock()
+}
+
+func removeLiveConnection(c *ClientConnection) {
+	liveConnectionsLock.Lock()
+	delete(liveConnections, c)
+	liveConnectionsLock.Unlock()
+}
+
+// Connections returns every open connection, authed or not.
+func Connections() (conns []*ClientConnection) {
+	liveConnectionsLock.Lock()
+	conns = make([]*ClientConnection, 0, len(liveConnections))
+	for c := range liveConnections {
+		conns = append(conns, c)
+	}
+	liveConnectionsLock.Unlock()
+	return
+}
+
+// StopReading stops the readers of all connections and waits until the
+// packets they already parsed are in their packet queue. Connections stay
+// open for writing.
+func StopReading(timeout time.Duration) {
+	deadline := time.After(timeout)
+	conns := Connections()
+	for _, c := range conns {
+		c.stopReading()
+	}
+	for _, c := range conns {
+		select {
+		case <-c.readerDone:
+		case <-deadline:
+			logs.Logger.Warn("stop reading timeout, ", len(conns), " connections")
+			return
+		}
+	}
+	if !waitZero(&pendingPackets, deadline) {
+		logs.Logger.Warn("stop reading timeout, ", atomic.LoadInt64(&pendingPackets), " packets not queued")
+	}
+}
+
+// CloseAll closes all connections, flushing their write queues, and waits
+// until they are done and their written callbacks returned.
+func CloseAll(timeout time.Duration) {
+	deadline := time.After(timeout)
+	conns := Connections()
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, c := range conns {
+		select {
+		case <-c.Done():
+		case <-deadline:
+			logs.Logger.Warn("close connections timeout, ", len(Connections()), " connections left")
+			return
+		}
+	}
+	if !waitZero(&pendingCallbacks, deadline) {
+		logs.Logger.Warn("close connections timeout, ", atomic.LoadInt64(&pendingCallbacks), " written callbacks running")
+	}
+}
+
+func waitZero(counter *int64, deadline <-chan time.Time) bool {
+	for atomic.LoadInt64(counter) > 0 {
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package connections
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStopReadingAndCloseAllFlush(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	packetChan := make(chan Packet, 1)
+	c := New(server, packetChan)
+
+	buf, _ := PrepareSendPacket(1, Pkt_Type_Request, 0, 9, []byte("{}"))
+	if _, err := client.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	StopReading(3 * time.Second)
+	select {
+	case <-packetChan:
+	default:
+		t.Fatal("packet read before StopReading not queued")
+	}
+	select {
+	case <-c.Done():
+		t.Fatal("StopReading closed the connection")
+	default:
+	}
+
+	written := make(chan bool, 1)
+	err := c.WritePacketNotify(1, Pkt_Type_Response, 0, 9, []byte(`{"c":0}`), func() { written <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+	CloseAll(3 * time.Second)
+	select {
+	case <-written:
+	default:
+		t.Error("written callback not finished after CloseAll")
+	}
+	data := <-received
+	res, found := ParseReceivedData(&data)
+	if !found || res.Sid != 9 || res.PktType != Pkt_Type_Response {
+		t.Fatalf("queued response not flushed, got %v", res)
+	}
+	if len(Connections()) != 0 {
+		t.Errorf("%d connections left after CloseAll", len(Connections()))
+	}
+}
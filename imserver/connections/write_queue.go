@@ -0,0 +1,87 @@
+package connections
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Limits of the outbound queue of every connection. They can be changed by
+// the server configuration before any connection is accepted.
+var (
+	WriteQueueMaxPackets     = 256
+	WriteQueueMaxBytes       = 4 * 1024 * 1024
+	SlowConsumerMaxOverflows = 16
+)
+
+var ErrWriteQueueFull = errors.New("write queue full")
+
+var writeQueueOverflows uint64
+var slowConsumerDisconnects uint64
+
+// WriteQueueOverflows returns how many packets were refused because the
+// outbound queue of their connection was full.
+func WriteQueueOverflows() uint64 {
+	return atomic.LoadUint64(&writeQueueOverflows)
+}
+
+// SlowConsumerDisconnects returns how many connections were closed because
+// they did not read their data fast enough.
+func SlowConsumerDisconnects() uint64 {
+	return atomic.LoadUint64(&slowConsumerDisconnects)
+}
+
+type writeItem struct {
+	data    []byte
+	written func()
+}
+
+// writeQueue is the outbound queue of a connection, bounded by packet count
+// and bytes. overflows counts refused packets since the queue last drained.
+type writeQueue struct {
+	lock      sync.Mutex
+	items     []writeItem
+	bytes     int
+	overflows int
+	signal    chan bool
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{
+		items:  make([]writeItem, 0, 8),
+		signal: make(chan bool, 1),
+	}
+}
+
+// push queues item. slow is true once the queue overflowed
+// SlowConsumerMaxOverflows times without draining.
+func (q *writeQueue) push(item writeItem) (err error, slow bool) {
+	q.lock.Lock()
+	if len(q.items) >= WriteQueueMaxPackets || q.bytes+len(item.data) > WriteQueueMaxBytes {
+		q.overflows++
+		slow = q.overflows >= SlowConsumerMaxOverflows
+		q.lock.Unlock()
+		atomic.AddUint64(&writeQueueOverflows, 1)
+		err = ErrWriteQueueFull
+		return
+	}
+	q.items = append(q.items, item)
+	q.bytes += len(item.data)
+	q.lock.Unlock()
+
+	select {
+	case q.signal <- true:
+	default:
+	}
+	return
+}
+
+func (q *writeQueue) popAll() (items []writeItem) {
+	q.lock.Lock()
+	items = q.items
+	q.items = make([]writeItem, 0, 8)
+	q.bytes = 0
+	q.overflows = 0
+	q.lock.Unlock()
+	return
+}
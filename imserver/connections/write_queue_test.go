@@ -0,0 +1,95 @@
+package connections
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteQueueLimits(t *testing.T) {
+	q := newWriteQueue()
+	maxPackets, maxBytes := WriteQueueMaxPackets, WriteQueueMaxBytes
+	WriteQueueMaxPackets, WriteQueueMaxBytes = 2, 10
+	defer func() { WriteQueueMaxPackets, WriteQueueMaxBytes = maxPackets, maxBytes }()
+
+	if err, _ := q.push(writeItem{data: make([]byte, 6)}); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := q.push(writeItem{data: make([]byte, 6)}); err != ErrWriteQueueFull {
+		t.Errorf("byte limit not enforced: %v", err)
+	}
+	if err, _ := q.push(writeItem{data: make([]byte, 4)}); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := q.push(writeItem{data: make([]byte, 0)}); err != ErrWriteQueueFull {
+		t.Errorf("packet limit not enforced: %v", err)
+	}
+	if q.overflows != 2 {
+		t.Errorf("got %d overflows, expect 2", q.overflows)
+	}
+	if items := q.popAll(); len(items) != 2 {
+		t.Errorf("got %d items, expect 2", len(items))
+	}
+	if q.overflows != 0 || q.bytes != 0 {
+		t.Errorf("queue not reset after drain")
+	}
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	maxPackets, maxOverflows := WriteQueueMaxPackets, SlowConsumerMaxOverflows
+	WriteQueueMaxPackets, SlowConsumerMaxOverflows = 2, 3
+	defer func() { WriteQueueMaxPackets, SlowConsumerMaxOverflows = maxPackets, maxOverflows }()
+
+	// The client never reads, so the writer blocks on the first packet.
+	server, client := net.Pipe()
+	defer client.Close()
+	c := New(server, make(chan Packet, 1))
+	overflows := WriteQueueOverflows()
+	disconnects := SlowConsumerDisconnects()
+
+	written := make(chan bool, 16)
+	refused := 0
+	for i := 0; i < 16; i++ {
+		err := c.WritePacketNotify(0x10, Pkt_Type_Request, 0, uint16(i), []byte("{}"), func() { written <- true })
+		if err == ErrWriteQueueFull {
+			refused++
+		}
+	}
+	if refused == 0 {
+		t.Fatal("no packet refused")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow consumer not disconnected")
+	}
+	if WriteQueueOverflows()-overflows != uint64(refused) {
+		t.Errorf("got %d overflows, expect %d", WriteQueueOverflows()-overflows, refused)
+	}
+	if SlowConsumerDisconnects()-disconnects == 0 {
+		t.Errorf("disconnect not counted")
+	}
+	select {
+	case <-written:
+		t.Errorf("written called for data the client never read")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWrittenCallback(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := New(server, make(chan Packet, 1))
+	defer c.Close()
+	written := make(chan bool, 1)
+	err := c.WritePacketNotify(0x10, Pkt_Type_Request, 0, 1, []byte("{}"), func() { written <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Read(make([]byte, 256))
+	select {
+	case <-written:
+	case <-time.After(3 * time.Second):
+		t.Fatal("written not called")
+	}
+}
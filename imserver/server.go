@@ -1,45 +1,357 @@
 package imserver
 
 import (
+	"crypto/tls"
+	"fmt"
+	"hug/config"
+	"hug/core/users"
+	"hug/imserver/cluster"
 	"hug/imserver/cmdhandler"
 	"hug/imserver/connections"
 	"hug/logs"
+	"hug/utils"
+	"hug/webserver"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	TcpHostPort = "0.0.0.0:5222"
 )
 
+const imserverConfigFilename = "config_imserver.json"
+
+const (
+	// DrainDuration bounds each step of Stop.
+	DrainDuration = 10 * time.Second
+	// ReconnectSpread is the longest delay clients are told to wait before
+	// reconnecting when the server shuts down.
+	ReconnectSpread = 10 * time.Second
+)
+
+var (
+	listeners        []net.Listener
+	registryListener net.Listener
+	cmdhandlers      *cmdhandler.CmdHandlers
+	stopping         int32
+)
+
+// listenConfig holds the addresses the IM server listens on. A listener is
+// only started when its address is not empty, so plaintext and TLS can run
+// side by side while clients migrate.
+type listenConfig struct {
+	tcpHostPort string
+	tlsHostPort string
+	tlsCertFile string
+	tlsKeyFile  string
+	cluster     clusterConfig
+}
+
+// clusterConfig joins the server to other nodes. Without node the server
+// runs alone with an in-memory presence registry.
+type clusterConfig struct {
+	// node is the address other nodes forward packets to, and nodeHostPort
+	// the address it listens on.
+	node         string
+	nodeHostPort string
+	// registryHostPort is the shared presence registry. A node with
+	// registryListen set serves it for the others.
+	registryHostPort string
+	registryListen   string
+	// secret authenticates the nodes and the registry to each other.
+	secret string
+}
+
+// loadConfig reads config_imserver.json. Without it the server listens on
+// TcpHostPort in plaintext with the default connection limits.
+func loadConfig() (lc listenConfig) {
+	lc.tcpHostPort = TcpHostPort
+	cfg, err := config.LoadConfigFile(utils.ApplicationPath() + "/" + imserverConfigFilename)
+	if err != nil {
+		logs.Logger.Warn("Load imserver config failed, only listen plaintext on ", TcpHostPort, ": ", err)
+		return
+	}
+	lc.tcpHostPort, _ = cfg.GetString("tcp_host_port")
+	lc.tlsHostPort, _ = cfg.GetString("tls_host_port")
+	if len(lc.tlsHostPort) > 0 {
+		lc.tlsCertFile, err = cfg.GetString("tls_cert_file")
+		if err != nil {
+			logs.Logger.Critical("Load tls cert file from config error: ", err)
+			os.Exit(1)
+		}
+		lc.tlsKeyFile, err = cfg.GetString("tls_key_file")
+		if err != nil {
+			logs.Logger.Critical("Load tls key file from config error: ", err)
+			os.Exit(1)
+		}
+		if !filepath.IsAbs(lc.tlsCertFile) {
+			lc.tlsCertFile = filepath.Join(utils.ApplicationPath(), lc.tlsCertFile)
+		}
+		if !filepath.IsAbs(lc.tlsKeyFile) {
+			lc.tlsKeyFile = filepath.Join(utils.ApplicationPath(), lc.tlsKeyFile)
+		}
+	}
+	loadWriteQueueConfig(cfg)
+	loadAdmissionConfig(cfg)
+	loadSessionConfig(cfg)
+	loadHandlerConfig(cfg)
+	lc.cluster = loadClusterConfig(cfg)
+	return
+}
+
+func loadClusterConfig(cfg *config.Config) (cc clusterConfig) {
+	cc.node, _ = cfg.GetString("cluster_node")
+	if len(cc.node) == 0 {
+		return
+	}
+	cc.nodeHostPort, _ = cfg.GetString("cluster_host_port")
+	if len(cc.nodeHostPort) == 0 {
+		cc.nodeHostPort = cc.node
+	}
+	cc.registryListen, _ = cfg.GetString("registry_listen_host_port")
+	var err error
+	cc.secret, err = cfg.GetString("cluster_secret")
+	if err != nil || len(cc.secret) == 0 {
+		logs.Logger.Critical("Load cluster secret from config error: ", err)
+		os.Exit(1)
+	}
+	cc.registryHostPort, err = cfg.GetString("registry_host_port")
+	if err != nil {
+		logs.Logger.Critical("Load registry host port from config error: ", err)
+		os.Exit(1)
+	}
+	return
+}
+
+// startCluster shares presences through the registry and forwards packets
+// to the other nodes. It must run before connections.StartManagePresences.
+func startCluster(cc clusterConfig) {
+	if len(cc.node) == 0 {
+		return
+	}
+	if len(cc.registryListen) > 0 {
+		listener, err := net.Listen("tcp", cc.registryListen)
+		if err != nil {
+			log.Fatal("Starting presence registry error!", err.Error())
+		}
+		logs.Logger.Info("presence registry listen on ", cc.registryListen)
+		registryListener = listener
+		go cluster.ServeRegistry(listener, cluster.NewMemoryRegistry(), []byte(cc.secret))
+	}
+	connections.Registry = cluster.NewRemoteRegistry(cc.registryHostPort, []byte(cc.secret))
+	connections.LocalNode = cc.node
+	err := cmdhandler.StartCluster(cc.node, cc.nodeHostPort, []byte(cc.secret))
+	if err != nil {
+		log.Fatal("Starting cluster node error!", err.Error())
+	}
+	logs.Logger.Info("cluster node ", cc.node, " listen on ", cc.nodeHostPort, " registry ", cc.registryHostPort)
+}
+
+func loadWriteQueueConfig(cfg *config.Config) {
+	if maxPackets, err := cfg.GetInt("write_queue_max_packets"); err == nil && maxPackets > 0 {
+		connections.WriteQueueMaxPackets = maxPackets
+	}
+	if maxBytes, err := cfg.GetInt("write_queue_max_bytes"); err == nil && maxBytes > 0 {
+		connections.WriteQueueMaxBytes = maxBytes
+	}
+	if maxOverflows, err := cfg.GetInt("slow_consumer_max_overflows"); err == nil && maxOverflows > 0 {
+		connections.SlowConsumerMaxOverflows = maxOverflows
+	}
+	logs.Logger.Info("write queue max packets: ", connections.WriteQueueMaxPackets, " max bytes: ", connections.WriteQueueMaxBytes, " slow consumer max overflows: ", connections.SlowConsumerMaxOverflows)
+}
+
+// loadAdmissionConfig reads the connection and rate limits. cmd_rate and
+// cmd_burst set the default packet rate of every cmd, cmd_rate_0x10 and
+// cmd_burst_0x10 override it for cmd 0x10.
+func loadAdmissionConfig(cfg *config.Config) {
+	if maxConns, err := cfg.GetInt("max_connections_per_ip"); err == nil && maxConns > 0 {
+		connections.MaxConnectionsPerIP = maxConns
+	}
+	if attempts, err := cfg.GetInt("auth_attempts_per_account"); err == nil && attempts > 0 {
+		connections.AuthAttemptsPerAccount = attempts
+	}
+	if attempts, err := cfg.GetInt("auth_attempts_per_ip"); err == nil && attempts > 0 {
+		connections.AuthAttemptsPerIP = attempts
+	}
+	connections.DefaultCmdRate = loadCmdRate(cfg, "cmd_rate", "cmd_burst", connections.DefaultCmdRate)
+	for cmd := 0; cmd <= 0xFF; cmd++ {
+		suffix := fmt.Sprintf("_0x%02x", cmd)
+		rate := loadCmdRate(cfg, "cmd_rate"+suffix, "cmd_burst"+suffix, connections.CmdRate{})
+		if rate.Rate > 0 {
+			if rate.Burst <= 0 {
+				rate.Burst = connections.DefaultCmdRate.Burst
+			}
+			connections.CmdRates[uint8(cmd)] = rate
+		}
+	}
+	logs.Logger.Info("max connections per ip: ", connections.MaxConnectionsPerIP, " auth attempts per account: ", connections.AuthAttemptsPerAccount, " per ip: ", connections.AuthAttemptsPerIP, " cmd rate: ", connections.DefaultCmdRate, " overrides: ", connections.CmdRates)
+}
+
+// loadSessionConfig reads how many sessions of one terminal type an account
+// may have. max_sessions sets the default, max_sessions_1 overrides it for
+// terminal type 1. Account policies stored in sessionlimits take precedence.
+func loadSessionConfig(cfg *config.Config) {
+	if max, err := cfg.GetInt("max_sessions"); err == nil && max > 0 {
+		users.DefaultMaxSessions = max
+	}
+	for terminalType := users.TerminalType_PC; terminalType <= users.TerminalType_Web; terminalType++ {
+		if max, err := cfg.GetInt(fmt.Sprintf("max_sessions_%d", terminalType)); err == nil && max > 0 {
+			users.MaxSessions[terminalType] = max
+		}
+	}
+	logs.Logger.Info("max sessions per terminal type: ", users.DefaultMaxSessions, " overrides: ", users.MaxSessions)
+}
+
+// loadHandlerConfig reads how many packets are handled at the same time and
+// how many requests and responses of one connection may wait.
+func loadHandlerConfig(cfg *config.Config) {
+	if workers, err := cfg.GetInt("handler_workers"); err == nil && workers > 0 {
+		cmdhandler.HandlerWorkers = workers
+	}
+	if maxPackets, err := cfg.GetInt("conn_queue_max_packets"); err == nil && maxPackets > 0 {
+		cmdhandler.ConnQueueMaxPackets = maxPackets
+	}
+	if maxResponses, err := cfg.GetInt("conn_queue_max_responses"); err == nil && maxResponses >= 0 {
+		cmdhandler.ConnQueueMaxResponses = maxResponses
+	}
+	logs.Logger.Info("handler workers: ", cmdhandler.HandlerWorkers, " conn queue max packets: ", cmdhandler.ConnQueueMaxPackets, " max responses: ", cmdhandler.ConnQueueMaxResponses)
+}
+
+func loadCmdRate(cfg *config.Config, rateKey, burstKey string, def connections.CmdRate) (rate connections.CmdRate) {
+	rate = def
+	if r, err := cfg.GetFloat64(rateKey); err == nil && r > 0 {
+		rate.Rate = r
+	}
+	if b, err := cfg.GetFloat64(burstKey); err == nil && b > 0 {
+		rate.Burst = b
+	}
+	return
+}
+
 func Start() {
 	log.Println("Starting IM Server...")
 	logs.Logger.Info("Starting IM Server...")
 
-	listener, err := net.Listen("tcp", TcpHostPort)
-	if err != nil {
-		log.Fatal("Starting IM Server error!", err.Error())
-		os.Exit(1)
+	lc := loadConfig()
+	if len(lc.tcpHostPort) == 0 && len(lc.tlsHostPort) == 0 {
+		log.Fatal("Starting IM Server error! No listen address configured.")
 	}
 
+	if len(lc.tcpHostPort) > 0 {
+		listener, err := net.Listen("tcp", lc.tcpHostPort)
+		if err != nil {
+			log.Fatal("Starting IM Server error!", err.Error())
+			os.Exit(1)
+		}
+		logs.Logger.Info("IM Server listen on ", lc.tcpHostPort)
+		listeners = append(listeners, listener)
+	}
+	if len(lc.tlsHostPort) > 0 {
+		listener, err := listenTLS(lc.tlsHostPort, lc.tlsCertFile, lc.tlsKeyFile)
+		if err != nil {
+			log.Fatal("Starting IM Server tls listener error!", err.Error())
+			os.Exit(1)
+		}
+		logs.Logger.Info("IM Server listen tls on ", lc.tlsHostPort)
+		listeners = append(listeners, listener)
+	}
+
+	startCluster(lc.cluster)
 	connections.StartManagePresences()
 
-	cmdhandlers := cmdhandler.NewCmdHanglers()
+	cmdhandlers = cmdhandler.NewCmdHanglers()
+	webserver.StartWebSocket(cmdhandlers.PacketQueue)
 
 	log.Println("Starting IM server successful!")
 	logs.Logger.Info("Starting IM Server successful.")
+	for _, listener := range listeners {
+		go serve(listener, cmdhandlers.PacketQueue)
+	}
+}
+
+// Stop shuts the server down without losing messages: it stops accepting,
+// asks clients to reconnect elsewhere, handles the packets already received
+// and flushes the responses before closing the connections.
+func Stop() {
+	log.Println("Stopping IM Server...")
+	logs.Logger.Info("Stopping IM Server...")
+	atomic.StoreInt32(&stopping, 1)
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	webserver.StopWebSocket()
+	if cmdhandlers == nil {
+		return
+	}
+
+	cmdhandler.SendShutdownNotification(ReconnectSpread)
+	connections.StopReading(DrainDuration)
+	cmdhandlers.Stop(DrainDuration)
+	connections.CloseAll(DrainDuration)
+	connections.StopPresences(DrainDuration)
+	cmdhandler.StopCluster()
+	if registryListener != nil {
+		registryListener.Close()
+	}
+	log.Println("Stopping IM Server successful.")
+	logs.Logger.Info("Stopping IM Server successful.")
+}
+
+func listenTLS(hostPort, certFile, keyFile string) (listener net.Listener, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	listener, err = tls.Listen("tcp", hostPort, tlsConfig)
+	return
+}
+
+func serve(listener net.Listener, packetQueue chan connections.Packet) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
+		if err != nil && atomic.LoadInt32(&stopping) == 1 {
+			return
+		} else if err != nil {
 			logs.Logger.Critical("Client connect listener error!", err)
 			continue
 		}
 		logs.Logger.Info("New client connected in:", conn.RemoteAddr())
-		connections.New(conn, cmdhandlers.PacketQueue)
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			// Admit before the handshake, so an IP cannot make the server
+			// run more than MaxConnectionsPerIP of them. A refused conn
+			// gets no error packet, which would need the handshake.
+			host, admitted := connections.Admit(conn)
+			if !admitted {
+				conn.Close()
+				continue
+			}
+			go handshakeTLS(tlsConn, host, packetQueue)
+		} else {
+			connections.Accept(conn, packetQueue)
+		}
 	}
 }
 
-func Stop() {
-
+// handshakeTLS finishes the handshake before the connection is handed over,
+// so the short read deadlines used by connections never interrupt it. conn
+// was admitted for host.
+func handshakeTLS(conn *tls.Conn, host string, packetQueue chan connections.Packet) {
+	conn.SetDeadline(time.Now().Add(connections.AuthDuration))
+	err := conn.Handshake()
+	if err != nil {
+		logs.Logger.Warn("tls handshake error: ", err, " addr: ", conn.RemoteAddr())
+		conn.Close()
+		connections.ReleaseAdmission(host)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	connections.AcceptAdmitted(conn, host, packetQueue)
 }
@@ -0,0 +1,255 @@
+package imserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"hug/imserver/connections"
+	"hug/logs"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	logs.DisableLog()
+}
+
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"hug test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTLSHandshakeAndFraming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hug-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, pool := writeSelfSignedCert(t, dir)
+
+	listener, err := listenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetQueue := make(chan connections.Packet, 1)
+	go serve(listener, packetQueue)
+
+	client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	reqData := []byte(`{"u":"dXNlcg==","p":"cGFzcw=="}`)
+	// 0x55, 0x05 and 0x04 force DLE escaping inside the encrypted stream.
+	reqData = append(reqData, connections.Pkt_STX, connections.Pkt_DLE, connections.Pkt_ETX)
+	sendBuf, err := connections.PrepareSendPacket(1, connections.Pkt_Type_Request, 0, 0x1234, reqData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split the frame so the server has to reassemble it across reads.
+	half := len(sendBuf) / 2
+	if _, err = client.Write(sendBuf[:half]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err = client.Write(sendBuf[half:]); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkt connections.Packet
+	select {
+	case pkt = <-packetQueue:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not receive packet")
+	}
+	if pkt.Cmd != 1 || pkt.PktType != connections.Pkt_Type_Request || pkt.Sid != 0x1234 {
+		t.Fatalf("got cmd %d type %d sid 0x%04x", pkt.Cmd, pkt.PktType, pkt.Sid)
+	}
+	if !bytes.Equal(pkt.Data, reqData) {
+		t.Fatalf("got data %v, expect %v", pkt.Data, reqData)
+	}
+
+	resData := []byte(`{"c":0}`)
+	err = pkt.Conn.WritePacket(1, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	received := make([]byte, 0, 256)
+	buf := make([]byte, 256)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+		res, found := connections.ParseReceivedData(&received)
+		if found {
+			if res.Cmd != 1 || res.PktType != connections.Pkt_Type_Response || res.Sid != 0x1234 {
+				t.Fatalf("got cmd %d type %d sid 0x%04x", res.Cmd, res.PktType, res.Sid)
+			}
+			if !bytes.Equal(res.Data, resData) {
+				t.Fatalf("got data %s, expect %s", res.Data, resData)
+			}
+			break
+		}
+	}
+}
+
+func TestTLSRejectsPlaintextClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hug-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _ := writeSelfSignedCert(t, dir)
+
+	listener, err := listenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetQueue := make(chan connections.Packet, 1)
+	go serve(listener, packetQueue)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sendBuf, err := connections.PrepareSendPacket(1, connections.Pkt_Type_Request, 0, 1, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(sendBuf)
+
+	select {
+	case <-packetQueue:
+		t.Fatal("plaintext packet accepted on tls listener")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestTLSAdmitsBeforeHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hug-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, pool := writeSelfSignedCert(t, dir)
+
+	listener, err := listenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serve(listener, make(chan connections.Packet, 1))
+	addr := listener.Addr().String()
+	tlsConfig := &tls.Config{RootCAs: pool}
+
+	// Wait until the connections of the other tests are released. The
+	// first admission orders the limit change after the Admit calls of
+	// their listeners.
+	probeListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probeListener.Close()
+	probe, err := net.Dial("tcp", probeListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, ok := connections.Admit(probe); ok {
+		connections.ReleaseAdmission(host)
+	}
+	defer func(max int) { connections.MaxConnectionsPerIP = max }(connections.MaxConnectionsPerIP)
+	connections.MaxConnectionsPerIP = 1
+	for {
+		host, ok := connections.Admit(probe)
+		if ok {
+			connections.ReleaseAdmission(host)
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	probe.Close()
+
+	// A connection which never handshakes holds the only admission.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := connections.RejectedConnections()
+	if client, err := tls.Dial("tcp", addr, tlsConfig); err == nil {
+		client.Close()
+		t.Fatal("second connection from the same ip handshaked")
+	}
+	if connections.RejectedConnections() != rejected+1 {
+		t.Error("refused connection not counted")
+	}
+
+	// Its failed handshake gives the admission back.
+	idle.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		client, err := tls.Dial("tcp", addr, tlsConfig)
+		if err == nil {
+			client.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection refused after the idle one closed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"hug/udpserver"
 	"hug/webserver"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 )
 
 func main() {
@@ -18,15 +21,21 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	core.Start()
-	defer core.Stop()
-
 	webserver.Start()
-	defer webserver.Stop()
-
 	udpserver.Start()
-	defer udpserver.Stop()
-
 	imserver.Start()
-	defer imserver.Stop()
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Println("Received signal", sig, ", stopping server...")
+	logs.Logger.Info("Received signal ", sig, ", stopping server...")
+
+	// The IM server goes first so handlers still have the databases while
+	// they drain.
+	imserver.Stop()
+	webserver.Stop()
+	udpserver.Stop()
+	core.Stop()
+	logs.Logger.Flush()
 }
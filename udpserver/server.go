@@ -4,6 +4,7 @@ import (
 	"hug/logs"
 	"hug/udpserver/udp_repacker"
 	"net"
+	"sync/atomic"
 )
 
 const (
@@ -13,6 +14,8 @@ const (
 var (
 	Conn *net.UDPConn
 	rp   *udp_repacker.UDPRepacker
+
+	stopping int32
 )
 
 func Start() {
@@ -22,7 +25,11 @@ func Start() {
 }
 
 func Stop() {
-
+	atomic.StoreInt32(&stopping, 1)
+	if Conn != nil {
+		Conn.Close()
+	}
+	logs.Logger.Info("Stopping udp server successful.")
 }
 
 func startListenUdpPort() {
@@ -43,7 +50,9 @@ func startListenUdpPort() {
 		// 读取数据
 		data := make([]byte, 4096)
 		len, remoteAddr, err := socket.ReadFromUDP(data)
-		if err != nil {
+		if err != nil && atomic.LoadInt32(&stopping) == 1 {
+			return
+		} else if err != nil {
 			logs.Logger.Critical("read udp failed!", err)
 			continue
 		}
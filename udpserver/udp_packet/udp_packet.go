@@ -94,16 +94,16 @@ func handlePacket(pkt *UDPStreamPacket) {
 		var conn1 *connections.ClientConnection
 		var conn2 *connections.ClientConnection
 		presence := connections.FindPresences(p1.Uid)
-		for terminal, conn := range presence.Terminals {
-			if terminal == p1.FromTerminal {
+		for _, conn := range presence.Sessions {
+			if conn.AuthInfo.TerminalType == p1.FromTerminal {
 				offline = false
 				conn1 = conn
 				break
 			}
 		}
 		presence = connections.FindPresences(p2.Uid)
-		for terminal, conn := range presence.Terminals {
-			if terminal == p1.FromTerminal {
+		for _, conn := range presence.Sessions {
+			if conn.AuthInfo.TerminalType == p1.FromTerminal {
 				offline = false
 				conn2 = conn
 				break
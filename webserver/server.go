@@ -1,15 +1,24 @@
 package webserver
 
 import (
+	"context"
 	"hug/logs"
 	"log"
 	"net/http"
+	"time"
 )
 
 const (
 	TcpHostPort = "0.0.0.0:5222"
 )
 
+const ShutdownDuration = 5 * time.Second
+
+var (
+	userServer = &http.Server{Addr: UserPort}
+	fileServer = &http.Server{Addr: FilePort}
+)
+
 func Start() {
 	log.Println("Starting web server...")
 	logs.Logger.Info("Starting web server...")
@@ -21,20 +30,33 @@ func Start() {
 	logs.Logger.Info("Starting web server successful.")
 }
 
+// Stop stops accepting requests and waits for running ones, such as
+// uploads, to finish.
 func Stop() {
-
+	logs.Logger.Info("Stopping web server...")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownDuration)
+	defer cancel()
+	err := userServer.Shutdown(ctx)
+	if err != nil {
+		logs.Logger.Warn("stop web user port error: ", err)
+	}
+	err = fileServer.Shutdown(ctx)
+	if err != nil {
+		logs.Logger.Warn("stop web file port error: ", err)
+	}
+	logs.Logger.Info("Stopping web server successful.")
 }
 
 func startListenUserPort() {
-	err := http.ListenAndServe(UserPort, nil) //设置监听的端口
-	if err != nil {
+	err := userServer.ListenAndServe() //设置监听的端口
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("start Listen web user port error: ", err)
 	}
 }
 
 func startListenFilePort() {
-	err := http.ListenAndServe(FilePort, nil) //设置监听的端口
-	if err != nil {
+	err := fileServer.ListenAndServe() //设置监听的端口
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("start Listen web file port error: ", err)
 	}
 }
@@ -0,0 +1,79 @@
+package webserver
+
+import (
+	"golang.org/x/net/websocket"
+	"hug/imserver/connections"
+	"hug/logs"
+	"log"
+	"net"
+	"net/http"
+)
+
+const (
+	WebSocketPath = "/im"
+	WebSocketPort = ":9092"
+)
+
+var webSocketPacketQueue chan connections.Packet
+
+// webSocketServer has a mux of its own, the user and file servers share
+// http.DefaultServeMux and must not serve the IM protocol.
+var webSocketServer = &http.Server{Addr: WebSocketPort, Handler: newWebSocketMux()}
+
+func newWebSocketMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Server{Handler: handleWebSocket})
+	return mux
+}
+
+// webSocketConn reports the address of the browser instead of the origin
+// url that websocket.Conn returns from RemoteAddr.
+type webSocketConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// StartWebSocket serves the IM protocol to web terminals. Every websocket
+// carries the same STX/DLE/ETX framed stream as the tcp listener, and its
+// packets are fed into packetQueue.
+func StartWebSocket(packetQueue chan connections.Packet) {
+	webSocketPacketQueue = packetQueue
+	go startListenWebSocketPort()
+	logs.Logger.Info("init websocket web server successful.")
+}
+
+// StopWebSocket stops accepting websockets. Open ones are connections of the
+// IM server and are closed by it.
+func StopWebSocket() {
+	err := webSocketServer.Close()
+	if err != nil {
+		logs.Logger.Warn("stop web socket port error: ", err)
+	}
+}
+
+func startListenWebSocketPort() {
+	err := webSocketServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("start Listen web socket port error: ", err)
+	}
+}
+
+func handleWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		logs.Logger.Warn("handleWebSocket invalid remote addr: ", ws.Request().RemoteAddr)
+		return
+	}
+	logs.Logger.Info("New web client connected in:", remoteAddr)
+	c, ok := connections.Accept(&webSocketConn{Conn: ws, remoteAddr: remoteAddr}, webSocketPacketQueue)
+	if !ok {
+		logs.Logger.Warn("too many connections, refuse web client: ", remoteAddr)
+		return
+	}
+	<-c.Done()
+}
@@ -0,0 +1,81 @@
+package webserver
+
+import (
+	"bytes"
+	"golang.org/x/net/websocket"
+	"hug/imserver/connections"
+	"hug/logs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logs.DisableLog()
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	webSocketPacketQueue = make(chan connections.Packet, 1)
+	server := httptest.NewServer(webSocketServer.Handler)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + WebSocketPath
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+
+	reqData := []byte(`{"u":"dXNlcg==","p":"cGFzcw==","tt":6}`)
+	sendBuf, err := connections.PrepareSendPacket(1, connections.Pkt_Type_Request, 0, 42, reqData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ws.Write(sendBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkt connections.Packet
+	select {
+	case pkt = <-webSocketPacketQueue:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not receive packet")
+	}
+	if pkt.Cmd != 1 || pkt.Sid != 42 || !bytes.Equal(pkt.Data, reqData) {
+		t.Fatalf("got cmd %d sid %d data %s", pkt.Cmd, pkt.Sid, pkt.Data)
+	}
+	if !strings.HasPrefix(pkt.Conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Fatalf("got remote addr %s", pkt.Conn.RemoteAddr())
+	}
+
+	resData := []byte(`{"c":0}`)
+	err = pkt.Conn.WritePacket(1, connections.Pkt_Type_Response, 0, pkt.Sid, resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var frame []byte
+	if err = websocket.Message.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	res, found := connections.ParseReceivedData(&frame)
+	if !found {
+		t.Fatal("response frame not found")
+	}
+	if res.Sid != 42 || res.PktType != connections.Pkt_Type_Response || !bytes.Equal(res.Data, resData) {
+		t.Fatalf("got sid %d type %d data %s", res.Sid, res.PktType, res.Data)
+	}
+}
+
+func TestWebSocketNotOnDefaultMux(t *testing.T) {
+	req := httptest.NewRequest("GET", WebSocketPath, nil)
+	if _, pattern := http.DefaultServeMux.Handler(req); pattern == WebSocketPath {
+		t.Fatalf("%s served by the mux of the user and file servers", WebSocketPath)
+	}
+	if _, pattern := webSocketServer.Handler.(*http.ServeMux).Handler(req); pattern != WebSocketPath {
+		t.Fatalf("got pattern %q, expect %s", pattern, WebSocketPath)
+	}
+}